@@ -1,16 +1,82 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
 	"strings"
 	"net/http"
+	"sync"
+	"time"
 )
 
+type ComputerKeys struct {
+	MAC	string `json:"mac"`
+	Name	string `json:"name"`
+	IP	string `json:"ip"`
+}
+
 type Notification struct {
 	Level		string `json:"level"`
 	Employee	string `json:"employeeAbbreviation"`
 	Message		string `json:"message"`
+	Version		int `json:"version,omitempty"`
+	ID		string `json:"id,omitempty"`
+	Type		string `json:"type,omitempty"`
+	Count		int `json:"count,omitempty"`
+	Limit		int `json:"limit,omitempty"`
+	Computers	[]ComputerKeys `json:"computers,omitempty"`
+	Time		*time.Time `json:"time,omitempty"`
+}
+
+// Received is a notification as it was recorded.
+type Received struct {
+	Notification
+	Received	time.Time `json:"received"`
+}
+
+// Every notification accepted is kept, so that tests can query them.
+var received = []Received{}
+var receivedAccess sync.Mutex
+
+// secret is shared with SampDB, which signs notifications with it. Without
+// one, signatures are not checked.
+var secret = ""
+
+// maxSkew is how far from now the timestamp of a signed notification may be.
+const maxSkew = 5 * time.Minute
+
+// verify checks the signature SampDB sent along with body: the HMAC-SHA256 of
+// the timestamp, a dot and the body, keyed with the secret.
+func verify(r *http.Request, body []byte) bool {
+	timestamp := r.Header.Get("X-SampDB-Timestamp")
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		fmt.Printf("DummyListener: Missing or invalid timestamp\n")
+		return false
+	}
+	skew := time.Since(time.Unix(sent, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		fmt.Printf("DummyListener: Stale timestamp %s\n", timestamp)
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-SampDB-Signature"))) {
+		fmt.Printf("DummyListener: Invalid signature\n")
+		return false
+	}
+	return true
 }
 
 func notify(w http.ResponseWriter, r *http.Request) {
@@ -20,7 +86,20 @@ func notify(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
-	err := json.NewDecoder(r.Body).Decode(&n)
+	fault := nextFault()
+	if !inject(w, fault) {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if secret != "" && !verify(r, body) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	err = json.Unmarshal(body, &n)
 	if err != nil {
 		fmt.Printf("DummyListener: Wrong JSON object format\b")
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -31,6 +110,7 @@ func notify(w http.ResponseWriter, r *http.Request) {
 	if msgHeader != "INFO" && msgHeader != "WARNING" && msgHeader != "ERROR" {
 		fmt.Printf("DummyListener: Unexpected message level %s\n", n.Level)
 		http.Error(w, "Unknown message type", http.StatusBadRequest)
+		return
 	}
 
 	if n.Employee != "" {
@@ -41,13 +121,91 @@ func notify(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Printf("DummyListener %s: %s\n", msgHeader, n.Message)
 
+	receivedAccess.Lock()
+	received = append(received, Received{ n, time.Now().UTC() })
+	receivedAccess.Unlock()
+
+	if fault.Status != 0 {
+		w.WriteHeader(fault.Status)
+		return
+	}
 	w.WriteHeader(http.StatusCreated)
 }
 
-func main() {
-	http.HandleFunc("/api/notify", notify)
+// notifications returns the notifications received so far, oldest first,
+// optionally those with a level or about an employee only, for GET. It
+// forgets them for DELETE.
+func notifications(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		level := r.URL.Query().Get("level")
+		employee := r.URL.Query().Get("employee")
+
+		found := []Received{}
+		receivedAccess.Lock()
+		for _, n := range(received) {
+			if (level == "" || strings.EqualFold(n.Level, level)) && (employee == "" || n.Employee == employee) {
+				found = append(found, n)
+			}
+		}
+		receivedAccess.Unlock()
 
-	fmt.Println("Starting server on port 8080...")
-	http.ListenAndServe(":8080", nil)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(found)
+	case http.MethodDelete:
+		receivedAccess.Lock()
+		received = []Received{}
+		receivedAccess.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
 }
 
+func main() {
+	flag.StringVar(&secret, "secret", "", "Optional. The secret SampDB signs notifications with, $SAMPDB_NOTIFY_SECRET by default")
+	flag.IntVar(&faults.Status, "status", 0, "Optional. The status code to answer notifications with, instead of 201")
+	delay := flag.Duration("delay", 0, "Optional. How long to wait before answering notifications")
+	flag.BoolVar(&faults.Reset, "reset", false, "Optional. Drop the connection instead of answering notifications")
+	flag.Float64Var(&faults.FailureRate, "failure-rate", 0, "Optional. The share of notifications, between 0 and 1, to answer with 500")
+	sequence := flag.String("sequence", "", "Optional. How to answer the first notifications, e.g. '500,500,reset'")
+	configFile := flag.String("config", "", "Optional. The JSON file holding the address, port and base path, $DUMMYLISTENER_CONFIG by default")
+	flag.String("address", "", "Optional. The address to listen on, all of them by default")
+	flag.Int("port", config.Port, "Optional. The port to listen on, 0 for any free port")
+	flag.String("base-path", config.BasePath, "Optional. The path the endpoints are served under")
+	flag.Parse()
+	if *configFile == "" {
+		*configFile = os.Getenv("DUMMYLISTENER_CONFIG")
+	}
+	err := resolveConfig(*configFile)
+	if err != nil {
+		fmt.Printf("Invalid configuration: %s\n", err.Error())
+		os.Exit(2)
+	}
+	if secret == "" {
+		secret = os.Getenv("SAMPDB_NOTIFY_SECRET")
+	}
+	faults.Delay = Duration(*delay)
+	faults.Sequence, err = parseSequence(*sequence)
+	if err == nil {
+		err = faults.validate()
+	}
+	if err != nil {
+		fmt.Printf("Invalid faults: %s\n", err.Error())
+		os.Exit(2)
+	}
+
+	http.HandleFunc(config.BasePath + "/notify", notify)
+	http.HandleFunc(config.BasePath + "/notifications", notifications)
+	http.HandleFunc(config.BasePath + "/faults", faultsHandler)
+
+	address := net.JoinHostPort(config.Address, strconv.Itoa(config.Port))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		fmt.Printf("Error listening on %s: %s\n", address, err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Starting server on port %d...\n", listener.Addr().(*net.TCPAddr).Port)
+	http.Serve(listener, nil)
+}
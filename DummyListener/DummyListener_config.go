@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config is where DummyListener listens. Port 0 picks a free port. The
+// endpoints are served under BasePath, e.g. BasePath + "/notify".
+type Config struct {
+	Address		string `json:"address"`
+	Port		int `json:"port"`
+	BasePath	string `json:"basePath"`
+}
+
+var config = Config{ Port: 8080, BasePath: "/api" }
+
+// resolveConfig overrides the defaults with configFile, if there is one,
+// then with the environment, then with the flags given.
+func resolveConfig(configFile string) error {
+	if configFile != "" {
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&config)
+		if err != nil {
+			return err
+		}
+	}
+
+	values := map[string]string{}
+	for name, env := range(map[string]string{ "address": "DUMMYLISTENER_ADDRESS", "port": "DUMMYLISTENER_PORT", "base-path": "DUMMYLISTENER_BASE_PATH" }) {
+		if value, ok := os.LookupEnv(env); ok {
+			values[name] = value
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+
+	for name, value := range(values) {
+		switch name {
+		case "address":
+			config.Address = value
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("port must be a number, not '%s'", value)
+			}
+			config.Port = port
+		case "base-path":
+			config.BasePath = value
+		}
+	}
+
+	if config.Port < 0 || config.Port > 65535 {
+		return fmt.Errorf("port %d is not between 0 and 65535", config.Port)
+	}
+	config.BasePath = strings.TrimSuffix(config.BasePath, "/")
+	if config.BasePath != "" && !strings.HasPrefix(config.BasePath, "/") {
+		return fmt.Errorf("base path '%s' must start with /", config.BasePath)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Duration is a time.Duration written as in Go, e.g. "1.5s", in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Fault is how DummyListener answers one notification: after Delay, with
+// Status (201 Created by default) or, with Reset, by dropping the connection.
+type Fault struct {
+	Status	int `json:"status,omitempty"`
+	Delay	Duration `json:"delay,omitempty"`
+	Reset	bool `json:"reset,omitempty"`
+}
+
+// Faults script the answers of DummyListener. The faults of Sequence are
+// used one per notification, in order. Once it's used up, notifications get
+// the default Fault, except for a share of them, FailureRate between 0 and
+// 1, which get 500 Internal Server Error.
+type Faults struct {
+	Fault
+	FailureRate	float64 `json:"failureRate,omitempty"`
+	Sequence	[]Fault `json:"sequence,omitempty"`
+}
+
+func (f Faults) validate() error {
+	if f.FailureRate < 0 || f.FailureRate > 1 {
+		return fmt.Errorf("failure rate %g is not between 0 and 1", f.FailureRate)
+	}
+	for _, fault := range(append([]Fault{ f.Fault }, f.Sequence...)) {
+		if fault.Status != 0 && (fault.Status < 100 || fault.Status > 599) {
+			return fmt.Errorf("invalid status %d", fault.Status)
+		}
+		if fault.Delay < 0 {
+			return fmt.Errorf("negative delay %s", time.Duration(fault.Delay))
+		}
+	}
+	return nil
+}
+
+var faults Faults
+var faultsAccess sync.Mutex
+
+// nextFault returns the fault for the notification being received.
+func nextFault() Fault {
+	faultsAccess.Lock()
+	defer faultsAccess.Unlock()
+	if len(faults.Sequence) > 0 {
+		fault := faults.Sequence[0]
+		faults.Sequence = faults.Sequence[1:]
+		return fault
+	}
+	fault := faults.Fault
+	if faults.FailureRate > 0 && rand.Float64() < faults.FailureRate {
+		fault.Status = http.StatusInternalServerError
+	}
+	return fault
+}
+
+// inject applies fault to the request being served. It returns false if the
+// request was answered, or dropped, and must not be processed.
+func inject(w http.ResponseWriter, fault Fault) bool {
+	time.Sleep(time.Duration(fault.Delay))
+	if fault.Reset {
+		fmt.Printf("DummyListener: Dropping the connection\n")
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "Connection can't be dropped", http.StatusInternalServerError)
+			return false
+		}
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			return false
+		}
+		// Closing right away, without lingering, resets the connection.
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetLinger(0)
+		}
+		conn.Close()
+		return false
+	}
+	if fault.Status != 0 && (fault.Status < 200 || fault.Status > 299) {
+		fmt.Printf("DummyListener: Answering %d\n", fault.Status)
+		http.Error(w, http.StatusText(fault.Status), fault.Status)
+		return false
+	}
+	return true
+}
+
+// faultsHandler returns the faults for GET, replaces them with those in the
+// body for PUT, and clears them for DELETE.
+func faultsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		faultsAccess.Lock()
+		f := faults
+		faultsAccess.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f)
+	case http.MethodPut:
+		var f Faults
+		err := json.NewDecoder(r.Body).Decode(&f)
+		if err == nil {
+			err = f.validate()
+		}
+		if err != nil {
+			http.Error(w, "Invalid faults: " + err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		faultsAccess.Lock()
+		faults = f
+		faultsAccess.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		faultsAccess.Lock()
+		faults = Faults{}
+		faultsAccess.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseSequence reads a sequence of faults from a comma separated list of
+// status codes and "reset", e.g. "500,500,201" to fail twice then succeed.
+func parseSequence(s string) ([]Fault, error) {
+	var sequence []Fault
+	if s == "" {
+		return nil, nil
+	}
+	for _, item := range(strings.Split(s, ",")) {
+		item = strings.TrimSpace(item)
+		if item == "reset" {
+			sequence = append(sequence, Fault{ Reset: true })
+			continue
+		}
+		status, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is neither a status code nor 'reset'", item)
+		}
+		sequence = append(sequence, Fault{ Status: status })
+	}
+	return sequence, nil
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"net"
 	"net/http"
-	"bytes"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // Data is the structure that holds the data to be written or read
@@ -15,6 +23,9 @@ type Computer struct {
 	IP		string `json:"ip"`
 	Assignee	string `json:"assignee"`
 	Description	string `json:"description"`
+	// Revision is bumped by the data store on every change, and is
+	// exposed through ETags rather than in the JSON object.
+	Revision	int `json:"-"`
 }
 
 type Assignment struct {
@@ -22,63 +33,78 @@ type Assignment struct {
 	Assignee	string `json:"assignee"`
 }
 
-type Notification struct {
-        Level           string `json:"level"`
-        Employee        string `json:"employeeAbbreviation"`
-        Message         string `json:"message"`
-}
-
-func notify(emp string, numAssigned int) int {
+// notify queues an over-assignment warning. It is delivered by runOutbox, so
+// that a listener that is down doesn't fail the request that caused it.
+// Repeats within notifyWindow are only recorded, unless the number of
+// computers went up, and they don't print the warning either.
+func notify(emp string, cl []Computer, limit int) error {
 
-	fmt.Printf("Warning: Employee [%s] has been assigned %d computers!\n", emp, numAssigned)
+	n := overAssignment(emp, cl, limit)
 
-	var n = Notification {
-		"Warning",
-		emp,
-		fmt.Sprintf("Over-assignement warning: Employee %s is now assigned %d computers.", emp, numAssigned),
+	dataAccess.Lock()
+	defer dataAccess.Unlock()
+	if suppressed(emp, typeOverAssignment, n.Count, n.Time) {
+		return recordSuppressed(n, n.Time)
 	}
 
-	jsonData, err := json.Marshal(n)
-        if err != nil {
-		fmt.Fprintf(os.Stderr, "Notification service: Error marshalling JSON object.")
-                return -1
-	}
+	fmt.Printf("Warning: Employee [%s] has been assigned %d computers!\n", emp, len(cl))
+
+	return enqueueNotification(n)
+}
+
+// etag formats the revision of a computer as an HTTP entity tag.
+func etag(revision int) string {
+	return fmt.Sprintf("\"%d\"", revision)
+}
 
-	const listenerURL = "http://localhost:8080/api/notify"
-	resp, err := http.Post(listenerURL, "application/json", bytes.NewBuffer(jsonData))
+// checkIfMatch compares the If-Match header of r, if there is one, with the
+// current revision of the computer. It must be called with dataAccess held,
+// so that the computer can't change before the caller is done with it.
+func checkIfMatch(r *http.Request, keytype, key string) error {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return nil
+	}
+	err, c := dataStore.Read(keytype, key)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Notification service: Error sending object (is the listener running?\n")
-		return -1
+		return err
 	}
-	defer resp.Body.Close()
-
-	return resp.StatusCode
+	for _, tag := range(strings.Split(header, ",")) {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag(c.Revision) {
+			return nil
+		}
+	}
+	return errStale
 }
 
-func checkEmployee (emp string) int {
+// checkEmployee warns about employees with more computers than their policy
+// allows. The change that triggered it is already stored, so failures are
+// only logged.
+func checkEmployee (emp string) {
 
 	dataAccess.Lock()
 	err, cl := dataStore.ReadAll(KeyAssignee, emp)
+	policy := policyFor(dataStore, emp)
 	dataAccess.Unlock()
 
 	if err == errNotFound {
-		return 0
+		return
 	} else if err != nil {
-		return http.StatusInternalServerError
-	}
-
-	if len(cl) > 2 {
-		resp := notify(emp, len(cl))
-		if resp < 0 {
-			return resp
-		} else if resp != http.StatusCreated {
-			fmt.Printf("Notification returned %d\n", resp)
-			return -1
-		} else {
-			return 0
+		fmt.Fprintf(os.Stderr, "Error checking assignments of %s: %s\n", emp, err.Error())
+		return
+	}
+
+	if len(cl) > policy.Limit {
+		err = notify(emp, cl, policy.Limit)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error queuing notification for %s: %s\n", emp, err.Error())
 		}
+	} else {
+		dataAccess.Lock()
+		forgetNotified(emp, typeOverAssignment)
+		dataAccess.Unlock()
 	}
-	return 0
 }
 
 func addComputer(w http.ResponseWriter, r *http.Request) {
@@ -96,25 +122,30 @@ func addComputer(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing mandatory property.", http.StatusBadRequest)
 		return
 	}
-	if c.Assignee != "" && len(c.Assignee) != 3 {
-		http.Error(w, "'assignee' field is restricted to 3-letter employee codes.", http.StatusBadRequest)
-		return // TODO: Reconsider limitation for future-proofing
+	if c.Assignee != "" && !validEmployeeCode(c.Assignee) {
+		http.Error(w, "'assignee' field must match the employee code format " + employeeCodeFormat.String() + ".", http.StatusBadRequest)
+		return
 	}
 
 	dataAccess.Lock()
-	err = dataStore.Add(c)
+	err = checkArchivedKeys(c)
+	if err == nil {
+		err = addWithHistory(c, actor(r), force(r))
+	}
 	dataAccess.Unlock()
 
-	if err != nil {
+	if assigneeError(w, err) || quotaError(w, err) {
+		return
+	} else if err == errArchivedKey {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	if c.Assignee != "" {
-		if checkEmployee(c.Assignee) < 0 {
-			http.Error(w, "Error reporting over-assignement.", http.StatusInternalServerError)
-			return
-		}
+		checkEmployee(c.Assignee)
 	}
 
 	w.WriteHeader(http.StatusCreated)
@@ -138,6 +169,7 @@ func getComputerByMAC(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("ETag", etag(c.Revision))
 	json.NewEncoder(w).Encode(*c)
 }
 
@@ -160,6 +192,7 @@ func getComputerByName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", etag(c.Revision))
 	json.NewEncoder(w).Encode(*c)
 }
 
@@ -182,6 +215,7 @@ func getComputerByIP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", etag(c.Revision))
 	json.NewEncoder(w).Encode(*c)
 }
 
@@ -267,16 +301,24 @@ func assignComputerByMAC(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing mandatory property 'assignee'.", http.StatusBadRequest)
 		return
 	}
-	if len(a.Assignee) != 3 {
-		http.Error(w, "'assignee' field is restricted to 3-letter employee codes.", http.StatusBadRequest)
-		return // TODO: Reconsider limitation for future-proofing
+	if !validEmployeeCode(a.Assignee) {
+		http.Error(w, "'assignee' field must match the employee code format " + employeeCodeFormat.String() + ".", http.StatusBadRequest)
+		return
 	}
 
 	dataAccess.Lock()
-	err = dataStore.Assign(KeyMAC, a.Key, a.Assignee)
+	err = checkIfMatch(r, KeyMAC, a.Key)
+	if err == nil {
+		err = assignWithHistory(KeyMAC, a.Key, a.Assignee, actor(r), force(r))
+	}
 	dataAccess.Unlock()
 
-	if err == errNotFound {
+	if assigneeError(w, err) || quotaError(w, err) {
+		return
+	} else if err == errStale {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	} else if err == errNotFound {
 		http.Error(w, "Error items not found", http.StatusNotFound)
 		return
 	} else if err != nil {
@@ -284,11 +326,7 @@ func assignComputerByMAC(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if checkEmployee(a.Assignee) < 0 {
-		fmt.Printf("Error reporting over-assignement.")
-		http.Error(w, "Error reporting over-assignement", http.StatusInternalServerError)
-		return
-	}
+	checkEmployee(a.Assignee)
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -312,16 +350,24 @@ func assignComputerByName(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing mandatory property 'assignee'.", http.StatusBadRequest)
 		return
 	}
-	if len(a.Assignee) != 3 {
-		http.Error(w, "'assignee' field is restricted to 3-letter employee codes.", http.StatusBadRequest)
-		return // TODO: Reconsider limitation for future-proofing
+	if !validEmployeeCode(a.Assignee) {
+		http.Error(w, "'assignee' field must match the employee code format " + employeeCodeFormat.String() + ".", http.StatusBadRequest)
+		return
 	}
 
 	dataAccess.Lock()
-	err = dataStore.Assign(KeyName, a.Key, a.Assignee)
+	err = checkIfMatch(r, KeyName, a.Key)
+	if err == nil {
+		err = assignWithHistory(KeyName, a.Key, a.Assignee, actor(r), force(r))
+	}
 	dataAccess.Unlock()
 
-	if err == errNotFound {
+	if assigneeError(w, err) || quotaError(w, err) {
+		return
+	} else if err == errStale {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	} else if err == errNotFound {
 		http.Error(w, "Error items not found", http.StatusNotFound)
 		return
 	} else if err != nil {
@@ -329,11 +375,7 @@ func assignComputerByName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if checkEmployee(a.Assignee) < 0 {
-		fmt.Printf("Error reporting over-assignement.")
-		http.Error(w, "Error reporting over-assignement", http.StatusInternalServerError)
-		return
-	}
+	checkEmployee(a.Assignee)
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -357,16 +399,24 @@ func assignComputerByIP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing mandatory property 'assignee'.", http.StatusBadRequest)
 		return
 	}
-	if len(a.Assignee) != 3 {
-		http.Error(w, "'assignee' field is restricted to 3-letter employee codes.", http.StatusBadRequest)
-		return // TODO: Reconsider limitation for future-proofing
+	if !validEmployeeCode(a.Assignee) {
+		http.Error(w, "'assignee' field must match the employee code format " + employeeCodeFormat.String() + ".", http.StatusBadRequest)
+		return
 	}
 
 	dataAccess.Lock()
-	err = dataStore.Assign(KeyIP, a.Key, a.Assignee)
+	err = checkIfMatch(r, KeyIP, a.Key)
+	if err == nil {
+		err = assignWithHistory(KeyIP, a.Key, a.Assignee, actor(r), force(r))
+	}
 	dataAccess.Unlock()
 
-	if err == errNotFound {
+	if assigneeError(w, err) || quotaError(w, err) {
+		return
+	} else if err == errStale {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	} else if err == errNotFound {
 		http.Error(w, "Error items not found", http.StatusNotFound)
 		return
 	} else if err != nil {
@@ -374,11 +424,7 @@ func assignComputerByIP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if checkEmployee(a.Assignee) < 0 {
-		fmt.Printf("Error reporting over-assignement.")
-		http.Error(w, "Error reporting over-assignement", http.StatusInternalServerError)
-		return
-	}
+	checkEmployee(a.Assignee)
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -391,10 +437,16 @@ func unassignComputerByMAC(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("mac")
 
 	dataAccess.Lock()
-	err := dataStore.Unassign(KeyMAC, key)
+	err := checkIfMatch(r, KeyMAC, key)
+	if err == nil {
+		err = assignWithHistory(KeyMAC, key, "", actor(r), false)
+	}
 	dataAccess.Unlock()
 
-	if err == errNotFound {
+	if err == errStale {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	} else if err == errNotFound {
 		http.Error(w, "Key not found", http.StatusNotFound)
 		return
 	} else if err != nil {
@@ -413,10 +465,16 @@ func unassignComputerByName(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("name")
 
 	dataAccess.Lock()
-	err := dataStore.Unassign(KeyName, key)
+	err := checkIfMatch(r, KeyName, key)
+	if err == nil {
+		err = assignWithHistory(KeyName, key, "", actor(r), false)
+	}
 	dataAccess.Unlock()
 
-	if err == errNotFound {
+	if err == errStale {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	} else if err == errNotFound {
 		http.Error(w, "Key not found", http.StatusNotFound)
 		return
 	} else if err != nil {
@@ -435,10 +493,16 @@ func unassignComputerByIP(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("ip")
 
 	dataAccess.Lock()
-	err := dataStore.Unassign(KeyName, key)
+	err := checkIfMatch(r, KeyIP, key)
+	if err == nil {
+		err = assignWithHistory(KeyIP, key, "", actor(r), false)
+	}
 	dataAccess.Unlock()
 
-	if err == errNotFound {
+	if err == errStale {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	} else if err == errNotFound {
 		http.Error(w, "Key not found", http.StatusNotFound)
 		return
 	} else if err != nil {
@@ -457,10 +521,16 @@ func deleteComputerByMAC(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("mac")
 
 	dataAccess.Lock()
-	err := dataStore.Delete(KeyMAC, key)
+	err := checkIfMatch(r, KeyMAC, key)
+	if err == nil {
+		err = archiveWithHistory(KeyMAC, key, r.URL.Query().Get("reason"), actor(r))
+	}
 	dataAccess.Unlock()
 
-	if err == errNotFound {
+	if err == errStale {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	} else if err == errNotFound {
 		http.Error(w, "Key not found", http.StatusNotFound)
 		return
 	} else if err != nil {
@@ -479,11 +549,18 @@ func deleteComputerByName(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("name")
 
 	dataAccess.Lock()
-	err := dataStore.Delete(KeyName, key)
+	err := checkIfMatch(r, KeyName, key)
+	if err == nil {
+		err = archiveWithHistory(KeyName, key, r.URL.Query().Get("reason"), actor(r))
+	}
 	dataAccess.Unlock()
 
-	if err == errNotFound {
+	if err == errStale {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	} else if err == errNotFound {
 		http.Error(w, "Key not found", http.StatusNotFound)
+		return
 	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -500,11 +577,18 @@ func deleteComputerByIP(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("ip")
 
 	dataAccess.Lock()
-	err := dataStore.Delete(KeyIP, key)
+	err := checkIfMatch(r, KeyIP, key)
+	if err == nil {
+		err = archiveWithHistory(KeyIP, key, r.URL.Query().Get("reason"), actor(r))
+	}
 	dataAccess.Unlock()
 
-	if err == errNotFound {
+	if err == errStale {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	} else if err == errNotFound {
 		http.Error(w, "Key not found", http.StatusNotFound)
+		return
 	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -514,35 +598,112 @@ func deleteComputerByIP(w http.ResponseWriter, r *http.Request) {
 }
 
 var dataStore dataInterface
+var dataAccess sync.Mutex
 
 func main() {
-	storagetype := flag.String("storage-type", "", "the type of storage to use ('volatile', 'json' or 'sqlite'")
-	file := flag.String("file", "", "Optional. The file to use as database")
+	if len(os.Args) > 1 && os.Args[1] == "convert" {
+		os.Exit(runConvert(os.Args[2:]))
+	}
+	os.Exit(runServer())
+}
+
+// runServer runs SampDB until it's told to stop by SIGINT or SIGTERM. It
+// returns the exit status: 0 once stopped cleanly, 1 if it failed to start or
+// to stop cleanly, and 2 for invalid settings.
+func runServer() int {
+	configFile := flag.String("config", "", "Optional. The JSON file holding the settings, $SAMPDB_CONFIG by default")
+	printConfig := flag.Bool("print-config", false, "Optional. Print the effective settings and exit")
+	var configFlags []configFlag
+	registerConfigFlags(flag.CommandLine, &configFlags)
 	flag.Parse()
 
-	if *storagetype == "" ||
-	   (*storagetype != "volatile" &&
-	    *storagetype != "json" &&
-	    *storagetype != "sqlite"){
-		fmt.Println("Usage: SampDB [--file=<file>] --storage-type=<volatile|json|sqlite>")
-		return
+	if *configFile == "" {
+		*configFile = os.Getenv("SAMPDB_CONFIG")
+	}
+	err, config := resolveConfig(*configFile, configFlags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading the configuration: %s\n", err.Error())
+		return 2
 	}
 
-	if *storagetype == "json" && *file == "" {
-		*file = "default.json"
-	} else if *storagetype == "sqlite" && *file == "" {
-		*file = "default.sqlite"
+	if *printConfig {
+		out, _ := json.MarshalIndent(config.redacted(), "", "  ")
+		fmt.Println(string(out))
+		err = config.validate()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		}
+		return 0
 	}
 
-	err := GetDataStore(*storagetype, *file, &dataStore)
+	if config.Storage.Type == "" {
+		fmt.Printf("Usage: SampDB [--config=<file>] [--print-config] [--file=<file>] [--journal] [--archived-keys-block] [--employee-code-format=<regexp>] [--policies=<file>] [--quota-mode=<warn|enforce>] [--notifiers=<file>] [--templates=<file>] [--address=<address>] [--port=<port>] [--base-path=<path>] [--public-url=<url>] [--shutdown-timeout=<duration>] [--listener-url=<url>] [--notify-secret=<secret>] [--notify-timeout=<duration>] [--notify-window=<duration>] [--digest-at=<HH:MM>] [--digest-idle=<duration>] [--log-file=<file>] --storage-type=<%s>\n", strings.Join(StorageTypes(), "|"))
+		fmt.Println("       SampDB convert --from=<storage-type>:<file> --to=<storage-type>:<file>")
+		fmt.Println("Storage types:")
+		for _, name := range(StorageTypes()) {
+			fmt.Printf("  %-10s %s\n", name, storageBackends[name].description)
+		}
+		return 2
+	}
+
+	err = config.validate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 2
+	}
+	config.apply()
+
+	if config.Logging.File != "" {
+		logFile, err := os.OpenFile(config.Logging.File, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0666)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening log file %s: %s\n", config.Logging.File, err.Error())
+			return 1
+		}
+		os.Stdout = logFile
+		os.Stderr = logFile
+	}
+
+	if policyFile != "" {
+		err = loadPolicies(policyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading policies from %s: %s\n", policyFile, err.Error())
+			return 1
+		}
+	}
+
+	if config.Notifications.Templates != "" {
+		err = loadTemplates(config.Notifications.Templates)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading templates from %s: %s\n", config.Notifications.Templates, err.Error())
+			return 1
+		}
+	}
+
+	notifiers = defaultNotifiers()
+	if config.Notifications.NotifiersFile != "" {
+		err, notifiers = loadNotifiers(config.Notifications.NotifiersFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading notifiers from %s: %s\n", config.Notifications.NotifiersFile, err.Error())
+			return 1
+		}
+	} else if len(config.Notifications.Notifiers) > 0 {
+		err, notifiers = newSinks(config.Notifications.Notifiers)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error configuring notifiers: %s\n", err.Error())
+			return 1
+		}
+	}
+
+	err = GetDataStore(config.Storage.Type, config.Storage.File, &dataStore)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error initializing database: %s\n", err.Error())
-		return
+		return 1
 	}
 
 	if dataStore == nil {
 		fmt.Fprintf(os.Stderr, "Error initializing database.\n")
-		return
+		return 1
 	}
 
 	http.HandleFunc("/getComputerByMAC",		getComputerByMAC)
@@ -561,8 +722,95 @@ func main() {
 	http.HandleFunc("/deleteComputerByMAC",		deleteComputerByMAC)
 	http.HandleFunc("/deleteComputerByName",	deleteComputerByName)
 	http.HandleFunc("/deleteComputerByIP",		deleteComputerByIP)
-	fmt.Println("Starting server on port 55555...")
-	http.ListenAndServe(":55555", nil)
-	fmt.Println("Couldn't get a lock on the port. Is SampDB already running?")
+	http.HandleFunc("/getHistoryByMAC",		getHistoryByMAC)
+	http.HandleFunc("/getHistoryByName",		getHistoryByName)
+	http.HandleFunc("/getHistoryByIP",		getHistoryByIP)
+	http.HandleFunc("/getHistoryByAssignee",	getHistoryByAssignee)
+	http.HandleFunc("/getEmployees",		getEmployees)
+	http.HandleFunc("/getEmployee",			getEmployee)
+	http.HandleFunc("/addEmployee",			addEmployee)
+	http.HandleFunc("/updateEmployee",		updateEmployee)
+	http.HandleFunc("/deleteEmployee",		deleteEmployee)
+	http.HandleFunc("/getPolicies",			getPolicies)
+	http.HandleFunc("/updatePolicies",		updatePolicies)
+	http.HandleFunc("/getEffectivePolicy",		getEffectivePolicy)
+	http.HandleFunc("/getQuotaOverrides",		getQuotaOverrides)
+	http.HandleFunc("/getNotifications",		getNotifications)
+	http.HandleFunc("/getNotification",		getNotification)
+	http.HandleFunc("/resendNotification",		resendNotification)
+	http.HandleFunc("/getSuppressedNotifications",	getSuppressedNotifications)
+	http.HandleFunc("/getArchivedComputers",	getArchivedComputers)
+	http.HandleFunc("/restoreComputer",		restoreComputer)
+	http.HandleFunc("/purgeComputer",		purgeComputer)
+
+	address := net.JoinHostPort(config.Server.Address, strconv.Itoa(config.Server.Port))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listening on %s: %s\n", address, err.Error())
+		return 1
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	publicURL = config.Server.PublicURL
+	if publicURL == "" {
+		publicURL = fmt.Sprintf("http://localhost:%d%s", port, config.Server.BasePath)
+	}
+
+	var handler http.Handler = http.DefaultServeMux
+	if config.Server.BasePath != "" {
+		handler = http.StripPrefix(config.Server.BasePath, handler)
+	}
+
+	go runOutbox()
+	if digestWanted() {
+		go runDigest()
+	}
+
+	server := &http.Server{ Handler: handler }
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	fmt.Printf("Starting server on port %d...\n", port)
+	status := 0
+	select {
+	case err = <-served:
+		fmt.Fprintf(os.Stderr, "Error serving: %s\n", err.Error())
+		status = 1
+	case sig := <-stop:
+		fmt.Printf("Received %s, shutting down...\n", sig)
+	}
+	return shutdown(server, time.Now().Add(time.Duration(config.Server.ShutdownTimeout)), status)
+}
+
+// shutdown stops server once its requests are done, delivers the pending
+// notifications and closes the data store, giving up on the first two at
+// deadline. It returns status, or 1 if it didn't stop cleanly.
+func shutdown(server *http.Server, deadline time.Time, status int) int {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error waiting for requests to finish: %s\n", err.Error())
+		status = 1
+	}
+
+	if !flushOutbox(deadline) {
+		fmt.Fprintf(os.Stderr, "Pending notifications were not all attempted before shutting down\n")
+	}
+
+	// Requests cut off by the deadline may still be running. dataAccess is
+	// never released, so that they can't use the store once it's closed.
+	dataAccess.Lock()
+	err = dataStore.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error closing database: %s\n", err.Error())
+		status = 1
+	}
+
+	fmt.Println("SampDB stopped.")
+	return status
 }
 
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var errArchivedKey = errors.New("key belongs to an archived computer")
+
+// ArchivedComputer is a deleted computer, kept for write-offs along with the
+// reason and date of its deletion.
+type ArchivedComputer struct {
+	ID		int `json:"id"`
+	Computer
+	Revision	int `json:"revision"`
+	Reason		string `json:"reason"`
+	Archived	time.Time `json:"archived"`
+}
+
+func newArchivedComputer(c Computer, reason string, when time.Time) ArchivedComputer {
+	return ArchivedComputer {
+		Computer:	c,
+		Revision:	c.Revision,
+		Reason:		reason,
+		Archived:	when,
+	}
+}
+
+// restored returns the computer as it is put back in service. Its revision
+// moves on, so that ETags handed out before the deletion are stale.
+func (a ArchivedComputer) restored() Computer {
+	c := a.Computer
+	c.Revision = a.Revision + 1
+	return c
+}
+
+// archivedKeysBlock makes the MAC, Name and IP of archived computers
+// unavailable to new computers.
+var archivedKeysBlock = false
+
+// checkArchivedKeys returns errArchivedKey if archivedKeysBlock is set and
+// an archived computer shares a key with c. It must be called with
+// dataAccess held.
+func checkArchivedKeys(c Computer) error {
+	if !archivedKeysBlock {
+		return nil
+	}
+	err, al := dataStore.ReadArchived()
+	if err == errNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, a := range(al) {
+		if a.MAC == c.MAC || a.Name == c.Name || a.IP == c.IP {
+			return errArchivedKey
+		}
+	}
+	return nil
+}
+
+// archiveWithHistory archives a computer, recording that an assigned one
+// loses its assignee. It must be called with dataAccess held.
+func archiveWithHistory(keytype, key, reason, actor string) error {
+	return dataStore.WithTx(func(tx dataInterface) error {
+		err, c := tx.Read(keytype, key)
+		if err != nil {
+			return err
+		}
+		err = tx.Archive(keytype, key, reason)
+		if err != nil || c.Assignee == "" {
+			return err
+		}
+		return tx.AddEvent(newEvent(*c, "", actor))
+	})
+}
+
+// restoreWithHistory is the reverse of archiveWithHistory. Restoring an
+// assigned computer is checked like assigning it again.
+func restoreWithHistory(id int, actor string, force bool) (error, *Computer) {
+	var restored *Computer
+	err := dataStore.WithTx(func(tx dataInterface) error {
+		err, al := tx.ReadArchived()
+		if err != nil {
+			return err
+		}
+		var override string
+		for _, a := range(al) {
+			if a.ID != id || a.Assignee == "" {
+				continue
+			}
+			err = checkAssignee(tx, a.Assignee)
+			if err != nil {
+				return err
+			}
+			override, err = checkQuota(tx, a.Assignee, force)
+			if err != nil {
+				return err
+			}
+		}
+		err, c := tx.Restore(id)
+		if err != nil {
+			return err
+		}
+		restored = c
+		if c.Assignee == "" {
+			return nil
+		}
+		unassigned := *c
+		unassigned.Assignee = ""
+		e := newEvent(unassigned, c.Assignee, actor)
+		e.Override = override
+		return tx.AddEvent(e)
+	})
+	if err != nil {
+		return err, nil
+	}
+	return nil, restored
+}
+
+func getArchivedComputers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dataAccess.Lock()
+	err, al := dataStore.ReadArchived()
+	dataAccess.Unlock()
+
+	if err == errNotFound {
+		http.Error(w, "No archived computers found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(al)
+}
+
+func restoreComputer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid archive id", http.StatusBadRequest)
+		return
+	}
+
+	dataAccess.Lock()
+	err, c := restoreWithHistory(id, actor(r), force(r))
+	dataAccess.Unlock()
+
+	if assigneeError(w, err) || quotaError(w, err) {
+		return
+	} else if err == errNotFound {
+		http.Error(w, "Archived computer not found", http.StatusNotFound)
+		return
+	} else if err == errAlreadyExists {
+		http.Error(w, "A computer with the same MAC, Name or IP exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if c.Assignee != "" {
+		checkEmployee(c.Assignee)
+	}
+
+	w.Header().Set("ETag", etag(c.Revision))
+	json.NewEncoder(w).Encode(c)
+}
+
+func purgeComputer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid archive id", http.StatusBadRequest)
+		return
+	}
+
+	dataAccess.Lock()
+	err = dataStore.Purge(id)
+	dataAccess.Unlock()
+
+	if err == errNotFound {
+		http.Error(w, "Archived computer not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
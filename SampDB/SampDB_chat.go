@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Webhook formats. Plain is the Notification itself, the others are the
+// payloads of the incoming webhooks of chat platforms.
+const (
+	formatPlain		= "plain"
+	formatCloudEvents	= "cloudevents"
+	formatSlack		= "slack"
+	formatMattermost	= "mattermost"
+	formatTeams		= "teams"
+)
+
+func validFormat(format string) bool {
+	switch format {
+	case formatPlain, formatCloudEvents, formatSlack, formatMattermost, formatTeams:
+		return true
+	}
+	return false
+}
+
+// publicURL is where SampDB is reached by those following the links in chat
+// messages.
+var publicURL = "http://localhost:55555"
+
+func computerLink(c ComputerKeys) string {
+	return strings.TrimSuffix(publicURL, "/") + "/getComputerByMAC?mac=" + url.QueryEscape(c.MAC)
+}
+
+var levelEmoji = map[string]string {
+	"Info":		":information_source:",
+	"Warning":	":warning:",
+	"Error":	":rotating_light:",
+}
+
+// slackEscape escapes the characters Slack uses for links and mentions.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// markdownEscape escapes the characters that would end a link text.
+func markdownEscape(s string) string {
+	return strings.NewReplacer("[", "\\[", "]", "\\]").Replace(s)
+}
+
+// chatMarkup is how text is formatted on one platform.
+type chatMarkup struct {
+	emoji	bool
+	escape	func(string) string
+	bold	func(string) string
+	link	func(text, url string) string
+	mention	func(id string) string
+}
+
+// chatMessage is the text shared by the chat formats: a title, the mention of
+// the employee, the message, and links to the computers. Employees are only
+// mentioned if mentions has their ID on the platform.
+func chatMessage(n Notification, mentions map[string]string, m chatMarkup) string {
+	var msg strings.Builder
+	title := "SampDB " + n.Level
+	if emoji, ok := levelEmoji[n.Level]; ok && m.emoji {
+		title = emoji + " " + title
+	}
+	msg.WriteString(m.bold(m.escape(title)))
+	if n.Employee != "" {
+		msg.WriteString(" · ")
+		if id, ok := mentions[n.Employee]; ok {
+			msg.WriteString(m.mention(id))
+		} else {
+			msg.WriteString(m.bold(m.escape(n.Employee)))
+		}
+	}
+	msg.WriteString("\n" + m.escape(n.Message))
+	for _, c := range(n.Computers) {
+		fmt.Fprintf(&msg, "\n• %s (%s, %s)", m.link(c.Name, computerLink(c)), m.escape(c.MAC), m.escape(c.IP))
+	}
+	return msg.String()
+}
+
+// slackPayload uses Slack's mrkdwn. Mentions are by user ID, e.g. U024BE7LH.
+func slackPayload(n Notification, mentions map[string]string) interface{} {
+	text := chatMessage(n, mentions, chatMarkup {
+		emoji:		true,
+		escape:		slackEscape,
+		bold:		func(s string) string { return "*" + s + "*" },
+		link:		func(text, url string) string { return "<" + url + "|" + slackEscape(text) + ">" },
+		mention:	func(id string) string { return "<@" + id + ">" },
+	})
+	type textObject struct {
+		Type	string `json:"type"`
+		Text	string `json:"text"`
+	}
+	type block struct {
+		Type	string `json:"type"`
+		Text	textObject `json:"text"`
+	}
+	return struct {
+		Text	string `json:"text"`
+		Blocks	[]block `json:"blocks"`
+	}{ text, []block{ { "section", textObject{ "mrkdwn", text } } } }
+}
+
+// mattermostPayload uses Markdown. Mentions are by username.
+func mattermostPayload(n Notification, mentions map[string]string) interface{} {
+	text := chatMessage(n, mentions, chatMarkup {
+		emoji:		true,
+		escape:		func(s string) string { return s },
+		bold:		func(s string) string { return "**" + s + "**" },
+		link:		func(text, url string) string { return "[" + markdownEscape(text) + "](" + url + ")" },
+		mention:	func(id string) string { return "@" + id },
+	})
+	return struct {
+		Username	string `json:"username"`
+		Text		string `json:"text"`
+	}{ "SampDB", text }
+}
+
+// teamsPayload is an Adaptive Card. Mentions are by Microsoft Entra object ID
+// or user principal name.
+func teamsPayload(n Notification, mentions map[string]string) interface{} {
+	type mentioned struct {
+		ID	string `json:"id"`
+		Name	string `json:"name"`
+	}
+	type entity struct {
+		Type		string `json:"type"`
+		Text		string `json:"text"`
+		Mentioned	mentioned `json:"mentioned"`
+	}
+	var entities []entity
+	text := chatMessage(n, mentions, chatMarkup {
+		escape:		func(s string) string { return s },
+		bold:		func(s string) string { return "**" + s + "**" },
+		link:		func(text, url string) string { return "[" + markdownEscape(text) + "](" + url + ")" },
+		mention:	func(id string) string {
+			entities = append(entities, entity{ "mention", "<at>" + n.Employee + "</at>", mentioned{ id, n.Employee } })
+			return "<at>" + n.Employee + "</at>"
+		},
+	})
+
+	color := "default"
+	if n.Level == "Warning" {
+		color = "warning"
+	} else if n.Level == "Error" {
+		color = "attention"
+	}
+	type textBlock struct {
+		Type	string `json:"type"`
+		Text	string `json:"text"`
+		Wrap	bool `json:"wrap"`
+		Color	string `json:"color"`
+	}
+	type card struct {
+		Schema	string `json:"$schema"`
+		Type	string `json:"type"`
+		Version	string `json:"version"`
+		Body	[]textBlock `json:"body"`
+		MSTeams	struct {
+			Width		string `json:"width"`
+			Entities	[]entity `json:"entities,omitempty"`
+		} `json:"msteams"`
+	}
+	type attachment struct {
+		ContentType	string `json:"contentType"`
+		Content		card `json:"content"`
+	}
+
+	c := card {
+		Schema:		"http://adaptivecards.io/schemas/adaptive-card.json",
+		Type:		"AdaptiveCard",
+		Version:	"1.4",
+		// Single line breaks are ignored.
+		Body:		[]textBlock{ { "TextBlock", strings.ReplaceAll(text, "\n", "\n\n"), true, color } },
+	}
+	c.MSTeams.Width = "Full"
+	c.MSTeams.Entities = entities
+	return struct {
+		Type		string `json:"type"`
+		Attachments	[]attachment `json:"attachments"`
+	}{ "message", []attachment{ { "application/vnd.microsoft.card.adaptive", c } } }
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidConfig = errors.New("invalid configuration")
+
+// Duration is a time.Duration written as in Go, e.g. "1h30m", in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// StorageConfig is where and how computers are stored.
+type StorageConfig struct {
+	Type			string `json:"type"`
+	File			string `json:"file"`
+	Journal			bool `json:"journal"`
+	ArchivedKeysBlock	bool `json:"archivedKeysBlock"`
+}
+
+type EmployeesConfig struct {
+	CodeFormat	string `json:"codeFormat"`
+}
+
+// ServerConfig is where SampDB serves its API. Port 0 picks a free port.
+type ServerConfig struct {
+	Address		string `json:"address"`
+	Port		int `json:"port"`
+	BasePath	string `json:"basePath"`
+	// PublicURL defaults to localhost, at Port and BasePath.
+	PublicURL	string `json:"publicURL"`
+	// ShutdownTimeout is how long in-flight requests and pending
+	// notifications have, together, once SampDB is told to stop.
+	ShutdownTimeout	Duration `json:"shutdownTimeout"`
+}
+
+type DigestConfig struct {
+	At	string `json:"at"`
+	Idle	Duration `json:"idle"`
+}
+
+// NotificationsConfig is how notifications are made and where they go.
+// The sinks are either Notifiers or the ones in NotifiersFile; without
+// either, notifications go to ListenerURL.
+type NotificationsConfig struct {
+	ListenerURL	string `json:"listenerURL"`
+	Secret		string `json:"secret"`
+	Timeout		Duration `json:"timeout"`
+	Window		Duration `json:"window"`
+	Templates	string `json:"templates"`
+	NotifiersFile	string `json:"notifiersFile"`
+	Notifiers	[]NotifierConfig `json:"notifiers"`
+	Digest		DigestConfig `json:"digest"`
+}
+
+type PoliciesConfig struct {
+	File		string `json:"file"`
+	QuotaMode	string `json:"quotaMode"`
+}
+
+// LoggingConfig is where SampDB writes its output, the console by default.
+type LoggingConfig struct {
+	File	string `json:"file"`
+}
+
+// Config holds the settings of SampDB. They are taken from, in increasing
+// order of precedence, the defaults, the config file, the environment and
+// the flags.
+type Config struct {
+	Storage		StorageConfig `json:"storage"`
+	Employees	EmployeesConfig `json:"employees"`
+	Server		ServerConfig `json:"server"`
+	Notifications	NotificationsConfig `json:"notifications"`
+	Policies	PoliciesConfig `json:"policies"`
+	Logging		LoggingConfig `json:"logging"`
+}
+
+const defaultPort = 55555
+const defaultShutdownTimeout = 10 * time.Second
+
+func defaultConfig() Config {
+	return Config {
+		Employees:	EmployeesConfig{ CodeFormat: defaultEmployeeCodeFormat },
+		Server:		ServerConfig{ Port: defaultPort, ShutdownTimeout: Duration(defaultShutdownTimeout) },
+		Notifications:	NotificationsConfig {
+			ListenerURL:	"http://localhost:8080/api/notify",
+			Timeout:	Duration(notifyTimeout),
+			Window:		Duration(notifyWindow),
+			Digest:		DigestConfig {
+				At:	fmt.Sprintf("%02d:%02d", int(digestAt.Hours()), int(digestAt.Minutes()) % 60),
+				Idle:	Duration(digestIdle),
+			},
+		},
+		Policies:	PoliciesConfig{ QuotaMode: quotaWarn },
+	}
+}
+
+// setting ties a field of Config to its flag. Its environment variable is
+// named after the flag, e.g. SAMPDB_STORAGE_TYPE for --storage-type.
+type setting struct {
+	flag	string
+	usage	string
+	value	interface{}
+}
+
+func (s setting) env() string {
+	return "SAMPDB_" + strings.ToUpper(strings.ReplaceAll(s.flag, "-", "_"))
+}
+
+func (c *Config) settings() []setting {
+	return []setting {
+		{ "storage-type", "the type of storage to use ('" + strings.Join(StorageTypes(), "', '") + "')", &c.Storage.Type },
+		{ "file", "Optional. The file to use as database", &c.Storage.File },
+		{ "journal", "Optional. Append changes to a journal instead of rewriting the JSON file", &c.Storage.Journal },
+		{ "archived-keys-block", "Optional. Refuse new computers that share a MAC, Name or IP with an archived one", &c.Storage.ArchivedKeysBlock },
+		{ "employee-code-format", "Optional. The regular expression employee codes must match, " + defaultEmployeeCodeFormat + " by default", &c.Employees.CodeFormat },
+		{ "address", "Optional. The address to listen on, all of them by default", &c.Server.Address },
+		{ "port", "Optional. The port to listen on, 55555 by default, 0 for any free port", &c.Server.Port },
+		{ "base-path", "Optional. The path the API is served under, e.g. /sampdb", &c.Server.BasePath },
+		{ "public-url", "Optional. The URL SampDB is reached at, for links in notifications", &c.Server.PublicURL },
+		{ "shutdown-timeout", "Optional. How long to wait for requests and notifications once stopped, 10s by default", &c.Server.ShutdownTimeout },
+		{ "listener-url", "Optional. The URL notifications are posted to, unless there are notifiers", &c.Notifications.ListenerURL },
+		{ "notify-secret", "Optional. The secret notifications to the listener are signed with", &c.Notifications.Secret },
+		{ "notify-timeout", "Optional. How long webhooks have to answer a notification, 10s by default", &c.Notifications.Timeout },
+		{ "notify-window", "Optional. How long repeats of a notification are suppressed, 1h by default, 0 to never suppress them", &c.Notifications.Window },
+		{ "templates", "Optional. The JSON file holding the templates of notification messages", &c.Notifications.Templates },
+		{ "notifiers", "Optional. The JSON file configuring where notifications are sent", &c.Notifications.NotifiersFile },
+		{ "digest-at", "Optional. When notifiers in digest mode get the daily digest, as HH:MM, 08:00 by default", &c.Notifications.Digest.At },
+		{ "digest-idle", "Optional. How long computers must have been unassigned to be listed in the digest, 720h by default", &c.Notifications.Digest.Idle },
+		{ "policies", "Optional. The JSON file holding the over-assignment policies", &c.Policies.File },
+		{ "quota-mode", "Optional. '" + quotaWarn + "' to notify about over-assignments, '" + quotaEnforce + "' to refuse them", &c.Policies.QuotaMode },
+		{ "log-file", "Optional. The file to append the output to, instead of the console", &c.Logging.File },
+	}
+}
+
+func (s setting) set(value string) error {
+	var err error
+	switch v := s.value.(type) {
+	case *string:
+		*v = value
+	case *int:
+		*v, err = strconv.Atoi(value)
+	case *bool:
+		*v, err = strconv.ParseBool(value)
+	case *Duration:
+		var d time.Duration
+		d, err = time.ParseDuration(value)
+		*v = Duration(d)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: invalid value '%s' for %s", errInvalidConfig, value, s.flag)
+	}
+	return nil
+}
+
+// configFlag is a setting given as a flag.
+type configFlag struct {
+	name	string
+	value	string
+}
+
+// flagValue records the flag of a setting, to be applied by resolveConfig.
+type flagValue struct {
+	name	string
+	isBool	bool
+	flags	*[]configFlag
+}
+
+func (v flagValue) String() string {
+	return ""
+}
+
+func (v flagValue) Set(value string) error {
+	*v.flags = append(*v.flags, configFlag{ v.name, value })
+	return nil
+}
+
+func (v flagValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+// registerConfigFlags adds a flag for every setting to fs. Their values are
+// applied by resolveConfig, once the config file and environment are read.
+func registerConfigFlags(fs *flag.FlagSet, cf *[]configFlag) {
+	var c Config
+	for _, s := range(c.settings()) {
+		_, isBool := s.value.(*bool)
+		fs.Var(flagValue{ s.flag, isBool, cf }, s.flag, s.usage)
+	}
+}
+
+// resolveConfig returns the defaults, overridden by configFile if there is
+// one, then by the environment, then by cf. The result isn't validated.
+func resolveConfig(configFile string, cf []configFlag) (error, Config) {
+	c := defaultConfig()
+	if configFile != "" {
+		err := loadConfig(configFile, &c)
+		if err != nil {
+			return err, c
+		}
+	}
+	settings := c.settings()
+	for _, s := range(settings) {
+		if value, ok := os.LookupEnv(s.env()); ok {
+			err := s.set(value)
+			if err != nil {
+				return fmt.Errorf("%w (from %s)", err, s.env()), c
+			}
+		}
+	}
+	for _, f := range(cf) {
+		for _, s := range(settings) {
+			if s.flag != f.name {
+				continue
+			}
+			err := s.set(f.value)
+			if err != nil {
+				return err, c
+			}
+		}
+	}
+	c.Server.BasePath = strings.TrimSuffix(c.Server.BasePath, "/")
+	return nil, c
+}
+
+// loadConfig reads filename, a JSON object, into c. Settings missing from the
+// file keep their value, unknown ones are refused.
+func loadConfig(filename string, c *Config) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(c)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %s", errInvalidConfig, filename, err.Error())
+	}
+	return nil
+}
+
+// validate returns every problem of c, one per line, or nil.
+func (c Config) validate() error {
+	var problems []string
+	problem := func(key, format string, args ...interface{}) {
+		problems = append(problems, key + ": " + fmt.Sprintf(format, args...))
+	}
+
+	if _, ok := storageBackends[c.Storage.Type]; !ok {
+		problem("storage.type", "unknown storage type '%s', expected one of '%s'", c.Storage.Type, strings.Join(StorageTypes(), "', '"))
+	}
+	if _, err := regexp.Compile(c.Employees.CodeFormat); err != nil {
+		problem("employees.codeFormat", "%s", err.Error())
+	}
+
+	if c.Server.Port < 0 || c.Server.Port > 65535 {
+		problem("server.port", "%d is not between 0 and 65535", c.Server.Port)
+	}
+	if c.Server.BasePath != "" && !strings.HasPrefix(c.Server.BasePath, "/") {
+		problem("server.basePath", "'%s' must start with /", c.Server.BasePath)
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		problem("server.shutdownTimeout", "%s is not more than 0", time.Duration(c.Server.ShutdownTimeout))
+	}
+	for _, u := range([]struct{ key, url string }{
+		{ "server.publicURL", c.Server.PublicURL },
+		{ "notifications.listenerURL", c.Notifications.ListenerURL },
+	}) {
+		if u.url == "" {
+			continue
+		}
+		parsed, err := url.Parse(u.url)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problem(u.key, "'%s' is not an http(s) URL", u.url)
+		}
+	}
+
+	n := c.Notifications
+	if n.ListenerURL == "" && n.NotifiersFile == "" && len(n.Notifiers) == 0 {
+		problem("notifications.listenerURL", "empty, without notifiers")
+	}
+	if n.Timeout <= 0 {
+		problem("notifications.timeout", "%s is not more than 0", time.Duration(n.Timeout))
+	}
+	if n.Window < 0 {
+		problem("notifications.window", "%s is negative", time.Duration(n.Window))
+	}
+	if len(n.Notifiers) > 0 && n.NotifiersFile != "" {
+		problem("notifications.notifiers", "given along with notifications.notifiersFile")
+	} else if len(n.Notifiers) > 0 {
+		if err, _ := newSinks(n.Notifiers); err != nil {
+			problem("notifications.notifiers", "%s", err.Error())
+		}
+	}
+	if _, err := time.Parse("15:04", n.Digest.At); err != nil {
+		problem("notifications.digest.at", "'%s' is not HH:MM", n.Digest.At)
+	}
+	if n.Digest.Idle < 0 {
+		problem("notifications.digest.idle", "%s is negative", time.Duration(n.Digest.Idle))
+	}
+
+	if c.Policies.QuotaMode != quotaWarn && c.Policies.QuotaMode != quotaEnforce {
+		problem("policies.quotaMode", "'%s' is neither '%s' nor '%s'", c.Policies.QuotaMode, quotaWarn, quotaEnforce)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w:\n  %s", errInvalidConfig, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// apply sets the globals the settings are read from. c must be valid.
+func (c Config) apply() {
+	jsonJournal = c.Storage.Journal
+	archivedKeysBlock = c.Storage.ArchivedKeysBlock
+	employeeCodeFormat = regexp.MustCompile(c.Employees.CodeFormat)
+	listenerURL = c.Notifications.ListenerURL
+	notifySecret = c.Notifications.Secret
+	notifyTimeout = time.Duration(c.Notifications.Timeout)
+	notifyWindow = time.Duration(c.Notifications.Window)
+	at, _ := time.Parse("15:04", c.Notifications.Digest.At)
+	digestAt = time.Duration(at.Hour()) * time.Hour + time.Duration(at.Minute()) * time.Minute
+	digestIdle = time.Duration(c.Notifications.Digest.Idle)
+	policyFile = c.Policies.File
+	quotaMode = c.Policies.QuotaMode
+}
+
+// redacted returns c without its secrets, for printing.
+func (c Config) redacted() Config {
+	const hidden = "********"
+	if c.Notifications.Secret != "" {
+		c.Notifications.Secret = hidden
+	}
+	nl := make([]NotifierConfig, len(c.Notifications.Notifiers))
+	for i, n := range(c.Notifications.Notifiers) {
+		if n.Secret != "" {
+			n.Secret = hidden
+		}
+		if n.Password != "" {
+			n.Password = hidden
+		}
+		nl[i] = n
+	}
+	c.Notifications.Notifiers = nl
+	return c
+}
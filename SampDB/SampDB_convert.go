@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// convertSummary counts what happened to the records of a conversion.
+type convertSummary struct {
+	read		int
+	converted	int
+	duplicates	int
+	malformed	int
+	failed		int
+	employees	int
+	employeesRead	int
+	events		int
+	eventsRead	int
+	archived	int
+	archivedRead	int
+	outbox		int
+	outboxRead	int
+}
+
+// parseStorageSpec splits a "<storage-type>:<file>" argument of convert.
+func parseStorageSpec(spec string) (string, string, error) {
+	storagetype, file, found := strings.Cut(spec, ":")
+	if !found || storagetype == "" || file == "" {
+		return "", "", fmt.Errorf("expected <storage-type>:<file>, got '%s'", spec)
+	}
+	backend, ok := storageBackends[storagetype]
+	if !ok {
+		return "", "", fmt.Errorf("unknown storage type '%s'", storagetype)
+	}
+	if backend.defaultDSN == "" {
+		return "", "", fmt.Errorf("storage type '%s' doesn't keep any data to convert", storagetype)
+	}
+	return storagetype, file, nil
+}
+
+// validateComputer checks the mandatory properties of c, and its keys
+// against those of the records accepted so far. Assignees are not checked
+// against the employee code format, which may have changed since.
+func validateComputer(c Computer, macs, names, ips map[string]bool) error {
+	if c.MAC == "" || c.Name == "" || c.IP == "" {
+		return fmt.Errorf("%w: missing mandatory property", errMalformed)
+	}
+	if macs[c.MAC] {
+		return fmt.Errorf("%w: MAC %s", errAlreadyExists, c.MAC)
+	}
+	if names[c.Name] {
+		return fmt.Errorf("%w: Name %s", errAlreadyExists, c.Name)
+	}
+	if ips[c.IP] {
+		return fmt.Errorf("%w: IP %s", errAlreadyExists, c.IP)
+	}
+	return nil
+}
+
+// convertStorage copies every employee and computer of src into dst, along
+// with the assignment history, the archived computers and the outbox.
+// Rejected records are reported one by one and counted, they never stop the
+// conversion. All the accepted records are written in a single transaction.
+func convertStorage(src, dst dataInterface) (convertSummary, error) {
+	var sum convertSummary
+
+	err, el := src.ReadEmployees()
+	if err != nil && err != errNotFound {
+		return sum, err
+	}
+	sum.employeesRead = len(el)
+
+	err, cl := src.ReadAll(KeyAll, "")
+	if err != nil && err != errNotFound {
+		return sum, err
+	}
+	sum.read = len(cl)
+
+	err, events := src.ReadEvents(KeyAll, "")
+	if err != nil && err != errNotFound {
+		return sum, err
+	}
+	sum.eventsRead = len(events)
+
+	err, al := src.ReadArchived()
+	if err != nil && err != errNotFound {
+		return sum, err
+	}
+	sum.archivedRead = len(al)
+
+	err, ol := src.ReadOutbox("")
+	if err != nil && err != errNotFound {
+		return sum, err
+	}
+	sum.outboxRead = len(ol)
+
+	// Records already in the destination count as taken.
+	macs := make(map[string]bool)
+	names := make(map[string]bool)
+	ips := make(map[string]bool)
+	err, existing := dst.ReadAll(KeyAll, "")
+	if err != nil && err != errNotFound {
+		return sum, err
+	}
+	for _, c := range(existing) {
+		macs[c.MAC] = true
+		names[c.Name] = true
+		ips[c.IP] = true
+	}
+
+	err = dst.WithTx(func(tx dataInterface) error {
+		for _, e := range(el) {
+			err := tx.AddEmployee(e)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Employee %s rejected: %s\n", e.Code, err.Error())
+				continue
+			}
+			sum.employees++
+		}
+		for n, c := range(cl) {
+			err := validateComputer(c, macs, names, ips)
+			if err == nil {
+				err = tx.Add(c)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Record %d (%s/%s/%s) rejected: %s\n", n + 1, c.MAC, c.Name, c.IP, err.Error())
+				if errors.Is(err, errAlreadyExists) {
+					sum.duplicates++
+				} else if errors.Is(err, errMalformed) {
+					sum.malformed++
+				} else {
+					sum.failed++
+				}
+				continue
+			}
+			macs[c.MAC] = true
+			names[c.Name] = true
+			ips[c.IP] = true
+			sum.converted++
+		}
+		for _, e := range(events) {
+			err := tx.AddEvent(e)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Event of %s at %s rejected: %s\n", e.MAC, e.Time.Format(time.RFC3339), err.Error())
+				continue
+			}
+			sum.events++
+		}
+		// Archived computers and outbox entries get new IDs in dst.
+		for _, a := range(al) {
+			err, _ := tx.AddArchived(a)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Archived item %d rejected: %s\n", a.ID, err.Error())
+				continue
+			}
+			sum.archived++
+		}
+		for _, o := range(ol) {
+			err, _ := tx.AddOutbox(o)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Outbox entry %d rejected: %s\n", o.ID, err.Error())
+				continue
+			}
+			sum.outbox++
+		}
+		return nil
+	})
+	if err != nil {
+		sum.converted = 0
+		sum.employees = 0
+		sum.events = 0
+		sum.archived = 0
+		sum.outbox = 0
+	}
+	return sum, err
+}
+
+// runConvert implements "SampDB convert". It returns the exit status.
+func runConvert(args []string) int {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	from := fs.String("from", "", "the storage to read, as <storage-type>:<file>")
+	to := fs.String("to", "", "the storage to write, as <storage-type>:<file>")
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	fromType, fromFile, err := parseStorageSpec(*from)
+	if err != nil {
+		return convertUsage(err)
+	}
+	toType, toFile, err := parseStorageSpec(*to)
+	if err != nil {
+		return convertUsage(err)
+	}
+	if toType == fromType && toFile == fromFile {
+		return convertUsage(fmt.Errorf("source and destination are the same"))
+	}
+
+	return convertFiles(fromType, fromFile, toType, toFile)
+}
+
+func convertUsage(err error) int {
+	fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+	fmt.Println("Usage: SampDB convert --from=<storage-type>:<file> --to=<storage-type>:<file>")
+	return 2
+}
+
+func convertFiles(fromType, fromFile, toType, toFile string) int {
+	if _, err := os.Stat(fromFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening source %s: %s\n", fromFile, err.Error())
+		return 1
+	}
+
+	// Opening a store may write to it, to replay its journal or to migrate
+	// its schema, so the source is opened from a copy of its files.
+	srcFile, cleanup, err := copySource(fromFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error copying source %s: %s\n", fromFile, err.Error())
+		return 1
+	}
+	defer cleanup()
+
+	var src, dst dataInterface
+	err = GetDataStore(fromType, srcFile, &src)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening source %s: %s\n", fromFile, err.Error())
+		return 1
+	}
+	defer src.Close()
+
+	err = GetDataStore(toType, toFile, &dst)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening destination %s: %s\n", toFile, err.Error())
+		return 1
+	}
+	defer dst.Close()
+
+	sum, err := convertStorage(src, dst)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error converting %s to %s: %s\n", fromFile, toFile, err.Error())
+		return 1
+	}
+
+	fmt.Printf("Converted %d of %d computers from %s to %s.\n", sum.converted, sum.read, fromFile, toFile)
+	fmt.Printf("Rejected: %d duplicate, %d malformed, %d failed.\n", sum.duplicates, sum.malformed, sum.failed)
+	fmt.Printf("Converted %d of %d employees.\n", sum.employees, sum.employeesRead)
+	fmt.Printf("Converted %d of %d assignment events.\n", sum.events, sum.eventsRead)
+	fmt.Printf("Converted %d of %d archived computers.\n", sum.archived, sum.archivedRead)
+	fmt.Printf("Converted %d of %d outbox entries.\n", sum.outbox, sum.outboxRead)
+	if sum.converted != sum.read || sum.employees != sum.employeesRead || sum.events != sum.eventsRead ||
+		sum.archived != sum.archivedRead || sum.outbox != sum.outboxRead {
+		return 1
+	}
+	return 0
+}
+
+// copySource copies file and its sidecars, the files named after it followed
+// by "." or "-", to a new temporary directory. It returns the path of the
+// copy of file and a function that removes the directory.
+func copySource(file string) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "sampdb-convert-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	base := filepath.Base(file)
+	entries, err := os.ReadDir(filepath.Dir(file))
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	for _, e := range(entries) {
+		name := e.Name()
+		if e.IsDir() || (name != base && !strings.HasPrefix(name, base + ".") && !strings.HasPrefix(name, base + "-")) {
+			continue
+		}
+		err = copyFile(filepath.Join(filepath.Dir(file), name), filepath.Join(dir, name))
+		if err != nil {
+			cleanup()
+			return "", nil, err
+		}
+	}
+	return filepath.Join(dir, base), cleanup, nil
+}
+
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Notifiers in digest mode don't get notifications as they happen. Instead,
+// they get one summary a day, at digestAt (hours and minutes, local time).
+var digestAt = 8 * time.Hour
+
+// digestIdle is how long a computer must have been unassigned to be listed in
+// the digest.
+var digestIdle = 30 * 24 * time.Hour
+
+// nextDigest returns when the first digest after now is due.
+func nextDigest(now time.Time) time.Time {
+	y, m, d := now.Date()
+	next := time.Date(y, m, d, 0, 0, 0, 0, now.Location()).Add(digestAt)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// buildDigest summarizes the state of store at now, and its changes since
+// the previous digest. It returns the level of the summary along with it:
+// Warning if someone is over their limit, Info otherwise. It must be called
+// with dataAccess held.
+func buildDigest(store dataInterface, since, now time.Time) (error, string, string) {
+	err, cl := store.ReadAll(KeyAll, "")
+	if err != nil && err != errNotFound {
+		return err, "", ""
+	}
+	err, el := store.ReadEvents(KeyAll, "")
+	if err != nil && err != errNotFound {
+		return err, "", ""
+	}
+
+	level := "Info"
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "SampDB digest, %s to %s.\n", since.Format("2006-01-02 15:04"), now.Format("2006-01-02 15:04"))
+
+	assigned := make(map[string]int)
+	for _, c := range(cl) {
+		if c.Assignee != "" {
+			assigned[c.Assignee]++
+		}
+	}
+	var emps []string
+	for emp := range(assigned) {
+		emps = append(emps, emp)
+	}
+	sort.Strings(emps)
+	fmt.Fprintf(&msg, "\nEmployees over their limit:\n")
+	over := 0
+	for _, emp := range(emps) {
+		policy := policyFor(store, emp)
+		if assigned[emp] > policy.Limit {
+			fmt.Fprintf(&msg, "  %s: %d computers (%s limit %d)\n", emp, assigned[emp], policy.Source, policy.Limit)
+			over++
+		}
+	}
+	if over == 0 {
+		fmt.Fprintf(&msg, "  none\n")
+	} else {
+		level = "Warning"
+	}
+
+	// Computers are unassigned since they were added or last unassigned.
+	// Only those added before additions were recorded have no history.
+	unassignedSince := make(map[string]time.Time)
+	everAssigned := make(map[string]bool)
+	for _, e := range(el) {
+		if e.NewAssignee == "" {
+			unassignedSince[e.MAC] = e.Time
+		} else {
+			delete(unassignedSince, e.MAC)
+		}
+		if e.OldAssignee != "" || e.NewAssignee != "" {
+			everAssigned[e.MAC] = true
+		}
+	}
+	seen := make(map[string]bool)
+	for _, e := range(el) {
+		seen[e.MAC] = true
+	}
+	fmt.Fprintf(&msg, "\nComputers unassigned for more than %d days:\n", int(digestIdle.Hours() / 24))
+	idle := 0
+	for _, c := range(cl) {
+		if c.Assignee != "" {
+			continue
+		}
+		if !seen[c.MAC] {
+			fmt.Fprintf(&msg, "  %s (%s, %s): never assigned\n", c.Name, c.MAC, c.IP)
+			idle++
+		} else if t, ok := unassignedSince[c.MAC]; ok && now.Sub(t) > digestIdle && !everAssigned[c.MAC] {
+			fmt.Fprintf(&msg, "  %s (%s, %s): never assigned, added %s\n", c.Name, c.MAC, c.IP, t.Format("2006-01-02"))
+			idle++
+		} else if ok && now.Sub(t) > digestIdle {
+			fmt.Fprintf(&msg, "  %s (%s, %s): since %s\n", c.Name, c.MAC, c.IP, t.Format("2006-01-02"))
+			idle++
+		}
+	}
+	if idle == 0 {
+		fmt.Fprintf(&msg, "  none\n")
+	}
+
+	fmt.Fprintf(&msg, "\nChanges since the previous digest:\n")
+	changes := 0
+	for _, e := range(el) {
+		if e.Time.Before(since) || !e.Time.Before(now) {
+			continue
+		}
+		if e.OldAssignee == "" && e.NewAssignee == "" {
+			fmt.Fprintf(&msg, "  %s %s (%s): added unassigned, by %s\n", e.Time.Local().Format("2006-01-02 15:04"), e.Name, e.MAC, e.Actor)
+			changes++
+			continue
+		}
+		from, to := e.OldAssignee, e.NewAssignee
+		if from == "" {
+			from = "unassigned"
+		}
+		if to == "" {
+			to = "unassigned"
+		}
+		fmt.Fprintf(&msg, "  %s %s (%s): %s -> %s, by %s\n", e.Time.Local().Format("2006-01-02 15:04"), e.Name, e.MAC, from, to, e.Actor)
+		changes++
+	}
+	if changes == 0 {
+		fmt.Fprintf(&msg, "  none\n")
+	}
+	return nil, msg.String(), level
+}
+
+// enqueueDigest queues the digest for every notifier in digest mode, in a
+// single transaction like enqueueNotification. It must be called with
+// dataAccess held.
+func enqueueDigest(since, now time.Time) error {
+	err, msg, level := buildDigest(dataStore, since, now)
+	if err != nil {
+		return err
+	}
+	n := newNotification(Notification{ Level: level, Message: msg, Type: typeDigest, Time: now.UTC() })
+	err = dataStore.WithTx(func(tx dataInterface) error {
+		for _, s := range(notifiers) {
+			if !s.digest {
+				continue
+			}
+			err, _ := tx.AddOutbox(OutboxEntry {
+				Notification:	n,
+				Sink:		s.name,
+				Status:		outboxPending,
+				NextAttempt:	now.UTC(),
+				Created:	now.UTC(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	wakeOutbox()
+	return nil
+}
+
+// runDigest queues the digests, for as long as SampDB runs. The first one
+// covers the day before it.
+func runDigest() {
+	since := time.Now().AddDate(0, 0, -1)
+	for {
+		next := nextDigest(time.Now())
+		time.Sleep(time.Until(next))
+
+		dataAccess.Lock()
+		err := enqueueDigest(since, next)
+		dataAccess.Unlock()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error queuing digest: %s\n", err.Error())
+			continue
+		}
+		since = next
+	}
+}
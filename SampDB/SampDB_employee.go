@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"regexp"
+)
+
+var errUnknownEmployee = errors.New("unknown employee")
+var errInactiveEmployee = errors.New("employee is not active")
+var errEmployeeHasComputers = errors.New("employee still has computers assigned")
+
+// Employee is a member of staff computers can be assigned to.
+type Employee struct {
+	Code		string `json:"code"`
+	FullName	string `json:"fullName"`
+	Email		string `json:"email"`
+	Department	string `json:"department"`
+	Active		bool `json:"active"`
+}
+
+// defaultEmployeeCodeFormat is the historical rule of 3-letter codes.
+const defaultEmployeeCodeFormat = "^[A-Za-z]{3}$"
+
+// employeeCodeFormat is what every assignee and employee code must match.
+var employeeCodeFormat = regexp.MustCompile(defaultEmployeeCodeFormat)
+
+func validEmployeeCode(code string) bool {
+	return employeeCodeFormat.MatchString(code)
+}
+
+func validateEmployee(e Employee) error {
+	if !validEmployeeCode(e.Code) || e.FullName == "" {
+		return errMalformed
+	}
+	if e.Email != "" {
+		if _, err := mail.ParseAddress(e.Email); err != nil {
+			return errMalformed
+		}
+	}
+	return nil
+}
+
+// checkAssignee returns an error unless code belongs to an active employee.
+func checkAssignee(store dataInterface, code string) error {
+	err, e := store.ReadEmployee(code)
+	if err == errNotFound {
+		return errUnknownEmployee
+	} else if err != nil {
+		return err
+	}
+	if !e.Active {
+		return errInactiveEmployee
+	}
+	return nil
+}
+
+// assigneeError writes the response for an assignee checkAssignee rejected.
+// It returns false for any other error.
+func assigneeError(w http.ResponseWriter, err error) bool {
+	if err == errUnknownEmployee || err == errInactiveEmployee {
+		http.Error(w, "'assignee' field: " + err.Error(), http.StatusBadRequest)
+		return true
+	}
+	return false
+}
+
+func getEmployees(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dataAccess.Lock()
+	err, el := dataStore.ReadEmployees()
+	dataAccess.Unlock()
+
+	if err == errNotFound {
+		http.Error(w, "No employees found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(el)
+}
+
+func getEmployee(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	code := r.URL.Query().Get("code")
+
+	dataAccess.Lock()
+	err, e := dataStore.ReadEmployee(code)
+	dataAccess.Unlock()
+
+	if err == errNotFound {
+		http.Error(w, "Employee not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(e)
+}
+
+// decodeEmployee reads an employee from the body of r. Employees are active
+// unless the body says otherwise.
+func decodeEmployee(w http.ResponseWriter, r *http.Request) (Employee, bool) {
+	e := Employee{ Active: true }
+	err := json.NewDecoder(r.Body).Decode(&e)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return e, false
+	}
+	if validateEmployee(e) != nil {
+		http.Error(w, "'code' must match " + employeeCodeFormat.String() + ", 'fullName' is mandatory and 'email' must be a valid address.", http.StatusBadRequest)
+		return e, false
+	}
+	return e, true
+}
+
+func addEmployee(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	e, ok := decodeEmployee(w, r)
+	if !ok {
+		return
+	}
+
+	dataAccess.Lock()
+	err := dataStore.AddEmployee(e)
+	dataAccess.Unlock()
+
+	if err == errAlreadyExists {
+		http.Error(w, "Employee already exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func updateEmployee(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	e, ok := decodeEmployee(w, r)
+	if !ok {
+		return
+	}
+
+	dataAccess.Lock()
+	err := dataStore.UpdateEmployee(e)
+	dataAccess.Unlock()
+
+	if err == errNotFound {
+		http.Error(w, "Employee not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteEmployee refuses to delete employees who still have computers,
+// archived ones included. Those who left with their computers returned can
+// be deactivated instead, which keeps them in the records.
+func deleteEmployee(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	code := r.URL.Query().Get("code")
+
+	dataAccess.Lock()
+	err := dataStore.WithTx(func(tx dataInterface) error {
+		err, _ := tx.ReadAll(KeyAssignee, code)
+		if err == nil {
+			return errEmployeeHasComputers
+		} else if err != errNotFound {
+			return err
+		}
+		err, al := tx.ReadArchived()
+		if err != nil && err != errNotFound {
+			return err
+		}
+		for _, a := range(al) {
+			if a.Assignee == code {
+				return errEmployeeHasComputers
+			}
+		}
+		return tx.DeleteEmployee(code)
+	})
+	dataAccess.Unlock()
+
+	if err == errNotFound {
+		http.Error(w, "Employee not found", http.StatusNotFound)
+		return
+	} else if err == errEmployeeHasComputers {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+// AssignmentEvent records a change of assignee of a computer. Adding an
+// assigned computer or deleting one count as changes too.
+type AssignmentEvent struct {
+	MAC		string `json:"mac"`
+	Name		string `json:"name"`
+	IP		string `json:"ip"`
+	OldAssignee	string `json:"oldAssignee"`
+	NewAssignee	string `json:"newAssignee"`
+	Time		time.Time `json:"time"`
+	Actor		string `json:"actor"`
+	// Override explains why a change that exceeds a quota was forced.
+	Override	string `json:"override,omitempty"`
+}
+
+// actorHeader lets clients tell who is making a change. Without it, the
+// history records the address the request came from.
+const actorHeader = "X-Actor"
+
+func actor(r *http.Request) string {
+	if a := r.Header.Get(actorHeader); a != "" {
+		return a
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func newEvent(c Computer, newAssignee, actor string) AssignmentEvent {
+	return AssignmentEvent {
+		MAC:		c.MAC,
+		Name:		c.Name,
+		IP:		c.IP,
+		OldAssignee:	c.Assignee,
+		NewAssignee:	newAssignee,
+		Time:		time.Now().UTC(),
+		Actor:		actor,
+	}
+}
+
+// The functions below perform a change along with its history event as a
+// single transaction. They must be called with dataAccess held. Computers
+// can only be given to active employees, within their quota unless force is
+// set.
+
+// addWithHistory records the addition of unassigned computers too, with an
+// event from and to no assignee.
+func addWithHistory(c Computer, actor string, force bool) error {
+	return dataStore.WithTx(func(tx dataInterface) error {
+		var override string
+		if c.Assignee != "" {
+			err := checkAssignee(tx, c.Assignee)
+			if err != nil {
+				return err
+			}
+			override, err = checkQuota(tx, c.Assignee, force)
+			if err != nil {
+				return err
+			}
+		}
+		err := tx.Add(c)
+		if err != nil {
+			return err
+		}
+		unassigned := c
+		unassigned.Assignee = ""
+		e := newEvent(unassigned, c.Assignee, actor)
+		e.Override = override
+		return tx.AddEvent(e)
+	})
+}
+
+// assignWithHistory assigns a computer, or unassigns it if assignee is empty.
+func assignWithHistory(keytype, key, assignee, actor string, force bool) error {
+	return dataStore.WithTx(func(tx dataInterface) error {
+		err, c := tx.Read(keytype, key)
+		if err != nil {
+			return err
+		}
+		var override string
+		if assignee != "" && assignee != c.Assignee {
+			err = checkAssignee(tx, assignee)
+			if err != nil {
+				return err
+			}
+			override, err = checkQuota(tx, assignee, force)
+			if err != nil {
+				return err
+			}
+		}
+		if assignee == "" {
+			err = tx.Unassign(keytype, key)
+		} else {
+			err = tx.Assign(keytype, key, assignee)
+		}
+		if err != nil || c.Assignee == assignee {
+			return err
+		}
+		e := newEvent(*c, assignee, actor)
+		e.Override = override
+		return tx.AddEvent(e)
+	})
+}
+
+func getHistory(w http.ResponseWriter, r *http.Request, keytype, param string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.URL.Query().Get(param)
+
+	dataAccess.Lock()
+	err, el := dataStore.ReadEvents(keytype, key)
+	dataAccess.Unlock()
+
+	if err == errNotFound {
+		http.Error(w, "No events found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(el)
+}
+
+func getHistoryByMAC(w http.ResponseWriter, r *http.Request) {
+	getHistory(w, r, KeyMAC, "mac")
+}
+
+func getHistoryByName(w http.ResponseWriter, r *http.Request) {
+	getHistory(w, r, KeyName, "name")
+}
+
+func getHistoryByIP(w http.ResponseWriter, r *http.Request) {
+	getHistory(w, r, KeyIP, "ip")
+}
+
+func getHistoryByAssignee(w http.ResponseWriter, r *http.Request) {
+	getHistory(w, r, KeyAssignee, "assignee")
+}
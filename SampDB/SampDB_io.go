@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"time"
 
 	_ "github.com/gwenn/gosqlite"
 )
@@ -22,6 +27,10 @@ var errNotFound = errors.New("record not found")
 var errAlreadyExists = errors.New("record already exists")
 var errNotUnique = errors.New("record is not uniquely described by key value pair")
 var errMalformed = errors.New("malformed record")
+var errMigratingDB = errors.New("error migrating database")
+var errSchemaTooNew = errors.New("database schema is newer than supported")
+var errNestedTx = errors.New("transaction already in progress")
+var errStale = errors.New("record has been modified since it was read")
 
 const (
 	KeyMAC		= "MAC"
@@ -39,38 +48,243 @@ type dataInterface interface {
 	Delete (string, string) error
 	Assign (string, string, string) error
 	Unassign (string, string) error
+	// AddEvent records a change of assignment. ReadEvents returns the
+	// recorded changes of a computer (by MAC, Name or IP), of an employee
+	// (by Assignee) or all of them (KeyAll), oldest first.
+	AddEvent (AssignmentEvent) error
+	ReadEvents (string, string) (error, []AssignmentEvent)
+	// Archive moves a computer out of the active ones, recording why.
+	// Archived computers are identified by an ID of their own, since they
+	// don't need to be unique. Restore makes one active again and returns
+	// it, while Purge drops it for good. AddArchived adds one as it is,
+	// under a new ID, and returns the ID.
+	Archive (string, string, string) error
+	AddArchived (ArchivedComputer) (error, int)
+	ReadArchived () (error, []ArchivedComputer)
+	Restore (int) (error, *Computer)
+	Purge (int) error
+	// The employee directory, keyed by employee code.
+	ReadEmployee (string) (error, *Employee)
+	ReadEmployees () (error, []Employee)
+	AddEmployee (Employee) error
+	UpdateEmployee (Employee) error
+	DeleteEmployee (string) error
+	// The outbox of notifications waiting to be delivered. AddOutbox
+	// returns the ID given to the entry. ReadOutbox returns the entries
+	// with a given status, or all of them, oldest first.
+	AddOutbox (OutboxEntry) (error, int)
+	ReadOutbox (string) (error, []OutboxEntry)
+	UpdateOutbox (OutboxEntry) error
+	// WithTx runs fn as a single transaction. The store handed to fn must
+	// be used for every operation in the transaction. If fn returns an
+	// error, none of its changes are kept.
+	WithTx (func(dataInterface) error) error
 	Close() error
 }
 
-func GetDataStore(dbtype, file string, db *dataInterface) error {
-	if dbtype == "volatile" {
-		return initVolatile(db)
+// storageFactory opens a data store. dsn is the file name, or whatever else
+// the backend needs to locate its data.
+type storageFactory func(db *dataInterface, dsn string) error
+
+// storageBackend is a storage type that can be selected with --storage-type.
+// Backends without a default DSN don't keep their data across restarts.
+type storageBackend struct {
+	name		string
+	description	string
+	defaultDSN	string
+	factory		storageFactory
+}
+
+var storageBackends = make(map[string]storageBackend)
+
+// RegisterStorage makes a backend available under name. Backends register
+// themselves from an init function, like the built-in ones below.
+func RegisterStorage(name, description, defaultDSN string, factory storageFactory) {
+	if _, exists := storageBackends[name]; exists {
+		panic("storage backend " + name + " registered twice")
 	}
-	if dbtype == "json" {
-		return initJSON(db, file)
+	storageBackends[name] = storageBackend{ name, description, defaultDSN, factory }
+}
+
+// StorageTypes returns the names of all registered backends, sorted.
+func StorageTypes() []string {
+	names := make([]string, 0, len(storageBackends))
+	for name := range(storageBackends) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterStorage("volatile", "keep the data in memory only (for testing)", "",
+		func(db *dataInterface, dsn string) error { return initVolatile(db) })
+	RegisterStorage("json", "human-readable JSON file", "default.json", initJSON)
+	RegisterStorage("sqlite", "SQLite database file", "default.sqlite", initSQL)
+}
+
+func GetDataStore(dbtype, file string, db *dataInterface) error {
+	backend, ok := storageBackends[dbtype]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error unknown DB type %s.\n", dbtype)
+		return errUnknownDBType
 	}
-	if dbtype == "sqlite" {
-		return initSQL(db, file)
+	if file == "" {
+		file = backend.defaultDSN
 	}
-	fmt.Fprintf(os.Stderr, "Error unknown DB type %s.\n", dbtype)
-	return errUnknownDBType
+	return backend.factory(db, file)
 }
 
 /****************/
 /* Non-Volatile */
 /****************/
 
+// volatileStore keeps the computers in memory. The records themselves live in
+// data, while the maps index them by position (MAC, Name, IP) or by MAC
+// (assignee sets) so that lookups don't need to walk the whole slice.
 type volatileStore struct {
-	data []Computer
+	data		[]Computer
+	byMAC		map[string]int
+	byName		map[string]int
+	byIP		map[string]int
+	byAssignee	map[string]map[string]bool
+	unassigned	map[string]bool
+	events		[]AssignmentEvent
+	eventIndex	map[string][]int
+	archive		map[int]ArchivedComputer
+	archiveSeq	int
+	employees	map[string]Employee
+	outbox		[]OutboxEntry
+	inTx		bool
+	undo		[]func()
 }
 
-var v volatileStore
+func newVolatileStore() *volatileStore {
+	return &volatileStore{
+		byMAC:		make(map[string]int),
+		byName:		make(map[string]int),
+		byIP:		make(map[string]int),
+		byAssignee:	make(map[string]map[string]bool),
+		unassigned:	make(map[string]bool),
+		eventIndex:	make(map[string][]int),
+		archive:	make(map[int]ArchivedComputer),
+		employees:	make(map[string]Employee),
+	}
+}
 
 func initVolatile (vp *dataInterface) error {
-	*vp = (dataInterface)(&v)
+	*vp = (dataInterface)(newVolatileStore())
 	return nil
 }
 
+// index returns the position in data of the computer identified by key.
+func (v *volatileStore) index (keytype, key string) (int, bool) {
+	var n int
+	var ok bool
+	switch keytype {
+	case KeyMAC:
+		n, ok = v.byMAC[key]
+	case KeyName:
+		n, ok = v.byName[key]
+	case KeyIP:
+		n, ok = v.byIP[key]
+	}
+	return n, ok
+}
+
+// place stores c at position n of data and indexes it.
+func (v *volatileStore) place (n int, c Computer) {
+	assignee := c.Assignee
+	c.Assignee = ""
+	v.data[n] = c
+	v.byMAC[c.MAC] = n
+	v.byName[c.Name] = n
+	v.byIP[c.IP] = n
+	v.unassigned[c.MAC] = true
+	v.setAssignee(n, assignee)
+}
+
+// move relocates the computer at position from to position to.
+func (v *volatileStore) move (from, to int) {
+	c := v.data[from]
+	v.data[to] = c
+	v.byMAC[c.MAC] = to
+	v.byName[c.Name] = to
+	v.byIP[c.IP] = to
+}
+
+// remove drops the computer at position n from every index, then moves the
+// last record into the freed slot, the same way the slice was always
+// compacted.
+func (v *volatileStore) remove (n int) {
+	c := v.data[n]
+	v.setAssignee(n, "")
+	delete(v.unassigned, c.MAC)
+	delete(v.byMAC, c.MAC)
+	delete(v.byName, c.Name)
+	delete(v.byIP, c.IP)
+
+	last := len(v.data) - 1
+	if n != last {
+		v.move(last, n)
+	}
+	v.data[last] = Computer{}
+	v.data = v.data[:last]
+}
+
+// insert undoes remove, putting c back at position n.
+func (v *volatileStore) insert (n int, c Computer) {
+	v.data = append(v.data, Computer{})
+	if n != len(v.data) - 1 {
+		v.move(n, len(v.data) - 1)
+	}
+	v.place(n, c)
+}
+
+// record remembers how to revert a change, if a transaction is open.
+func (v *volatileStore) record (undo func()) {
+	if v.inTx {
+		v.undo = append(v.undo, undo)
+	}
+}
+
+// setAssignee moves the computer at position n from its current assignee set
+// to the one of assignee.
+func (v *volatileStore) setAssignee (n int, assignee string) {
+	mac := v.data[n].MAC
+	if old := v.data[n].Assignee; old == "" {
+		delete(v.unassigned, mac)
+	} else {
+		delete(v.byAssignee[old], mac)
+		if len(v.byAssignee[old]) == 0 {
+			delete(v.byAssignee, old)
+		}
+	}
+	if assignee == "" {
+		v.unassigned[mac] = true
+	} else {
+		if v.byAssignee[assignee] == nil {
+			v.byAssignee[assignee] = make(map[string]bool)
+		}
+		v.byAssignee[assignee][mac] = true
+	}
+	v.data[n].Assignee = assignee
+}
+
+// collect returns the computers whose MACs are in set, in storage order.
+func (v *volatileStore) collect (set map[string]bool) []Computer {
+	idx := make([]int, 0, len(set))
+	for mac := range(set) {
+		idx = append(idx, v.byMAC[mac])
+	}
+	sort.Ints(idx)
+	cl := make([]Computer, 0, len(idx))
+	for _, n := range(idx) {
+		cl = append(cl, v.data[n])
+	}
+	return cl
+}
+
 func (v *volatileStore) Read (keytype, key string) (error, *Computer) {
 	if keytype != KeyMAC && keytype != KeyName && keytype != KeyIP {
 		if keytype == KeyAssignee || keytype == KeyNotAssigned {
@@ -80,20 +294,9 @@ func (v *volatileStore) Read (keytype, key string) (error, *Computer) {
 		fmt.Fprintf(os.Stderr, "Error fetching item: Unknown key type %s.\n", keytype)
 		return errUnknownKeyType, nil
 	}
-	var found *Computer = nil
-	for _, c := range(v.data) {
-		if (keytype == KeyMAC && c.MAC == key) ||
-		   (keytype == KeyName && c.Name == key) ||
-		   (keytype == KeyIP && c.IP == key) {
-			if found != nil {
-				fmt.Fprintf(os.Stderr, "Error fetching item with %s=%s: Multiple entries found.\n", keytype, key)
-				return errNotUnique, nil
-			}
-			found = &c
-		}
-	}
-	if found != nil {
-		return nil, found
+	if n, ok := v.index(keytype, key); ok {
+		c := v.data[n]
+		return nil, &c
 	}
 
 	fmt.Fprintf(os.Stderr, "Error fetching item with %s=%s: No item found.\n", keytype, key)
@@ -104,22 +307,12 @@ func (v *volatileStore) ReadAll (keytype, key string) (error, []Computer) {
 	var cl []Computer
 
 	if keytype == KeyAssignee {
-		for _, c := range(v.data) {
-			if c.Assignee == key {
-				cl = append(cl, c)
-			}
-		}
+		cl = v.collect(v.byAssignee[key])
 	} else if keytype == KeyNotAssigned {
-		for _, c := range(v.data) {
-			if c.Assignee == "" {
-				cl = append(cl, c)
-			}
-		}
+		cl = v.collect(v.unassigned)
 	} else if keytype == KeyAll {
-		for _, c := range(v.data) {
-			cl = append(cl, c)
-			fmt.Printf("@")
-		}
+		cl = make([]Computer, len(v.data))
+		copy(cl, v.data)
 	} else if keytype == KeyMAC || keytype == KeyName || keytype == KeyIP {
 		fmt.Fprintf(os.Stderr, "Error fetching items: Invalid key type %s.\n", keytype)
 		return errInvalidKeyType, nil
@@ -141,17 +334,21 @@ func (v *volatileStore) Add (c Computer) error {
 		fmt.Fprintf(os.Stderr, "Error adding item: MAC, Name and IP are mandatory fields.\n")
 		return errMalformed
 	}
-	if c.Assignee != "" && len(c.Assignee) != 3 {
-		fmt.Fprintf(os.Stderr, "Error adding item: Assignee code must be exactly three characters long.\n")
-		return errMalformed
+	_, macExists := v.byMAC[c.MAC]
+	_, nameExists := v.byName[c.Name]
+	_, ipExists := v.byIP[c.IP]
+	if macExists || nameExists || ipExists {
+		fmt.Fprintf(os.Stderr, "Error adding item: Item already exists.\n")
+		return errAlreadyExists
 	}
-	for _, nvc := range(v.data) {
-		if c.MAC == nvc.MAC || c.Name == nvc.Name || c.IP == nvc.IP {
-			fmt.Fprintf(os.Stderr, "Error adding item: Item already exists.\n")
-			return errAlreadyExists
-		}
+
+	if c.Revision < 1 {
+		c.Revision = 1
 	}
-	v.data = append(v.data, c)
+	n := len(v.data)
+	v.data = append(v.data, Computer{})
+	v.place(n, c)
+	v.record(func() { v.remove(n) })
 
 	return nil
 }
@@ -165,47 +362,20 @@ func (v *volatileStore) Delete (keytype, key string) error {
 		fmt.Fprintf(os.Stderr, "Error deleting item: Unknown key type %s.\n", keytype)
 		return errUnknownKeyType
 	}
-	if len(v.data) == 0 {
-		fmt.Fprintf(os.Stderr, "Error deleting item with %s=%s: Item not found.\n", keytype, key)
-		return errNotFound
-	}
-	if len(v.data) == 1 {
-		if (keytype == KeyMAC && v.data[0].MAC == key) ||
-		   (keytype == KeyName && v.data[0].Name == key) ||
-		   (keytype == KeyIP && v.data[0].IP == key) {
-			v.data = nil
-			return nil
-		}
+	n, ok := v.index(keytype, key)
+	if !ok {
 		fmt.Fprintf(os.Stderr, "Error deleting item with %s=%s: Item not found.\n", keytype, key)
 		return errNotFound
 	}
-	found := -1
-	for n, c := range(v.data) {
-		if (keytype == KeyMAC && c.MAC == key) ||
-		   (keytype == KeyName && c.Name == key) ||
-		   (keytype == KeyIP && c.IP == key) {
-			if found >= 0 {
-				return errNotUnique
-		fmt.Fprintf(os.Stderr, "Error deleting item with %s=%s: Multiple items found.\n", keytype, key)
-			}
-			found = n
-		}
-	}
-	if found >= 0 {
-		v.data[found] = v.data[len(v.data)-1]
-		v.data = v.data[:len(v.data)-1]
-		return nil
-	}
 
-	fmt.Fprintf(os.Stderr, "Error deleting item with %s=%s: Item not found.\n", keytype, key)
-	return errNotFound
+	c := v.data[n]
+	v.remove(n)
+	v.record(func() { v.insert(n, c) })
+
+	return nil
 }
 
 func (v *volatileStore) Assign (keytype, key, assignee string) error {
-	if assignee != "" && len(assignee) != 3 {
-		fmt.Fprintf(os.Stderr, "Error assigning item: Assignee code must be exactly 3 characters long.\n")
-		return errMalformed
-	}
 	if keytype != KeyMAC && keytype != KeyName && keytype != KeyIP {
 		if keytype == KeyAssignee || keytype == KeyNotAssigned {
 			fmt.Fprintf(os.Stderr, "Error assigning item: Invalid key type %s.\n", keytype)
@@ -214,20 +384,14 @@ func (v *volatileStore) Assign (keytype, key, assignee string) error {
 		fmt.Fprintf(os.Stderr, "Error assigning item: Unknown key type %s.\n", keytype)
 		return errUnknownKeyType
 	}
-	found := -1
-	for n, _ := range(v.data) {
-		if (keytype == KeyMAC && v.data[n].MAC == key) ||
-		   (keytype == KeyName && v.data[n].Name == key) ||
-		   (keytype == KeyIP && v.data[n].IP == key) {
-			if found >= 0 {
-				fmt.Fprintf(os.Stderr, "Error assigning item with %s=%s: Multiple items found.\n", keytype, key)
-				return errNotUnique
-			}
-			found = n
-		}
-	}
-	if found >= 0 {
-		v.data[found].Assignee = assignee
+	if n, ok := v.index(keytype, key); ok {
+		previous, revision := v.data[n].Assignee, v.data[n].Revision
+		v.setAssignee(n, assignee)
+		v.data[n].Revision++
+		v.record(func() {
+			v.setAssignee(n, previous)
+			v.data[n].Revision = revision
+		})
 		return nil
 	}
 
@@ -239,200 +403,1591 @@ func (v *volatileStore) Unassign (keytype, key string) error {
 	return v.Assign(keytype, key, "")
 }
 
-func (v *volatileStore) Close() error {
-	return nil
+// eventKeys returns the keys under which e is found in eventIndex.
+func eventKeys (e AssignmentEvent) []string {
+	keys := []string{ KeyMAC + "=" + e.MAC, KeyName + "=" + e.Name, KeyIP + "=" + e.IP }
+	if e.OldAssignee != "" {
+		keys = append(keys, KeyAssignee + "=" + e.OldAssignee)
+	}
+	if e.NewAssignee != "" && e.NewAssignee != e.OldAssignee {
+		keys = append(keys, KeyAssignee + "=" + e.NewAssignee)
+	}
+	return keys
 }
 
-/********/
-/* JSON */
-/********/
-
-type jsonStore struct {
-	file	*os.File
-	v	dataInterface
+func (v *volatileStore) AddEvent (e AssignmentEvent) error {
+	if e.MAC == "" || e.Name == "" || e.IP == "" {
+		fmt.Fprintf(os.Stderr, "Error adding event: MAC, Name and IP are mandatory fields.\n")
+		return errMalformed
+	}
+	n := len(v.events)
+	v.events = append(v.events, e)
+	keys := eventKeys(e)
+	for _, k := range(keys) {
+		v.eventIndex[k] = append(v.eventIndex[k], n)
+	}
+	v.record(func() {
+		for _, k := range(keys) {
+			v.eventIndex[k] = v.eventIndex[k][:len(v.eventIndex[k]) - 1]
+			if len(v.eventIndex[k]) == 0 {
+				delete(v.eventIndex, k)
+			}
+		}
+		v.events = v.events[:n]
+	})
+	return nil
 }
 
-var j jsonStore
-func initJSON (jp *dataInterface, filename string) error {
-	var err error
-
-	err = initVolatile(&j.v)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error initializing internal database: %s\n", err.Error())
-		return errCreatingDB
+func (v *volatileStore) ReadEvents (keytype, key string) (error, []AssignmentEvent) {
+	if keytype == KeyAll {
+		if len(v.events) == 0 {
+			fmt.Fprintf(os.Stderr, "Error fetching events: No events found.\n")
+			return errNotFound, nil
+		}
+		return nil, append([]AssignmentEvent(nil), v.events...)
 	}
-
-	// Check if file exists
-	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
-		j.file, err = os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating file %s: %s\n", filename, err.Error())
-			return errCreatingDB
+	if keytype != KeyMAC && keytype != KeyName && keytype != KeyIP && keytype != KeyAssignee {
+		if keytype == KeyNotAssigned {
+			fmt.Fprintf(os.Stderr, "Error fetching events: Invalid key type %s.\n", keytype)
+			return errInvalidKeyType, nil
 		}
-	} else {
+		fmt.Fprintf(os.Stderr, "Error fetching events: Unknown key type %s.\n", keytype)
+		return errUnknownKeyType, nil
+	}
+	idx := v.eventIndex[keytype + "=" + key]
+	if len(idx) == 0 {
+		fmt.Fprintf(os.Stderr, "Error fetching events with %s=%s: No events found.\n", keytype, key)
+		return errNotFound, nil
+	}
+	el := make([]AssignmentEvent, len(idx))
+	for i, n := range(idx) {
+		el[i] = v.events[n]
+	}
+	return nil, el
+}
 
-		j.file, err = os.OpenFile(filename, os.O_RDWR, 0666)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error opening file %s: %s\n", filename, err.Error())
-			return errOpeningDB
+// hasEvent tells whether e was recorded already.
+func (v *volatileStore) hasEvent (e AssignmentEvent) bool {
+	for _, n := range(v.eventIndex[KeyMAC + "=" + e.MAC]) {
+		if v.events[n] == e {
+			return true
 		}
+	}
+	return false
+}
 
-		dec := json.NewDecoder(j.file)
-		_, err = dec.Token()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error decoding JSON: %s\n", err.Error())
-			return errReadingDB
-		}
-		for dec.More() {
-			var c Computer
-			err := dec.Decode(&c)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error decoding JSON: %s\n", err.Error())
-				return errReadingDB
-			}
-			err = j.v.Add(c)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error updating internal database: %s\n", err.Error())
-				return errReadingDB
-			}
-		}
-		_, err = dec.Token()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error decoding JSON: %s\n", err.Error())
-			return errReadingDB
+// archiveComputer moves a computer to the archive, with the given time.
+func (v *volatileStore) archiveComputer (keytype, key, reason string, when time.Time) (ArchivedComputer, error) {
+	if keytype != KeyMAC && keytype != KeyName && keytype != KeyIP {
+		if keytype == KeyAssignee || keytype == KeyNotAssigned {
+			fmt.Fprintf(os.Stderr, "Error archiving item: Invalid key type %s.\n", keytype)
+			return ArchivedComputer{}, errInvalidKeyType
 		}
+		fmt.Fprintf(os.Stderr, "Error archiving item: Unknown key type %s.\n", keytype)
+		return ArchivedComputer{}, errUnknownKeyType
+	}
+	n, ok := v.index(keytype, key)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error archiving item with %s=%s: Item not found.\n", keytype, key)
+		return ArchivedComputer{}, errNotFound
 	}
 
-	*jp = (dataInterface)(&j)
+	a := newArchivedComputer(v.data[n], reason, when)
+	a.ID = v.archiveSeq + 1
+	c := v.data[n]
+	v.remove(n)
+	v.record(func() { v.insert(n, c) })
+	v.putArchived(a)
+	return a, nil
+}
 
-	return nil
+// putArchived adds a to the archive, keeping its ID.
+func (v *volatileStore) putArchived (a ArchivedComputer) {
+	seq := v.archiveSeq
+	v.archive[a.ID] = a
+	if a.ID > v.archiveSeq {
+		v.archiveSeq = a.ID
+	}
+	v.record(func() {
+		delete(v.archive, a.ID)
+		v.archiveSeq = seq
+	})
 }
 
-func (j *jsonStore) Read (keytype, key string) (error, *Computer) {
-	return j.v.Read(keytype, key)
+// dropArchived removes an archived computer and returns it.
+func (v *volatileStore) dropArchived (id int) (ArchivedComputer, error) {
+	a, ok := v.archive[id]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error fetching archived item %d: Item not found.\n", id)
+		return a, errNotFound
+	}
+	delete(v.archive, id)
+	v.record(func() { v.archive[id] = a })
+	return a, nil
 }
 
-func (j *jsonStore) ReadAll (keytype, key string) (error, []Computer) {
-	return j.v.ReadAll(keytype, key)
+func (v *volatileStore) Archive (keytype, key, reason string) error {
+	_, err := v.archiveComputer(keytype, key, reason, time.Now().UTC())
+	return err
 }
 
-func (j *jsonStore) Write () error {
-	j.file.Truncate(0)
-	j.file.Seek(0, 0)
-	err, cl := j.v.ReadAll(KeyAll, "")
-	if len(cl) > 0 {
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading internal database: %s\n", err.Error())
-			return err
-		}
-		err = json.NewEncoder(j.file).Encode(cl)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error encoding JSON: %s\n", err.Error())
-			return errWritingDB
-		}
-	} else {
-		// Ignore error
-		n, err := j.file.WriteString("[]")
-		if n != 2 || err != nil {
-			fmt.Fprintf(os.Stderr, "Error writing JSON file: %s\n", err.Error())
-			return errWritingDB
-		}
+func (v *volatileStore) AddArchived (a ArchivedComputer) (error, int) {
+	a.ID = v.archiveSeq + 1
+	v.putArchived(a)
+	return nil, a.ID
+}
+
+func (v *volatileStore) ReadArchived () (error, []ArchivedComputer) {
+	if len(v.archive) == 0 {
+		fmt.Fprintf(os.Stderr, "Error fetching archived items: No items found.\n")
+		return errNotFound, nil
 	}
-	return nil
+	al := make([]ArchivedComputer, 0, len(v.archive))
+	for _, a := range(v.archive) {
+		al = append(al, a)
+	}
+	sort.Slice(al, func(i, k int) bool { return al[i].ID < al[k].ID })
+	return nil, al
 }
 
-func (j *jsonStore) Add (c Computer) error {
-	err := j.v.Add(c)
+func (v *volatileStore) Restore (id int) (error, *Computer) {
+	a, ok := v.archive[id]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error restoring archived item %d: Item not found.\n", id)
+		return errNotFound, nil
+	}
+	c := a.restored()
+	err := v.Add(c)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error adding item to internal database: %s\n", err.Error())
-		return err
+		return err, nil
 	}
-	return j.Write()
+	v.dropArchived(id)
+	return nil, &c
 }
 
-func (j *jsonStore) Delete (keytype, key string) error {
-	err := j.v.Delete(keytype, key)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error deleting item from internal database: %s\n", err.Error())
-		return err
+func (v *volatileStore) Purge (id int) error {
+	_, err := v.dropArchived(id)
+	return err
+}
+
+func (v *volatileStore) ReadEmployee (code string) (error, *Employee) {
+	e, ok := v.employees[code]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error fetching employee %s: Employee not found.\n", code)
+		return errNotFound, nil
 	}
-	return j.Write()
+	return nil, &e
 }
 
-func (j *jsonStore) Assign (keytype, key, assignee string) error {
-	err := j.v.Assign(keytype, key, assignee)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error updating item assignment in internal database: %s\n", err.Error())
-		return err
+func (v *volatileStore) ReadEmployees () (error, []Employee) {
+	if len(v.employees) == 0 {
+		fmt.Fprintf(os.Stderr, "Error fetching employees: No employees found.\n")
+		return errNotFound, nil
+	}
+	el := make([]Employee, 0, len(v.employees))
+	for _, e := range(v.employees) {
+		el = append(el, e)
 	}
-	return j.Write()
+	sort.Slice(el, func(i, k int) bool { return el[i].Code < el[k].Code })
+	return nil, el
 }
 
-func (j *jsonStore) Unassign (keytype, key string) error {
-	err := j.v.Assign(keytype, key, "")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error removing item assignment in internal database: %s\n", err.Error())
-		return err
+// putEmployee adds or replaces an employee.
+func (v *volatileStore) putEmployee (e Employee) {
+	previous, existed := v.employees[e.Code]
+	v.employees[e.Code] = e
+	v.record(func() {
+		if existed {
+			v.employees[e.Code] = previous
+		} else {
+			delete(v.employees, e.Code)
+		}
+	})
+}
+
+func (v *volatileStore) AddEmployee (e Employee) error {
+	if validateEmployee(e) != nil {
+		fmt.Fprintf(os.Stderr, "Error adding employee: Code must match %s and full name is mandatory.\n", employeeCodeFormat)
+		return errMalformed
+	}
+	if _, ok := v.employees[e.Code]; ok {
+		fmt.Fprintf(os.Stderr, "Error adding employee %s: Employee already exists.\n", e.Code)
+		return errAlreadyExists
 	}
-	return j.Write()
+	v.putEmployee(e)
+	return nil
 }
 
-func (j *jsonStore) Close() error {
-	err := j.file.Close()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error closing internal database: %s\n", err.Error())
-		return errClosingDB
+func (v *volatileStore) UpdateEmployee (e Employee) error {
+	if validateEmployee(e) != nil {
+		fmt.Fprintf(os.Stderr, "Error updating employee: Code must match %s and full name is mandatory.\n", employeeCodeFormat)
+		return errMalformed
 	}
+	if _, ok := v.employees[e.Code]; !ok {
+		fmt.Fprintf(os.Stderr, "Error updating employee %s: Employee not found.\n", e.Code)
+		return errNotFound
+	}
+	v.putEmployee(e)
 	return nil
 }
 
-/***********/
-/* SQLite */
-/***********/
+func (v *volatileStore) DeleteEmployee (code string) error {
+	e, ok := v.employees[code]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error deleting employee %s: Employee not found.\n", code)
+		return errNotFound
+	}
+	delete(v.employees, code)
+	v.record(func() { v.employees[code] = e })
+	return nil
+}
 
-type sqlStore struct {
-	data *sql.DB
+// putOutbox adds an outbox entry or replaces the one with the same ID. IDs
+// are positions in the outbox, starting from 1.
+func (v *volatileStore) putOutbox (e OutboxEntry) error {
+	if e.ID < 1 || e.ID > len(v.outbox) + 1 {
+		fmt.Fprintf(os.Stderr, "Error writing outbox entry %d: Entry not found.\n", e.ID)
+		return errNotFound
+	}
+	if e.ID == len(v.outbox) + 1 {
+		v.outbox = append(v.outbox, e)
+		v.record(func() { v.outbox = v.outbox[:e.ID - 1] })
+		return nil
+	}
+	previous := v.outbox[e.ID - 1]
+	v.outbox[e.ID - 1] = e
+	v.record(func() { v.outbox[e.ID - 1] = previous })
+	return nil
 }
 
-var db sqlStore
+func (v *volatileStore) AddOutbox (e OutboxEntry) (error, int) {
+	e.ID = len(v.outbox) + 1
+	return v.putOutbox(e), e.ID
+}
 
-func initSQL (sqlp *dataInterface, filename string) error {
-	var err error
+func (v *volatileStore) ReadOutbox (status string) (error, []OutboxEntry) {
+	var el []OutboxEntry
+	for _, e := range(v.outbox) {
+		if status == "" || e.Status == status {
+			el = append(el, e)
+		}
+	}
+	if len(el) == 0 {
+		return errNotFound, nil
+	}
+	return nil, el
+}
 
-	db.data, err = sql.Open("sqlite3", filename)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error opening SQL database: %s\n", err.Error())
-		return errOpeningDB
+func (v *volatileStore) UpdateOutbox (e OutboxEntry) error {
+	if e.ID < 1 || e.ID > len(v.outbox) {
+		fmt.Fprintf(os.Stderr, "Error updating outbox entry %d: Entry not found.\n", e.ID)
+		return errNotFound
 	}
-	db.data.SetMaxOpenConns(1)
+	return v.putOutbox(e)
+}
 
-	createSQL := `CREATE TABLE IF NOT EXISTS computers (
-		MAC VARCHAR(17) NOT NULL,
-		Name VARCHAR(50) NOT NULL,
-  		IP VARCHAR(15) NOT NULL,
-		Assignee VARCHAR(3),
-		Description TEXT,
-		PRIMARY KEY (MAC, Name, IP)
-	);`
+// WithTx keeps an undo log while fn runs, and plays it backwards if fn fails.
+func (v *volatileStore) WithTx (fn func(dataInterface) error) error {
+	if v.inTx {
+		fmt.Fprintf(os.Stderr, "Error starting transaction: Transaction already in progress.\n")
+		return errNestedTx
+	}
+	v.inTx = true
+	committed := false
+	defer func() {
+		v.inTx = false
+		if !committed {
+			for i := len(v.undo) - 1; i >= 0; i-- {
+				v.undo[i]()
+			}
+		}
+		v.undo = nil
+	}()
 
-	_, err = db.data.Exec(createSQL)
+	err := fn(v)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating table in SQL database: %s\n", err.Error())
-		return errCreatingDB
+		return err
 	}
+	committed = true
+	return nil
+}
 
-	*sqlp = (dataInterface)(&db)
-
+func (v *volatileStore) Close() error {
 	return nil
 }
 
-func resolveTransaction(tx *sql.Tx) {
-	if p := recover(); p != nil {
-		fmt.Fprintf(os.Stderr, "Error encountered while updating SQL database. Rolling it back.\n")
-		tx.Rollback()
-		return
+/********/
+/* JSON */
+/********/
+
+// jsonStore keeps its data in a volatileStore and mirrors it to a JSON file.
+// By default, every mutation rewrites the whole file. In journaling mode,
+// mutations are appended to a journal next to it instead, and the journal is
+// folded into the JSON file every jsonCompactEvery entries. The assignment
+// history is kept apart, in a file of its own that is only ever appended to,
+// and so are archived computers, employees and the notification outbox,
+// which are written along with the JSON file.
+type jsonStore struct {
+	filename	string
+	journal		*os.File
+	history		*os.File
+	entries		int
+	archiveDirty	bool
+	employeesDirty	bool
+	outboxDirty	bool
+	inTx		bool
+	pending		[]journalEntry
+	pendingEvents	[]AssignmentEvent
+	// unflushed are the events in the journal but not in the history yet.
+	unflushed	[]AssignmentEvent
+	v		*volatileStore
+}
+
+// jsonComputer is a computer as stored in JSON files. Unlike in the REST API,
+// its revision is part of it.
+type jsonComputer struct {
+	Computer
+	Revision	int `json:"revision,omitempty"`
+}
+
+func toJSONComputer(c Computer) *jsonComputer {
+	return &jsonComputer{ c, c.Revision }
+}
+
+func (jc *jsonComputer) computer() Computer {
+	c := jc.Computer
+	c.Revision = jc.Revision
+	return c
+}
+
+// journalEntry is a single mutation as recorded in the journal.
+type journalEntry struct {
+	Op		string `json:"op"`
+	KeyType		string `json:"keytype,omitempty"`
+	Key		string `json:"key,omitempty"`
+	Assignee	string `json:"assignee,omitempty"`
+	Computer	*jsonComputer `json:"computer,omitempty"`
+	Archived	*ArchivedComputer `json:"archived,omitempty"`
+	Employee	*Employee `json:"employee,omitempty"`
+	Outbox		*OutboxEntry `json:"outbox,omitempty"`
+	Event		*AssignmentEvent `json:"event,omitempty"`
+	ID		int `json:"id,omitempty"`
+	Entries		[]journalEntry `json:"entries,omitempty"`
+}
+
+const (
+	journalAdd		= "add"
+	journalDelete		= "delete"
+	journalAssign		= "assign"
+	journalArchive		= "archive"
+	journalRestore		= "restore"
+	journalPurge		= "purge"
+	journalAddArchived	= "addArchived"
+	journalAddEmployee	= "addEmployee"
+	journalUpdateEmployee	= "updateEmployee"
+	journalDeleteEmployee	= "deleteEmployee"
+	journalOutbox		= "outbox"
+	journalEvent		= "event"
+	journalTx		= "tx"
+)
+
+const jsonCompactEvery = 100
+
+// jsonJournal selects the journaling mode for JSON storage.
+var jsonJournal = false
+
+func initJSON (jp *dataInterface, filename string) error {
+	var err error
+
+	j := &jsonStore{ filename: filename }
+	j.v = newVolatileStore()
+
+	// Check if file exists
+	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+		err = j.Write()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating file %s: %s\n", filename, err.Error())
+			return errCreatingDB
+		}
+	} else {
+		err = j.readSnapshot()
+		if err != nil {
+			return err
+		}
+	}
+	err = j.readArchive()
+	if err != nil {
+		return err
+	}
+	err = j.readEmployees()
+	if err != nil {
+		return err
+	}
+	err = j.readOutbox()
+	if err != nil {
+		return err
+	}
+
+	// The history goes first, since the journal may hold events that
+	// follow it.
+	offset, err := j.readHistory()
+	if err != nil {
+		return err
+	}
+	j.history, err = os.OpenFile(j.historyName(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening history %s: %s\n", j.historyName(), err.Error())
+		return errOpeningDB
+	}
+	err = j.history.Truncate(offset)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error truncating history %s: %s\n", j.historyName(), err.Error())
+		return errOpeningDB
+	}
+
+	entries, offset, err := j.replayJournal()
+	if err != nil {
+		return err
+	}
+
+	if jsonJournal {
+		j.journal, err = os.OpenFile(j.journalName(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening journal %s: %s\n", j.journalName(), err.Error())
+			return errOpeningDB
+		}
+		// Drop whatever is left of a record that was cut off mid-write.
+		err = j.journal.Truncate(offset)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error truncating journal %s: %s\n", j.journalName(), err.Error())
+			return errOpeningDB
+		}
+		j.entries = entries
+	} else if entries > 0 {
+		// Journaling has been turned off. Fold the journal into the
+		// snapshot and the history so it doesn't get replayed again.
+		err = j.flushEvents()
+		if err != nil {
+			return err
+		}
+		err = j.Write()
+		if err != nil {
+			return err
+		}
+		err = os.Remove(j.journalName())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error removing journal %s: %s\n", j.journalName(), err.Error())
+			return errWritingDB
+		}
+	}
+
+	*jp = (dataInterface)(j)
+
+	return nil
+}
+
+func (j *jsonStore) journalName () string {
+	return j.filename + ".journal"
+}
+
+func (j *jsonStore) archiveName () string {
+	return j.filename + ".archive"
+}
+
+func (j *jsonStore) employeesName () string {
+	return j.filename + ".employees"
+}
+
+func (j *jsonStore) outboxName () string {
+	return j.filename + ".outbox"
+}
+
+// readSidecar decodes the JSON file filename into data, if the file exists.
+func readSidecar (filename string, data interface{}) error {
+	file, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening %s: %s\n", filename, err.Error())
+		return errOpeningDB
+	}
+	defer file.Close()
+
+	err = json.NewDecoder(file).Decode(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error decoding JSON: %s\n", err.Error())
+		return errReadingDB
+	}
+	return nil
+}
+
+// writeSidecar replaces the JSON file filename with data.
+func writeSidecar (filename string, data interface{}) error {
+	err := writeFileAtomic(filename, func(file *os.File) error {
+		return json.NewEncoder(file).Encode(data)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %s\n", filename, err.Error())
+		return errWritingDB
+	}
+	return nil
+}
+
+// readArchive loads the archived computers into the internal database.
+func (j *jsonStore) readArchive () error {
+	var al []ArchivedComputer
+	err := readSidecar(j.archiveName(), &al)
+	if err != nil {
+		return err
+	}
+	for _, a := range(al) {
+		j.v.putArchived(a)
+	}
+	return nil
+}
+
+// readOutbox loads the notification outbox into the internal database.
+func (j *jsonStore) readOutbox () error {
+	var el []OutboxEntry
+	err := readSidecar(j.outboxName(), &el)
+	if err != nil {
+		return err
+	}
+	for _, e := range(el) {
+		err = j.v.putOutbox(e)
+		if err != nil {
+			return errReadingDB
+		}
+	}
+	return nil
+}
+
+// readEmployees loads the employees into the internal database.
+func (j *jsonStore) readEmployees () error {
+	var el []Employee
+	err := readSidecar(j.employeesName(), &el)
+	if err != nil {
+		return err
+	}
+	for _, e := range(el) {
+		j.v.putEmployee(e)
+	}
+	return nil
+}
+
+func (j *jsonStore) historyName () string {
+	return j.filename + ".history"
+}
+
+// readHistory loads the assignment history into the internal database. It
+// returns the offset right after the last complete event.
+func (j *jsonStore) readHistory () (int64, error) {
+	file, err := os.Open(j.historyName())
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening history %s: %s\n", j.historyName(), err.Error())
+		return 0, errOpeningDB
+	}
+	defer file.Close()
+
+	var offset int64
+	dec := json.NewDecoder(file)
+	for {
+		var e AssignmentEvent
+		err = dec.Decode(&e)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring incomplete history event at offset %d: %s\n", offset, err.Error())
+			break
+		}
+		err = j.v.AddEvent(e)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading history %s: %s\n", j.historyName(), err.Error())
+			return 0, errReadingDB
+		}
+		offset = dec.InputOffset()
+	}
+	return offset, nil
+}
+
+// writeEvents appends events to the history file.
+func (j *jsonStore) writeEvents (el []AssignmentEvent) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range(el) {
+		err := enc.Encode(e)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding history event: %s\n", err.Error())
+			return errWritingDB
+		}
+	}
+	_, err := j.history.Write(buf.Bytes())
+	if err == nil {
+		err = j.history.Sync()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing history %s: %s\n", j.historyName(), err.Error())
+		return errWritingDB
+	}
+	return nil
+}
+
+// flushEvents appends the events that are only in the journal to the
+// history.
+func (j *jsonStore) flushEvents () error {
+	if len(j.unflushed) == 0 {
+		return nil
+	}
+	err := j.writeEvents(j.unflushed)
+	if err != nil {
+		return err
+	}
+	j.unflushed = nil
+	return nil
+}
+
+// readSnapshot loads the JSON file into the internal database.
+func (j *jsonStore) readSnapshot () error {
+	file, err := os.Open(j.filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening file %s: %s\n", j.filename, err.Error())
+		return errOpeningDB
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(file)
+	_, err = dec.Token()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error decoding JSON: %s\n", err.Error())
+		return errReadingDB
+	}
+	for dec.More() {
+		var jc jsonComputer
+		err := dec.Decode(&jc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error decoding JSON: %s\n", err.Error())
+			return errReadingDB
+		}
+		err = j.v.Add(jc.computer())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error updating internal database: %s\n", err.Error())
+			return errReadingDB
+		}
+	}
+	_, err = dec.Token()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error decoding JSON: %s\n", err.Error())
+		return errReadingDB
+	}
+	return nil
+}
+
+// replayJournal applies the journal, if there is one, on top of the internal
+// database. It returns the number of entries replayed and the offset right
+// after the last complete one.
+func (j *jsonStore) replayJournal () (int, int64, error) {
+	file, err := os.Open(j.journalName())
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening journal %s: %s\n", j.journalName(), err.Error())
+		return 0, 0, errOpeningDB
+	}
+	defer file.Close()
+
+	var entries int
+	var offset int64
+	dec := json.NewDecoder(file)
+	for {
+		var e journalEntry
+		err = dec.Decode(&e)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// Only the last record can be incomplete, since the
+			// journal is only ever appended to.
+			fmt.Fprintf(os.Stderr, "Ignoring incomplete journal entry at offset %d: %s\n", offset, err.Error())
+			break
+		}
+
+		err = j.apply(e)
+		// A crash between writing a snapshot and truncating the
+		// journal leaves entries that are already in the snapshot.
+		if err == errAlreadyExists || err == errNotFound {
+			fmt.Fprintf(os.Stderr, "Journal entry %d already applied, skipping.\n", entries)
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Error replaying journal %s: %s\n", j.journalName(), err.Error())
+			return 0, 0, errReadingDB
+		}
+		entries++
+		offset = dec.InputOffset()
+	}
+
+	return entries, offset, nil
+}
+
+// apply performs a journal entry on the internal database.
+func (j *jsonStore) apply (e journalEntry) error {
+	switch e.Op {
+	case journalAdd:
+		if e.Computer == nil {
+			return errMalformed
+		}
+		return j.v.Add(e.Computer.computer())
+	case journalDelete:
+		return j.v.Delete(e.KeyType, e.Key)
+	case journalAssign:
+		return j.v.Assign(e.KeyType, e.Key, e.Assignee)
+	case journalArchive:
+		if e.Archived == nil {
+			return errMalformed
+		}
+		j.archiveDirty = true
+		err := j.v.Delete(KeyMAC, e.Archived.MAC)
+		if err == nil {
+			j.v.putArchived(*e.Archived)
+		}
+		return err
+	case journalAddArchived:
+		if e.Archived == nil {
+			return errMalformed
+		}
+		j.archiveDirty = true
+		j.v.putArchived(*e.Archived)
+		return nil
+	case journalRestore:
+		j.archiveDirty = true
+		err, _ := j.v.Restore(e.ID)
+		return err
+	case journalPurge:
+		j.archiveDirty = true
+		return j.v.Purge(e.ID)
+	case journalAddEmployee, journalUpdateEmployee:
+		if e.Employee == nil {
+			return errMalformed
+		}
+		j.employeesDirty = true
+		if e.Op == journalAddEmployee {
+			return j.v.AddEmployee(*e.Employee)
+		}
+		return j.v.UpdateEmployee(*e.Employee)
+	case journalDeleteEmployee:
+		j.employeesDirty = true
+		return j.v.DeleteEmployee(e.Key)
+	case journalOutbox:
+		if e.Outbox == nil {
+			return errMalformed
+		}
+		j.outboxDirty = true
+		return j.v.putOutbox(*e.Outbox)
+	case journalEvent:
+		if e.Event == nil {
+			return errMalformed
+		}
+		// A crash between flushing the events and truncating the
+		// journal leaves events that are in the history already.
+		if j.v.hasEvent(*e.Event) {
+			return nil
+		}
+		err := j.v.AddEvent(*e.Event)
+		if err == nil {
+			j.unflushed = append(j.unflushed, *e.Event)
+		}
+		return err
+	case journalTx:
+		for _, te := range(e.Entries) {
+			err := j.apply(te)
+			if err != nil && err != errAlreadyExists && err != errNotFound {
+				return err
+			}
+		}
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "Error applying journal entry: Unknown operation %s.\n", e.Op)
+	return errMalformed
+}
+
+func (j *jsonStore) Read (keytype, key string) (error, *Computer) {
+	return j.v.Read(keytype, key)
+}
+
+func (j *jsonStore) ReadAll (keytype, key string) (error, []Computer) {
+	return j.v.ReadAll(keytype, key)
+}
+
+// writeFileAtomic replaces filename with whatever write produces. The data is
+// written to a temporary file that is synced and then renamed over filename,
+// so a crash leaves either the old or the new contents behind, never a mix.
+func writeFileAtomic (filename string, write func(*os.File) error) error {
+	tmpname := filename + ".tmp"
+	tmp, err := os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpname, filename)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+
+	// Make the rename itself durable.
+	dir, err := os.Open(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (j *jsonStore) Write () error {
+	// Employees and the archive go first, so that a crash in between
+	// leaves an archived computer active as well, rather than losing it,
+	// and never leaves a computer assigned to an unknown employee.
+	if j.employeesDirty {
+		err, el := j.v.ReadEmployees()
+		if err != nil && err != errNotFound {
+			return err
+		}
+		if el == nil {
+			el = []Employee{}
+		}
+		err = writeSidecar(j.employeesName(), el)
+		if err != nil {
+			return err
+		}
+		j.employeesDirty = false
+	}
+	if j.outboxDirty {
+		err := j.writeOutbox()
+		if err != nil {
+			return err
+		}
+	}
+	if j.archiveDirty {
+		err, al := j.v.ReadArchived()
+		if err != nil && err != errNotFound {
+			return err
+		}
+		if al == nil {
+			al = []ArchivedComputer{}
+		}
+		err = writeSidecar(j.archiveName(), al)
+		if err != nil {
+			return err
+		}
+		j.archiveDirty = false
+	}
+
+	err, cl := j.v.ReadAll(KeyAll, "")
+	if err != nil && err != errNotFound {
+		fmt.Fprintf(os.Stderr, "Error reading internal database: %s\n", err.Error())
+		return err
+	}
+	err = writeFileAtomic(j.filename, func(file *os.File) error {
+		if len(cl) > 0 {
+			jcl := make([]*jsonComputer, len(cl))
+			for n, c := range(cl) {
+				jcl[n] = toJSONComputer(c)
+			}
+			return json.NewEncoder(file).Encode(jcl)
+		}
+		_, err := file.WriteString("[]")
+		return err
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing JSON file: %s\n", err.Error())
+		return errWritingDB
+	}
+	return nil
+}
+
+// writeOutbox rewrites the outbox file on its own.
+func (j *jsonStore) writeOutbox () error {
+	err, el := j.v.ReadOutbox("")
+	if err != nil && err != errNotFound {
+		return err
+	}
+	if el == nil {
+		el = []OutboxEntry{}
+	}
+	err = writeSidecar(j.outboxName(), el)
+	if err != nil {
+		return err
+	}
+	j.outboxDirty = false
+	return nil
+}
+
+// rewrite persists entries without a journal. Changes to the outbox alone,
+// which every delivery attempt makes, only rewrite the outbox file.
+func (j *jsonStore) rewrite (entries []journalEntry) error {
+	for _, e := range(entries) {
+		if e.Op != journalOutbox {
+			return j.Write()
+		}
+	}
+	return j.writeOutbox()
+}
+
+// commit persists a mutation that was already applied to the internal
+// database, either by appending it to the journal or by rewriting the file.
+// Within a transaction, mutations are only collected until it ends.
+func (j *jsonStore) commit (e journalEntry) error {
+	if j.inTx {
+		j.pending = append(j.pending, e)
+		return nil
+	}
+	if j.journal == nil {
+		return j.rewrite([]journalEntry{ e })
+	}
+
+	err := j.appendJournal(e)
+	if err != nil {
+		return err
+	}
+	j.entries++
+	if j.entries >= jsonCompactEvery {
+		return j.compact()
+	}
+	return nil
+}
+
+// appendJournal writes e to the journal as a single record. What a failed
+// write leaves behind is cut off, so that later records can be replayed.
+func (j *jsonStore) appendJournal (e journalEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding journal entry: %s\n", err.Error())
+		return errWritingDB
+	}
+	info, err := j.journal.Stat()
+	if err == nil {
+		_, err = j.journal.Write(append(line, '\n'))
+		if err == nil {
+			err = j.journal.Sync()
+		}
+		if err != nil {
+			j.journal.Truncate(info.Size())
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing journal %s: %s\n", j.journalName(), err.Error())
+		return errWritingDB
+	}
+	return nil
+}
+
+// compact folds the journal into a fresh snapshot and the history.
+func (j *jsonStore) compact () error {
+	err := j.flushEvents()
+	if err != nil {
+		return err
+	}
+	err = j.Write()
+	if err != nil {
+		return err
+	}
+	err = j.journal.Truncate(0)
+	if err == nil {
+		err = j.journal.Sync()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error truncating journal %s: %s\n", j.journalName(), err.Error())
+		return errWritingDB
+	}
+	j.entries = 0
+	return nil
+}
+
+func (j *jsonStore) Add (c Computer) error {
+	err := j.v.Add(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error adding item to internal database: %s\n", err.Error())
+		return err
+	}
+	err, added := j.v.Read(KeyMAC, c.MAC)
+	if err != nil {
+		return err
+	}
+	return j.commit(journalEntry{ Op: journalAdd, Computer: toJSONComputer(*added) })
+}
+
+func (j *jsonStore) Delete (keytype, key string) error {
+	err := j.v.Delete(keytype, key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error deleting item from internal database: %s\n", err.Error())
+		return err
+	}
+	return j.commit(journalEntry{ Op: journalDelete, KeyType: keytype, Key: key })
+}
+
+func (j *jsonStore) Assign (keytype, key, assignee string) error {
+	err := j.v.Assign(keytype, key, assignee)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error updating item assignment in internal database: %s\n", err.Error())
+		return err
+	}
+	return j.commit(journalEntry{ Op: journalAssign, KeyType: keytype, Key: key, Assignee: assignee })
+}
+
+func (j *jsonStore) Unassign (keytype, key string) error {
+	err := j.v.Assign(keytype, key, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error removing item assignment in internal database: %s\n", err.Error())
+		return err
+	}
+	return j.commit(journalEntry{ Op: journalAssign, KeyType: keytype, Key: key })
+}
+
+// WithTx runs fn against the internal database's transaction. Nothing is
+// written unless fn succeeds, and then the whole transaction is persisted
+// at once, before the transaction ends, so that failing to persist it rolls
+// it back.
+func (j *jsonStore) WithTx (fn func(dataInterface) error) error {
+	if j.inTx {
+		fmt.Fprintf(os.Stderr, "Error starting transaction: Transaction already in progress.\n")
+		return errNestedTx
+	}
+	j.inTx = true
+	defer func() {
+		j.inTx = false
+		j.pending = nil
+		j.pendingEvents = nil
+	}()
+
+	err := j.v.WithTx(func(dataInterface) error {
+		err := fn(j)
+		if err != nil {
+			return err
+		}
+		return j.persistTx()
+	})
+	if err != nil {
+		return err
+	}
+
+	// The transaction is in the journal already, so a failed compaction is
+	// just tried again on the next commit.
+	if j.journal != nil && j.entries >= jsonCompactEvery {
+		j.compact()
+	}
+	return nil
+}
+
+// persistTx writes the changes and events of the current transaction. With
+// a journal, they make up a single entry. Without one, the events are
+// appended to the history before the file is rewritten, and cut off again
+// if that fails.
+func (j *jsonStore) persistTx () error {
+	pending, events := j.pending, j.pendingEvents
+	if len(pending) == 0 && len(events) == 0 {
+		return nil
+	}
+
+	if j.journal != nil {
+		for n := range(events) {
+			pending = append(pending, journalEntry{ Op: journalEvent, Event: &events[n] })
+		}
+		err := j.appendJournal(journalEntry{ Op: journalTx, Entries: pending })
+		if err != nil {
+			return err
+		}
+		j.unflushed = append(j.unflushed, events...)
+		j.entries++
+		return nil
+	}
+
+	info, err := j.history.Stat()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading history %s: %s\n", j.historyName(), err.Error())
+		return errWritingDB
+	}
+	if len(events) > 0 {
+		err = j.writeEvents(events)
+		if err != nil {
+			j.history.Truncate(info.Size())
+			return err
+		}
+	}
+	if len(pending) > 0 {
+		err = j.rewrite(pending)
+		if err != nil {
+			j.history.Truncate(info.Size())
+			// Some of the files may have been written already, so
+			// have them all rewritten next time.
+			j.archiveDirty, j.employeesDirty, j.outboxDirty = true, true, true
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *jsonStore) AddEvent (e AssignmentEvent) error {
+	err := j.v.AddEvent(e)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error adding event to internal database: %s\n", err.Error())
+		return err
+	}
+	if j.inTx {
+		j.pendingEvents = append(j.pendingEvents, e)
+		return nil
+	}
+	if j.journal != nil {
+		j.unflushed = append(j.unflushed, e)
+		return j.commit(journalEntry{ Op: journalEvent, Event: &e })
+	}
+	return j.writeEvents([]AssignmentEvent{ e })
+}
+
+func (j *jsonStore) ReadEvents (keytype, key string) (error, []AssignmentEvent) {
+	return j.v.ReadEvents(keytype, key)
+}
+
+func (j *jsonStore) Archive (keytype, key, reason string) error {
+	a, err := j.v.archiveComputer(keytype, key, reason, time.Now().UTC())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error archiving item in internal database: %s\n", err.Error())
+		return err
+	}
+	j.archiveDirty = true
+	return j.commit(journalEntry{ Op: journalArchive, Archived: &a })
+}
+
+func (j *jsonStore) AddArchived (a ArchivedComputer) (error, int) {
+	err, id := j.v.AddArchived(a)
+	if err != nil {
+		return err, 0
+	}
+	a.ID = id
+	j.archiveDirty = true
+	return j.commit(journalEntry{ Op: journalAddArchived, Archived: &a }), id
+}
+
+func (j *jsonStore) ReadArchived () (error, []ArchivedComputer) {
+	return j.v.ReadArchived()
+}
+
+func (j *jsonStore) Restore (id int) (error, *Computer) {
+	err, c := j.v.Restore(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error restoring item in internal database: %s\n", err.Error())
+		return err, nil
+	}
+	j.archiveDirty = true
+	return j.commit(journalEntry{ Op: journalRestore, ID: id }), c
+}
+
+func (j *jsonStore) Purge (id int) error {
+	err := j.v.Purge(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error purging item from internal database: %s\n", err.Error())
+		return err
+	}
+	j.archiveDirty = true
+	return j.commit(journalEntry{ Op: journalPurge, ID: id })
+}
+
+func (j *jsonStore) ReadEmployee (code string) (error, *Employee) {
+	return j.v.ReadEmployee(code)
+}
+
+func (j *jsonStore) ReadEmployees () (error, []Employee) {
+	return j.v.ReadEmployees()
+}
+
+func (j *jsonStore) AddEmployee (e Employee) error {
+	err := j.v.AddEmployee(e)
+	if err != nil {
+		return err
+	}
+	j.employeesDirty = true
+	return j.commit(journalEntry{ Op: journalAddEmployee, Employee: &e })
+}
+
+func (j *jsonStore) UpdateEmployee (e Employee) error {
+	err := j.v.UpdateEmployee(e)
+	if err != nil {
+		return err
+	}
+	j.employeesDirty = true
+	return j.commit(journalEntry{ Op: journalUpdateEmployee, Employee: &e })
+}
+
+func (j *jsonStore) DeleteEmployee (code string) error {
+	err := j.v.DeleteEmployee(code)
+	if err != nil {
+		return err
+	}
+	j.employeesDirty = true
+	return j.commit(journalEntry{ Op: journalDeleteEmployee, Key: code })
+}
+
+func (j *jsonStore) AddOutbox (e OutboxEntry) (error, int) {
+	err, id := j.v.AddOutbox(e)
+	if err != nil {
+		return err, 0
+	}
+	e.ID = id
+	j.outboxDirty = true
+	return j.commit(journalEntry{ Op: journalOutbox, Outbox: &e }), id
+}
+
+func (j *jsonStore) ReadOutbox (status string) (error, []OutboxEntry) {
+	return j.v.ReadOutbox(status)
+}
+
+func (j *jsonStore) UpdateOutbox (e OutboxEntry) error {
+	err := j.v.UpdateOutbox(e)
+	if err != nil {
+		return err
+	}
+	j.outboxDirty = true
+	return j.commit(journalEntry{ Op: journalOutbox, Outbox: &e })
+}
+
+func (j *jsonStore) Close() error {
+	if j.journal != nil {
+		// Leave a compacted snapshot behind on a clean shutdown.
+		err := j.compact()
+		if err != nil {
+			return err
+		}
+	}
+	err := j.history.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error closing history: %s\n", err.Error())
+		return errClosingDB
+	}
+	if j.journal == nil {
+		return nil
+	}
+	err = j.journal.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error closing internal database: %s\n", err.Error())
+		return errClosingDB
+	}
+	return nil
+}
+
+/***********/
+/* SQLite */
+/***********/
+
+type sqlStore struct {
+	data	*sql.DB
+	tx	*sql.Tx
+}
+
+func initSQL (sqlp *dataInterface, filename string) error {
+	var err error
+
+	db := &sqlStore{}
+
+	db.data, err = sql.Open("sqlite3", filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening SQL database: %s\n", err.Error())
+		return errOpeningDB
+	}
+	db.data.SetMaxOpenConns(1)
+
+	err = migrateSQL(db.data)
+	if err != nil {
+		return err
+	}
+
+	*sqlp = (dataInterface)(db)
+
+	return nil
+}
+
+// sqlMigration is one step in the evolution of the SQLite schema. Migrations
+// are applied in order, and each one is recorded in the schema_version table
+// once it has run, so that it is never applied twice.
+type sqlMigration struct {
+	version		int
+	description	string
+	statements	[]string
+}
+
+// sqlMigrations must only ever be appended to. Databases created before
+// schema_version existed hold the table of migration 1 already, which is why
+// it is created conditionally.
+var sqlMigrations = []sqlMigration{
+	{ 1, "Create computers table", []string{
+		`CREATE TABLE IF NOT EXISTS computers (
+			MAC VARCHAR(17) NOT NULL,
+			Name VARCHAR(50) NOT NULL,
+			IP VARCHAR(15) NOT NULL,
+			Assignee VARCHAR(3),
+			Description TEXT,
+			PRIMARY KEY (MAC, Name, IP)
+		);`,
+	}},
+	{ 2, "Make MAC, Name and IP unique on their own", []string{
+		`CREATE TABLE computers_new (
+			MAC VARCHAR(17) NOT NULL UNIQUE,
+			Name VARCHAR(50) NOT NULL UNIQUE,
+			IP VARCHAR(15) NOT NULL UNIQUE,
+			Assignee VARCHAR(3),
+			Description TEXT,
+			PRIMARY KEY (MAC)
+		);`,
+		`INSERT INTO computers_new SELECT MAC, Name, IP, Assignee, Description FROM computers;`,
+		`DROP TABLE computers;`,
+		`ALTER TABLE computers_new RENAME TO computers;`,
+	}},
+	// SQLite doesn't enforce the length of VARCHAR columns, so this only
+	// documents in the schema that IPv6 addresses are stored.
+	{ 3, "Widen IP to fit IPv6 addresses", []string{
+		`CREATE TABLE computers_new (
+			MAC VARCHAR(17) NOT NULL UNIQUE,
+			Name VARCHAR(50) NOT NULL UNIQUE,
+			IP VARCHAR(45) NOT NULL UNIQUE,
+			Assignee VARCHAR(3),
+			Description TEXT,
+			PRIMARY KEY (MAC)
+		);`,
+		`INSERT INTO computers_new SELECT MAC, Name, IP, Assignee, Description FROM computers;`,
+		`DROP TABLE computers;`,
+		`ALTER TABLE computers_new RENAME TO computers;`,
+	}},
+	{ 4, "Add revision numbers", []string{
+		`ALTER TABLE computers ADD COLUMN Revision INTEGER NOT NULL DEFAULT 1;`,
+	}},
+	{ 5, "Add assignment history", []string{
+		`CREATE TABLE assignment_events (
+			ID INTEGER PRIMARY KEY AUTOINCREMENT,
+			MAC VARCHAR(17) NOT NULL,
+			Name VARCHAR(50) NOT NULL,
+			IP VARCHAR(45) NOT NULL,
+			OldAssignee VARCHAR(3),
+			NewAssignee VARCHAR(3),
+			Time TEXT NOT NULL,
+			Actor TEXT
+		);`,
+		`CREATE INDEX assignment_events_mac ON assignment_events (MAC);`,
+		`CREATE INDEX assignment_events_name ON assignment_events (Name);`,
+		`CREATE INDEX assignment_events_ip ON assignment_events (IP);`,
+		`CREATE INDEX assignment_events_old ON assignment_events (OldAssignee);`,
+		`CREATE INDEX assignment_events_new ON assignment_events (NewAssignee);`,
+	}},
+	{ 6, "Add archive of deleted computers", []string{
+		`CREATE TABLE archived_computers (
+			ID INTEGER PRIMARY KEY AUTOINCREMENT,
+			MAC VARCHAR(17) NOT NULL,
+			Name VARCHAR(50) NOT NULL,
+			IP VARCHAR(45) NOT NULL,
+			Assignee VARCHAR(3),
+			Description TEXT,
+			Revision INTEGER NOT NULL,
+			Reason TEXT,
+			Archived TEXT NOT NULL
+		);`,
+	}},
+	{ 7, "Add employees", []string{
+		`CREATE TABLE employees (
+			Code VARCHAR(16) NOT NULL PRIMARY KEY,
+			FullName TEXT NOT NULL,
+			Email TEXT,
+			Department TEXT,
+			Active INTEGER NOT NULL DEFAULT 1
+		);`,
+	}},
+	{ 8, "Add notification outbox", []string{
+		`CREATE TABLE notification_outbox (
+			ID INTEGER PRIMARY KEY AUTOINCREMENT,
+			Payload TEXT NOT NULL,
+			Status VARCHAR(16) NOT NULL,
+			Attempts INTEGER NOT NULL DEFAULT 0,
+			NextAttempt TEXT NOT NULL,
+			LastError TEXT,
+			Created TEXT NOT NULL
+		);`,
+		`CREATE INDEX notification_outbox_status ON notification_outbox (Status);`,
+	}},
+	{ 9, "Record quota overrides in the assignment history", []string{
+		`ALTER TABLE assignment_events ADD COLUMN Override TEXT;`,
+	}},
+	{ 10, "Deliver notifications to several notifiers", []string{
+		`ALTER TABLE notification_outbox ADD COLUMN Sink VARCHAR(64);`,
+	}},
+	{ 11, "Track the delivery of notifications", []string{
+		`ALTER TABLE notification_outbox ADD COLUMN ResponseCode INTEGER;`,
+	}},
+	// Assignees are as long as the employee codes of --employee-code-format,
+	// up to the VARCHAR(16) of employees.Code.
+	{ 12, "Widen assignees to the length of employee codes", []string{
+		`CREATE TABLE computers_new (
+			MAC VARCHAR(17) NOT NULL UNIQUE,
+			Name VARCHAR(50) NOT NULL UNIQUE,
+			IP VARCHAR(45) NOT NULL UNIQUE,
+			Assignee VARCHAR(16),
+			Description TEXT,
+			Revision INTEGER NOT NULL DEFAULT 1,
+			PRIMARY KEY (MAC)
+		);`,
+		`INSERT INTO computers_new SELECT MAC, Name, IP, Assignee, Description, Revision FROM computers;`,
+		`DROP TABLE computers;`,
+		`ALTER TABLE computers_new RENAME TO computers;`,
+		`CREATE TABLE assignment_events_tmp (
+			ID INTEGER PRIMARY KEY AUTOINCREMENT,
+			MAC VARCHAR(17) NOT NULL,
+			Name VARCHAR(50) NOT NULL,
+			IP VARCHAR(45) NOT NULL,
+			OldAssignee VARCHAR(16),
+			NewAssignee VARCHAR(16),
+			Time TEXT NOT NULL,
+			Actor TEXT,
+			Override TEXT
+		);`,
+		`INSERT INTO assignment_events_tmp SELECT ID, MAC, Name, IP, OldAssignee, NewAssignee, Time, Actor, Override FROM assignment_events;`,
+		`DROP TABLE assignment_events;`,
+		`ALTER TABLE assignment_events_tmp RENAME TO assignment_events;`,
+		`CREATE INDEX assignment_events_mac ON assignment_events (MAC);`,
+		`CREATE INDEX assignment_events_name ON assignment_events (Name);`,
+		`CREATE INDEX assignment_events_ip ON assignment_events (IP);`,
+		`CREATE INDEX assignment_events_old ON assignment_events (OldAssignee);`,
+		`CREATE INDEX assignment_events_new ON assignment_events (NewAssignee);`,
+		`CREATE TABLE archived_computers_new (
+			ID INTEGER PRIMARY KEY AUTOINCREMENT,
+			MAC VARCHAR(17) NOT NULL,
+			Name VARCHAR(50) NOT NULL,
+			IP VARCHAR(45) NOT NULL,
+			Assignee VARCHAR(16),
+			Description TEXT,
+			Revision INTEGER NOT NULL,
+			Reason TEXT,
+			Archived TEXT NOT NULL
+		);`,
+		`INSERT INTO archived_computers_new SELECT ID, MAC, Name, IP, Assignee, Description, Revision, Reason, Archived FROM archived_computers;`,
+		`DROP TABLE archived_computers;`,
+		`ALTER TABLE archived_computers_new RENAME TO archived_computers;`,
+	}},
+}
+
+// migrateSQL brings the schema of data up to the latest version. All pending
+// migrations run in a single transaction, so a failing one leaves the
+// database exactly as it was.
+func migrateSQL (data *sql.DB) error {
+	tx, err := data.Begin()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error migrating SQL database: %s\n", err.Error())
+		return errMigratingDB
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		description TEXT,
+		applied TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating schema_version table: %s\n", err.Error())
+		return errMigratingDB
+	}
+
+	var current int
+	err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&current)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading schema version: %s\n", err.Error())
+		return errMigratingDB
+	}
+	latest := sqlMigrations[len(sqlMigrations)-1].version
+	if current > latest {
+		fmt.Fprintf(os.Stderr, "Error migrating SQL database: Schema version %d is newer than the latest known version %d.\n", current, latest)
+		return errSchemaTooNew
+	}
+
+	for _, m := range(sqlMigrations) {
+		if m.version <= current {
+			continue
+		}
+		for _, stmt := range(m.statements) {
+			_, err = tx.Exec(stmt)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error applying migration %d (%s): %s\n", m.version, m.description, err.Error())
+				return errMigratingDB
+			}
+		}
+		_, err = tx.Exec("INSERT INTO schema_version(version, description) VALUES (?, ?)", m.version, m.description)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error recording migration %d: %s\n", m.version, err.Error())
+			return errMigratingDB
+		}
+		fmt.Fprintf(os.Stderr, "Applied SQL migration %d: %s.\n", m.version, m.description)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error committing migrations: %s\n", err.Error())
+		return errMigratingDB
+	}
+	return nil
+}
+
+// begin returns the transaction a statement should run in. Inside WithTx,
+// that is the transaction of WithTx, otherwise every statement gets its own.
+func (db *sqlStore) begin() (*sql.Tx, error) {
+	if db.tx != nil {
+		return db.tx, nil
+	}
+	return db.data.Begin()
+}
+
+// resolve ends a transaction obtained from begin, unless it belongs to WithTx.
+func (db *sqlStore) resolve(tx *sql.Tx) {
+	if p := recover(); p != nil {
+		fmt.Fprintf(os.Stderr, "Error encountered while updating SQL database. Rolling it back.\n")
+		if tx != nil {
+			tx.Rollback()
+		}
+		if tx == db.tx {
+			panic(p)
+		}
+		return
+	}
+	if tx != nil && tx != db.tx {
+		tx.Commit()
+	}
+}
+
+// sqlColumns lists the columns of computers in the order scanComputer expects.
+const sqlColumns = "MAC, Name, IP, Assignee, Description, Revision"
+
+func scanComputer(rows *sql.Rows) (Computer, error) {
+	var c Computer
+	var assignee, description sql.NullString
+	err := rows.Scan(&c.MAC, &c.Name, &c.IP, &assignee, &description, &c.Revision)
+	if assignee.Valid {
+		c.Assignee = assignee.String
+	} else {
+		c.Assignee = ""
+	}
+	if description.Valid {
+		c.Description = description.String
+	} else {
+		c.Description = ""
 	}
-	tx.Commit()
+	return c, err
+}
+
+// query runs a SELECT statement, inside the transaction of WithTx if any.
+func (db *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	if db.tx != nil {
+		return db.tx.Query(query, args...)
+	}
+	return db.data.Query(query, args...)
 }
 
 func (db *sqlStore) Read (keytype, key string) (error, *Computer) {
@@ -444,8 +1999,8 @@ func (db *sqlStore) Read (keytype, key string) (error, *Computer) {
 		fmt.Fprintf(os.Stderr, "Error fetching item: Unknown key type %s.\n", keytype)
 		return errUnknownKeyType, nil
 	}
-	selectSQL := fmt.Sprintf("SELECT * FROM computers WHERE %s='%s'", keytype, key)
-	rows, err := db.data.Query(selectSQL)
+	selectSQL := fmt.Sprintf("SELECT %s FROM computers WHERE %s = ?", sqlColumns, keytype)
+	rows, err := db.query(selectSQL, key)
 	defer rows.Close()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error fetching item: %s\n", err.Error())
@@ -453,9 +2008,8 @@ func (db *sqlStore) Read (keytype, key string) (error, *Computer) {
 	}
 
 	var c Computer
-	var assignee, description sql.NullString
 	if rows.Next() {
-		err = rows.Scan(&c.MAC, &c.Name, &c.IP, &assignee, &description)
+		c, err = scanComputer(rows)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error fetching item: %s\n", err.Error())
 			return errReadingDB, nil
@@ -464,16 +2018,6 @@ func (db *sqlStore) Read (keytype, key string) (error, *Computer) {
 		fmt.Fprintf(os.Stderr, "Error fetching item with %s=%s: Item not found.\n", keytype, key)
 		return errNotFound, nil
 	}
-	if assignee.Valid {
-		c.Assignee = assignee.String
-	} else {
-		c.Assignee = ""
-	}
-	if description.Valid {
-		c.Description = description.String
-	} else {
-		c.Description = ""
-	}
 	if rows.Next() {
 		fmt.Fprintf(os.Stderr, "Error fetching item with %s=%s: Mutlitple items found.\n", keytype, key)
 		return errNotUnique, nil
@@ -483,13 +2027,15 @@ func (db *sqlStore) Read (keytype, key string) (error, *Computer) {
 
 func (db *sqlStore) ReadAll (keytype, key string) (error, []Computer) {
 	var selectSQL string
+	var args []interface{}
 
 	if keytype == KeyAssignee {
-		selectSQL = fmt.Sprintf("SELECT * FROM computers WHERE Assignee = '%s'", key)
+		selectSQL = fmt.Sprintf("SELECT %s FROM computers WHERE Assignee = ?", sqlColumns)
+		args = append(args, key)
 	} else if keytype == KeyNotAssigned {
-		selectSQL = fmt.Sprintf("SELECT * FROM computers WHERE Assignee = '' OR Assignee IS NULL")
+		selectSQL = fmt.Sprintf("SELECT %s FROM computers WHERE Assignee = '' OR Assignee IS NULL", sqlColumns)
 	} else if keytype == KeyAll {
-		selectSQL = fmt.Sprintf("SELECT * FROM computers")
+		selectSQL = fmt.Sprintf("SELECT %s FROM computers", sqlColumns)
 	} else if keytype == KeyMAC || keytype == KeyName || keytype == KeyIP {
 		fmt.Fprintf(os.Stderr, "Error fetching items: Invalid key type %s.\n", keytype)
 		return errInvalidKeyType, nil
@@ -498,7 +2044,7 @@ func (db *sqlStore) ReadAll (keytype, key string) (error, []Computer) {
 		return errUnknownKeyType, nil
 	}
 
-	rows, err := db.data.Query(selectSQL)
+	rows, err := db.query(selectSQL, args...)
 	defer rows.Close()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error reading database: %s.\n", err.Error())
@@ -507,20 +2053,8 @@ func (db *sqlStore) ReadAll (keytype, key string) (error, []Computer) {
 
 	var cl []Computer
 	for rows.Next() {
-		var c Computer
-		var assignee, description sql.NullString
-		err = rows.Scan(&c.MAC, &c.Name, &c.IP, &assignee, &description)
+		c, err := scanComputer(rows)
 		if err == nil {
-			if assignee.Valid {
-				c.Assignee = assignee.String
-			} else {
-				c.Assignee = ""
-			}
-			if description.Valid {
-				c.Description = description.String
-			} else {
-				c.Description = ""
-			}
 			cl = append(cl, c)
 		}
 	}
@@ -539,23 +2073,22 @@ func (db *sqlStore) Add (c Computer) error {
 		fmt.Fprintf(os.Stderr, "Error adding item: MAC, Name and IP are mandatory fields.\n")
 		return errMalformed
 	}
-	if c.Assignee != "" && len(c.Assignee) != 3 {
-		fmt.Fprintf(os.Stderr, "Error adding item: Assignee code must be exactly 3 characters long.\n")
-		return errMalformed
-	}
-	tx, err := db.data.Begin()
-	defer resolveTransaction(tx)
+	tx, err := db.begin()
+	defer db.resolve(tx)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error writing to database: %s\n", err.Error())
 		return errWritingDB
 	}
-	stmt, err := tx.Prepare("INSERT INTO computers(MAC, Name, IP, Assignee, Description) VALUES (?, ?, ?, ?, ?)")
+	stmt, err := tx.Prepare("INSERT INTO computers(MAC, Name, IP, Assignee, Description, Revision) VALUES (?, ?, ?, ?, ?, ?)")
 	defer stmt.Close()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error writing to database: %s\n", err.Error())
 		return errWritingDB
 	}
-	_, err = stmt.Exec(c.MAC, c.Name, c.IP, c.Assignee, c.Description)
+	if c.Revision < 1 {
+		c.Revision = 1
+	}
+	_, err = stmt.Exec(c.MAC, c.Name, c.IP, c.Assignee, c.Description, c.Revision)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error writing to database: %s\n", err.Error())
 		return errWritingDB
@@ -575,8 +2108,8 @@ func (db *sqlStore) Delete (keytype, key string) error {
 	}
 
 	deleteSQL := fmt.Sprintf("DELETE FROM computers WHERE %s = ?", keytype)
-	tx, err := db.data.Begin()
-	defer resolveTransaction(tx)
+	tx, err := db.begin()
+	defer db.resolve(tx)
         if err != nil {
 		fmt.Fprintf(os.Stderr, "Error writing to database: %s\n", err.Error())
                 return errWritingDB
@@ -608,17 +2141,13 @@ func (db *sqlStore) Assign (keytype, key, assignee string) error {
 		fmt.Fprintf(os.Stderr, "Error assigning item: Unknown key type %s.\n", keytype)
 		return errUnknownKeyType
 	}
-	if len(assignee) != 3 {
-		fmt.Fprintf(os.Stderr, "Error assigning item: Assignee code must be exactly 3 characters long.\n")
-		return errMalformed
-	}
-	tx, err := db.data.Begin()
-	defer resolveTransaction(tx)
+	tx, err := db.begin()
+	defer db.resolve(tx)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error writing to database: %s\n", err.Error())
 		return errWritingDB
 	}
-	updateSQL := fmt.Sprintf("UPDATE computers SET Assignee = ? WHERE %s = ?", keytype)
+	updateSQL := fmt.Sprintf("UPDATE computers SET Assignee = ?, Revision = Revision + 1 WHERE %s = ?", keytype)
 	stmt, err := tx.Prepare(updateSQL)
 	defer stmt.Close()
 	if err != nil {
@@ -643,13 +2172,13 @@ func (db *sqlStore) Unassign (keytype, key string) error {
 		fmt.Fprintf(os.Stderr, "Error removing assignment: Unknown key type %s.\n", keytype)
 		return errUnknownKeyType
 	}
-	tx, err := db.data.Begin()
-	defer resolveTransaction(tx)
+	tx, err := db.begin()
+	defer db.resolve(tx)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error writing to database: %s\n", err.Error())
 		return errWritingDB
 	}
-	updateSQL := fmt.Sprintf("UPDATE computers SET Assignee = '' WHERE %s = ?", keytype)
+	updateSQL := fmt.Sprintf("UPDATE computers SET Assignee = '', Revision = Revision + 1 WHERE %s = ?", keytype)
 	stmt, err := tx.Prepare(updateSQL)
 	defer stmt.Close()
 	if err != nil {
@@ -664,6 +2193,464 @@ func (db *sqlStore) Unassign (keytype, key string) error {
 	return nil
 }
 
+func (db *sqlStore) AddEvent (e AssignmentEvent) error {
+	if e.MAC == "" || e.Name == "" || e.IP == "" {
+		fmt.Fprintf(os.Stderr, "Error adding event: MAC, Name and IP are mandatory fields.\n")
+		return errMalformed
+	}
+	tx, err := db.begin()
+	defer db.resolve(tx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing to database: %s\n", err.Error())
+		return errWritingDB
+	}
+	_, err = tx.Exec("INSERT INTO assignment_events(MAC, Name, IP, OldAssignee, NewAssignee, Time, Actor, Override) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		e.MAC, e.Name, e.IP, e.OldAssignee, e.NewAssignee, e.Time.UTC().Format(time.RFC3339Nano), e.Actor, e.Override)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing to database: %s\n", err.Error())
+		return errWritingDB
+	}
+	return nil
+}
+
+func (db *sqlStore) ReadEvents (keytype, key string) (error, []AssignmentEvent) {
+	var where string
+	args := []interface{}{ key }
+	if keytype == KeyMAC || keytype == KeyName || keytype == KeyIP {
+		where = " WHERE " + keytype + " = ?"
+	} else if keytype == KeyAssignee {
+		where = " WHERE OldAssignee = ? OR NewAssignee = ?"
+		args = append(args, key)
+	} else if keytype == KeyAll {
+		args = nil
+	} else if keytype == KeyNotAssigned {
+		fmt.Fprintf(os.Stderr, "Error fetching events: Invalid key type %s.\n", keytype)
+		return errInvalidKeyType, nil
+	} else {
+		fmt.Fprintf(os.Stderr, "Error fetching events: Unknown key type %s.\n", keytype)
+		return errUnknownKeyType, nil
+	}
+
+	rows, err := db.query("SELECT MAC, Name, IP, OldAssignee, NewAssignee, Time, Actor, Override FROM assignment_events" + where + " ORDER BY ID", args...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading database: %s.\n", err.Error())
+		return errReadingDB, nil
+	}
+	defer rows.Close()
+
+	var el []AssignmentEvent
+	for rows.Next() {
+		var e AssignmentEvent
+		var oldAssignee, newAssignee, actor, override sql.NullString
+		var when string
+		err = rows.Scan(&e.MAC, &e.Name, &e.IP, &oldAssignee, &newAssignee, &when, &actor, &override)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading database: %s.\n", err.Error())
+			return errReadingDB, nil
+		}
+		e.OldAssignee = oldAssignee.String
+		e.NewAssignee = newAssignee.String
+		e.Actor = actor.String
+		e.Override = override.String
+		e.Time, err = time.Parse(time.RFC3339Nano, when)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading event time %s: %s.\n", when, err.Error())
+			return errReadingDB, nil
+		}
+		el = append(el, e)
+	}
+
+	if len(el) == 0 {
+		fmt.Fprintf(os.Stderr, "Error fetching events with %s=%s: No events found.\n", keytype, key)
+		return errNotFound, nil
+	}
+	return nil, el
+}
+
+// atomically runs fn in the transaction of WithTx if any, or else in a
+// transaction of its own that is committed only if fn succeeds.
+func (db *sqlStore) atomically (fn func(*sql.Tx) error) error {
+	if db.tx != nil {
+		return fn(db.tx)
+	}
+	tx, err := db.data.Begin()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing to database: %s\n", err.Error())
+		return errWritingDB
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error committing transaction: %s\n", err.Error())
+		return errWritingDB
+	}
+	return nil
+}
+
+const sqlArchivedColumns = "ID, MAC, Name, IP, Assignee, Description, Revision, Reason, Archived"
+
+func scanArchived(rows *sql.Rows) (ArchivedComputer, error) {
+	var a ArchivedComputer
+	var assignee, description, reason sql.NullString
+	var when string
+	err := rows.Scan(&a.ID, &a.MAC, &a.Name, &a.IP, &assignee, &description, &a.Revision, &reason, &when)
+	if err != nil {
+		return a, err
+	}
+	a.Assignee = assignee.String
+	a.Description = description.String
+	a.Reason = reason.String
+	a.Archived, err = time.Parse(time.RFC3339Nano, when)
+	return a, err
+}
+
+func (db *sqlStore) Archive (keytype, key, reason string) error {
+	err, c := db.Read(keytype, key)
+	if err != nil {
+		return err
+	}
+	a := newArchivedComputer(*c, reason, time.Now().UTC())
+
+	return db.atomically(func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT INTO archived_computers(MAC, Name, IP, Assignee, Description, Revision, Reason, Archived) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			a.MAC, a.Name, a.IP, a.Assignee, a.Description, a.Revision, a.Reason, a.Archived.Format(time.RFC3339Nano))
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM computers WHERE MAC = ?", a.MAC)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing to database: %s\n", err.Error())
+			return errWritingDB
+		}
+		return nil
+	})
+}
+
+func (db *sqlStore) AddArchived (a ArchivedComputer) (error, int) {
+	var id int64
+	err := db.atomically(func(tx *sql.Tx) error {
+		res, err := tx.Exec("INSERT INTO archived_computers(MAC, Name, IP, Assignee, Description, Revision, Reason, Archived) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			a.MAC, a.Name, a.IP, a.Assignee, a.Description, a.Revision, a.Reason, a.Archived.Format(time.RFC3339Nano))
+		if err == nil {
+			id, err = res.LastInsertId()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing to database: %s\n", err.Error())
+			return errWritingDB
+		}
+		return nil
+	})
+	if err != nil {
+		return err, 0
+	}
+	return nil, int(id)
+}
+
+func (db *sqlStore) readArchived (where string, args ...interface{}) (error, []ArchivedComputer) {
+	rows, err := db.query("SELECT " + sqlArchivedColumns + " FROM archived_computers" + where + " ORDER BY ID", args...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading database: %s.\n", err.Error())
+		return errReadingDB, nil
+	}
+	defer rows.Close()
+
+	var al []ArchivedComputer
+	for rows.Next() {
+		a, err := scanArchived(rows)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading database: %s.\n", err.Error())
+			return errReadingDB, nil
+		}
+		al = append(al, a)
+	}
+	if len(al) == 0 {
+		fmt.Fprintf(os.Stderr, "Error fetching archived items: No items found.\n")
+		return errNotFound, nil
+	}
+	return nil, al
+}
+
+func (db *sqlStore) ReadArchived () (error, []ArchivedComputer) {
+	return db.readArchived("")
+}
+
+func (db *sqlStore) Restore (id int) (error, *Computer) {
+	err, al := db.readArchived(" WHERE ID = ?", id)
+	if err != nil {
+		return err, nil
+	}
+	c := al[0].restored()
+
+	rows, err := db.query("SELECT MAC FROM computers WHERE MAC = ? OR Name = ? OR IP = ?", c.MAC, c.Name, c.IP)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading database: %s.\n", err.Error())
+		return errReadingDB, nil
+	}
+	taken := rows.Next()
+	rows.Close()
+	if taken {
+		fmt.Fprintf(os.Stderr, "Error restoring archived item %d: Item already exists.\n", id)
+		return errAlreadyExists, nil
+	}
+
+	err = db.atomically(func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT INTO computers(MAC, Name, IP, Assignee, Description, Revision) VALUES (?, ?, ?, ?, ?, ?)",
+			c.MAC, c.Name, c.IP, c.Assignee, c.Description, c.Revision)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM archived_computers WHERE ID = ?", id)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing to database: %s\n", err.Error())
+			return errWritingDB
+		}
+		return nil
+	})
+	if err != nil {
+		return err, nil
+	}
+	return nil, &c
+}
+
+func (db *sqlStore) Purge (id int) error {
+	return db.atomically(func(tx *sql.Tx) error {
+		res, err := tx.Exec("DELETE FROM archived_computers WHERE ID = ?", id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing to database: %s\n", err.Error())
+			return errWritingDB
+		}
+		n, err := res.RowsAffected()
+		if err == nil && n == 0 {
+			fmt.Fprintf(os.Stderr, "Error purging archived item %d: Item not found.\n", id)
+			return errNotFound
+		}
+		return nil
+	})
+}
+
+func (db *sqlStore) readEmployees (where string, args ...interface{}) (error, []Employee) {
+	rows, err := db.query("SELECT Code, FullName, Email, Department, Active FROM employees" + where + " ORDER BY Code", args...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading database: %s.\n", err.Error())
+		return errReadingDB, nil
+	}
+	defer rows.Close()
+
+	var el []Employee
+	for rows.Next() {
+		var e Employee
+		var email, department sql.NullString
+		err = rows.Scan(&e.Code, &e.FullName, &email, &department, &e.Active)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading database: %s.\n", err.Error())
+			return errReadingDB, nil
+		}
+		e.Email = email.String
+		e.Department = department.String
+		el = append(el, e)
+	}
+	if len(el) == 0 {
+		fmt.Fprintf(os.Stderr, "Error fetching employees: No employees found.\n")
+		return errNotFound, nil
+	}
+	return nil, el
+}
+
+func (db *sqlStore) ReadEmployee (code string) (error, *Employee) {
+	err, el := db.readEmployees(" WHERE Code = ?", code)
+	if err != nil {
+		return err, nil
+	}
+	return nil, &el[0]
+}
+
+func (db *sqlStore) ReadEmployees () (error, []Employee) {
+	return db.readEmployees("")
+}
+
+func (db *sqlStore) AddEmployee (e Employee) error {
+	if validateEmployee(e) != nil {
+		fmt.Fprintf(os.Stderr, "Error adding employee: Code must match %s and full name is mandatory.\n", employeeCodeFormat)
+		return errMalformed
+	}
+	err, _ := db.ReadEmployee(e.Code)
+	if err == nil {
+		fmt.Fprintf(os.Stderr, "Error adding employee %s: Employee already exists.\n", e.Code)
+		return errAlreadyExists
+	} else if err != errNotFound {
+		return err
+	}
+	return db.atomically(func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT INTO employees(Code, FullName, Email, Department, Active) VALUES (?, ?, ?, ?, ?)",
+			e.Code, e.FullName, e.Email, e.Department, e.Active)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing to database: %s\n", err.Error())
+			return errWritingDB
+		}
+		return nil
+	})
+}
+
+// changeEmployee runs a statement on the row of one employee, and returns
+// errNotFound if there is no such row.
+func (db *sqlStore) changeEmployee (code, stmt string, args ...interface{}) error {
+	return db.atomically(func(tx *sql.Tx) error {
+		res, err := tx.Exec(stmt, args...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing to database: %s\n", err.Error())
+			return errWritingDB
+		}
+		n, err := res.RowsAffected()
+		if err == nil && n == 0 {
+			fmt.Fprintf(os.Stderr, "Error changing employee %s: Employee not found.\n", code)
+			return errNotFound
+		}
+		return nil
+	})
+}
+
+func (db *sqlStore) UpdateEmployee (e Employee) error {
+	if validateEmployee(e) != nil {
+		fmt.Fprintf(os.Stderr, "Error updating employee: Code must match %s and full name is mandatory.\n", employeeCodeFormat)
+		return errMalformed
+	}
+	return db.changeEmployee(e.Code, "UPDATE employees SET FullName = ?, Email = ?, Department = ?, Active = ? WHERE Code = ?",
+		e.FullName, e.Email, e.Department, e.Active, e.Code)
+}
+
+func (db *sqlStore) DeleteEmployee (code string) error {
+	return db.changeEmployee(code, "DELETE FROM employees WHERE Code = ?", code)
+}
+
+// The notification of an outbox entry is stored as JSON, so that the table
+// doesn't have to follow every change of the Notification type.
+
+func (db *sqlStore) AddOutbox (e OutboxEntry) (error, int) {
+	payload, err := json.Marshal(e.Notification)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding notification: %s\n", err.Error())
+		return errMalformed, 0
+	}
+	var id int64
+	err = db.atomically(func(tx *sql.Tx) error {
+		res, err := tx.Exec("INSERT INTO notification_outbox(Payload, Sink, Status, Attempts, NextAttempt, LastError, ResponseCode, Created) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			string(payload), e.Sink, e.Status, e.Attempts, e.NextAttempt.UTC().Format(time.RFC3339Nano), e.LastError, e.ResponseCode, e.Created.UTC().Format(time.RFC3339Nano))
+		if err == nil {
+			id, err = res.LastInsertId()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing to database: %s\n", err.Error())
+			return errWritingDB
+		}
+		return nil
+	})
+	if err != nil {
+		return err, 0
+	}
+	return nil, int(id)
+}
+
+func (db *sqlStore) ReadOutbox (status string) (error, []OutboxEntry) {
+	selectSQL := "SELECT ID, Payload, Sink, Status, Attempts, NextAttempt, LastError, ResponseCode, Created FROM notification_outbox"
+	var args []interface{}
+	if status != "" {
+		selectSQL += " WHERE Status = ?"
+		args = append(args, status)
+	}
+	rows, err := db.query(selectSQL + " ORDER BY ID", args...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading database: %s.\n", err.Error())
+		return errReadingDB, nil
+	}
+	defer rows.Close()
+
+	var el []OutboxEntry
+	for rows.Next() {
+		var e OutboxEntry
+		var payload, next, created string
+		var sink, lastError sql.NullString
+		var code sql.NullInt64
+		err = rows.Scan(&e.ID, &payload, &sink, &e.Status, &e.Attempts, &next, &lastError, &code, &created)
+		if err == nil {
+			err = json.Unmarshal([]byte(payload), &e.Notification)
+		}
+		if err == nil {
+			e.NextAttempt, err = time.Parse(time.RFC3339Nano, next)
+		}
+		if err == nil {
+			e.Created, err = time.Parse(time.RFC3339Nano, created)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading outbox: %s.\n", err.Error())
+			return errReadingDB, nil
+		}
+		e.Sink = sink.String
+		e.LastError = lastError.String
+		e.ResponseCode = int(code.Int64)
+		el = append(el, e)
+	}
+	if len(el) == 0 {
+		return errNotFound, nil
+	}
+	return nil, el
+}
+
+func (db *sqlStore) UpdateOutbox (e OutboxEntry) error {
+	payload, err := json.Marshal(e.Notification)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding notification: %s\n", err.Error())
+		return errMalformed
+	}
+	return db.atomically(func(tx *sql.Tx) error {
+		res, err := tx.Exec("UPDATE notification_outbox SET Payload = ?, Status = ?, Attempts = ?, NextAttempt = ?, LastError = ?, ResponseCode = ? WHERE ID = ?",
+			string(payload), e.Status, e.Attempts, e.NextAttempt.UTC().Format(time.RFC3339Nano), e.LastError, e.ResponseCode, e.ID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing to database: %s\n", err.Error())
+			return errWritingDB
+		}
+		n, err := res.RowsAffected()
+		if err == nil && n == 0 {
+			fmt.Fprintf(os.Stderr, "Error updating outbox entry %d: Entry not found.\n", e.ID)
+			return errNotFound
+		}
+		return nil
+	})
+}
+
+func (db *sqlStore) WithTx (fn func(dataInterface) error) error {
+	if db.tx != nil {
+		fmt.Fprintf(os.Stderr, "Error starting transaction: Transaction already in progress.\n")
+		return errNestedTx
+	}
+	tx, err := db.data.Begin()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error starting transaction: %s\n", err.Error())
+		return errWritingDB
+	}
+	db.tx = tx
+	committed := false
+	defer func() {
+		db.tx = nil
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+
+	err = fn(db)
+	if err != nil {
+		return err
+	}
+	committed = true
+	err = tx.Commit()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error committing transaction: %s\n", err.Error())
+		return errWritingDB
+	}
+	return nil
+}
+
 func (db *sqlStore) Close() error {
 	err := db.data.Close()
 	if err != nil {
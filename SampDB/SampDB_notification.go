@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/template"
+	"time"
+)
+
+var errInvalidTemplate = errors.New("invalid template")
+
+// notificationVersion is the version of the Notification schema. Version 1
+// only had the level, employeeAbbreviation and message fields, which keep
+// their meaning.
+const notificationVersion = 2
+
+// Types of notifications.
+const (
+	typeOverAssignment	= "over-assignment"
+	typeDigest		= "digest"
+)
+
+// ComputerKeys identifies a computer in a notification.
+type ComputerKeys struct {
+	MAC	string `json:"mac"`
+	Name	string `json:"name"`
+	IP	string `json:"ip"`
+}
+
+// Notification is what notifiers deliver. Message is meant for humans, and
+// is rendered from the template of the type; programs should use the other
+// fields instead.
+type Notification struct {
+	Level		string `json:"level"`
+	Employee	string `json:"employeeAbbreviation"`
+	Message		string `json:"message"`
+	Version		int `json:"version"`
+	ID		string `json:"id"`
+	Type		string `json:"type"`
+	Count		int `json:"count,omitempty"`
+	Limit		int `json:"limit,omitempty"`
+	Computers	[]ComputerKeys `json:"computers,omitempty"`
+	Time		time.Time `json:"time"`
+}
+
+// defaultTemplates render the messages of the types that have one. The
+// message of the others is left as it is.
+var defaultTemplates = map[string]string {
+	typeOverAssignment:	"Over-assignment warning: Employee {{.Employee}} is now assigned {{.Count}} computers (limit {{.Limit}}).",
+}
+
+var templates = mustParseTemplates(defaultTemplates)
+
+func parseTemplates(tl map[string]string) (error, map[string]*template.Template) {
+	parsed := make(map[string]*template.Template)
+	for typ, text := range(tl) {
+		if typ != typeOverAssignment && typ != typeDigest {
+			return fmt.Errorf("%w: unknown notification type '%s'", errInvalidTemplate, typ), nil
+		}
+		t, err := template.New(typ).Option("missingkey=error").Parse(text)
+		if err == nil {
+			// Catch references to fields that don't exist.
+			err = t.Execute(&bytes.Buffer{}, Notification{})
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", errInvalidTemplate, err.Error()), nil
+		}
+		parsed[typ] = t
+	}
+	return nil, parsed
+}
+
+func mustParseTemplates(tl map[string]string) map[string]*template.Template {
+	err, parsed := parseTemplates(tl)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// loadTemplates reads templates from filename, a JSON object mapping types
+// to templates, in addition to the default ones.
+func loadTemplates(filename string) error {
+	tl := make(map[string]string)
+	for typ, text := range(defaultTemplates) {
+		tl[typ] = text
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, &tl)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidTemplate, err.Error())
+	}
+	err, parsed := parseTemplates(tl)
+	if err != nil {
+		return err
+	}
+	templates = parsed
+	return nil
+}
+
+func newNotificationID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// newNotification returns a notification of the current version, with its
+// message rendered. The message of n is kept for types without a template.
+func newNotification(n Notification) Notification {
+	n.Version = notificationVersion
+	n.ID = newNotificationID()
+	if n.Time.IsZero() {
+		n.Time = time.Now().UTC()
+	}
+	if t, ok := templates[n.Type]; ok {
+		var msg bytes.Buffer
+		err := t.Execute(&msg, n)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error rendering %s notification: %s\n", n.Type, err.Error())
+		} else {
+			n.Message = msg.String()
+		}
+	}
+	return n
+}
+
+func overAssignment(emp string, cl []Computer, limit int) Notification {
+	keys := make([]ComputerKeys, len(cl))
+	for i, c := range(cl) {
+		keys[i] = ComputerKeys{ c.MAC, c.Name, c.IP }
+	}
+	return newNotification(Notification {
+		Level:		"Warning",
+		Employee:	emp,
+		Type:		typeOverAssignment,
+		Count:		len(cl),
+		Limit:		limit,
+		Computers:	keys,
+	})
+}
+
+/***************/
+/* CloudEvents */
+/***************/
+
+// cloudEvent is the envelope of notifications for webhooks in the
+// "cloudevents" format, in the structured mode of CloudEvents 1.0.
+type cloudEvent struct {
+	SpecVersion	string `json:"specversion"`
+	ID		string `json:"id"`
+	Source		string `json:"source"`
+	Type		string `json:"type"`
+	Subject		string `json:"subject,omitempty"`
+	Time		time.Time `json:"time"`
+	DataContentType	string `json:"datacontenttype"`
+	Data		Notification `json:"data"`
+}
+
+const cloudEventsContentType = "application/cloudevents+json"
+
+func newCloudEvent(n Notification) cloudEvent {
+	return cloudEvent {
+		SpecVersion:		"1.0",
+		ID:			n.ID,
+		Source:			"/SampDB",
+		Type:			fmt.Sprintf("sampdb.%s.v%d", n.Type, n.Version),
+		Subject:		n.Employee,
+		Time:			n.Time,
+		DataContentType:	"application/json",
+		Data:			n,
+	}
+}
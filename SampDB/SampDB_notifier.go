@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errInvalidNotifier = errors.New("invalid notifier")
+
+// Notifier delivers notifications somewhere. A failed delivery is retried by
+// the outbox, so Notify may be called several times for one notification.
+// Notify returns the response code of the destination, for those that have
+// one, 0 otherwise.
+type Notifier interface {
+	Notify(n Notification) (error, int)
+}
+
+// Notification levels, from the least to the most severe.
+var levels = []string{ "Info", "Warning", "Error" }
+
+func levelRank(level string) int {
+	for i, l := range(levels) {
+		if strings.EqualFold(l, level) {
+			return i
+		}
+	}
+	return -1
+}
+
+// NotifierConfig describes a notifier in the --notifiers file. Which of the
+// fields are used depends on the type:
+//
+//	webhook: url, format ("plain" by default, "cloudevents", "slack",
+//	         "mattermost" or "teams"), secret to sign the notifications, and
+//	         mentions mapping employees to their ID on the chat platform
+//	smtp:    address, from, to, and username and password if the server
+//	         requires authentication
+//	syslog:  network, address and tag; without an address, the local syslog
+//	file:    path
+//
+// With digest set, the notifier gets the daily digest instead of single
+// notifications.
+type NotifierConfig struct {
+	Name		string `json:"name,omitempty"`
+	Type		string `json:"type"`
+	Level		string `json:"level,omitempty"`
+	Digest		bool `json:"digest,omitempty"`
+	URL		string `json:"url,omitempty"`
+	Format		string `json:"format,omitempty"`
+	Secret		string `json:"secret,omitempty"`
+	Mentions	map[string]string `json:"mentions,omitempty"`
+	Network		string `json:"network,omitempty"`
+	Address		string `json:"address,omitempty"`
+	From		string `json:"from,omitempty"`
+	To		[]string `json:"to,omitempty"`
+	Username	string `json:"username,omitempty"`
+	Password	string `json:"password,omitempty"`
+	Tag		string `json:"tag,omitempty"`
+	Path		string `json:"path,omitempty"`
+}
+
+// sink is a configured notifier. It only gets the notifications of its level
+// and above, unless it's in digest mode.
+type sink struct {
+	name		string
+	level		int
+	digest		bool
+	notifier	Notifier
+}
+
+func (s *sink) accepts(n Notification) bool {
+	return !s.digest && levelRank(n.Level) >= s.level
+}
+
+func digestWanted() bool {
+	for _, s := range(notifiers) {
+		if s.digest {
+			return true
+		}
+	}
+	return false
+}
+
+// notifiers are the sinks notifications are delivered to. Without a
+// --notifiers file, there is a single webhook posting to listenerURL, signed
+// with notifySecret.
+var notifiers []*sink
+
+var notifySecret = ""
+
+// notifyTimeout is how long webhooks have to answer, so that a stuck one
+// doesn't hold up the outbox.
+var notifyTimeout = 10 * time.Second
+
+// defaultNotifierName is also the sink of outbox entries from before there
+// were several of them.
+const defaultNotifierName = "listener"
+
+func defaultNotifiers() []*sink {
+	return []*sink{ { defaultNotifierName, 0, false, &webhookNotifier{ url: listenerURL, secret: notifySecret } } }
+}
+
+func findNotifier(name string) *sink {
+	if name == "" {
+		name = defaultNotifierName
+	}
+	for _, s := range(notifiers) {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func newNotifier(c NotifierConfig) (error, Notifier) {
+	switch c.Type {
+	case "webhook":
+		if c.URL == "" {
+			return fmt.Errorf("%w: webhook without a url", errInvalidNotifier), nil
+		}
+		if c.Format == "" {
+			c.Format = formatPlain
+		}
+		if !validFormat(c.Format) {
+			return fmt.Errorf("%w: unknown webhook format '%s'", errInvalidNotifier, c.Format), nil
+		}
+		return nil, &webhookNotifier{ c.URL, c.Format, c.Secret, c.Mentions }
+	case "smtp":
+		if c.Address == "" || c.From == "" || len(c.To) == 0 {
+			return fmt.Errorf("%w: smtp needs an address, from and to", errInvalidNotifier), nil
+		}
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			return fmt.Errorf("%w: smtp address: %s", errInvalidNotifier, err.Error()), nil
+		}
+		return nil, &smtpNotifier{ c.Address, c.From, c.To, c.Username, c.Password }
+	case "syslog":
+		if (c.Network == "") != (c.Address == "") {
+			return fmt.Errorf("%w: syslog needs both a network and an address, or neither", errInvalidNotifier), nil
+		}
+		tag := c.Tag
+		if tag == "" {
+			tag = "SampDB"
+		}
+		return nil, &syslogNotifier{ network: c.Network, address: c.Address, tag: tag }
+	case "file":
+		if c.Path == "" {
+			return fmt.Errorf("%w: file without a path", errInvalidNotifier), nil
+		}
+		return nil, &fileNotifier{ path: c.Path }
+	}
+	return fmt.Errorf("%w: unknown type '%s'", errInvalidNotifier, c.Type), nil
+}
+
+// newSinks configures the sinks of cl. Names default to the type, and must
+// be unique.
+func newSinks(cl []NotifierConfig) (error, []*sink) {
+	var sl []*sink
+	names := make(map[string]bool)
+	for _, c := range(cl) {
+		if c.Name == "" {
+			c.Name = c.Type
+		}
+		if names[c.Name] {
+			return fmt.Errorf("%w: duplicate name '%s'", errInvalidNotifier, c.Name), nil
+		}
+		names[c.Name] = true
+
+		level := 0
+		if c.Level != "" {
+			level = levelRank(c.Level)
+			if level < 0 {
+				return fmt.Errorf("%w: '%s' has unknown level '%s'", errInvalidNotifier, c.Name, c.Level), nil
+			}
+		}
+		err, n := newNotifier(c)
+		if err != nil {
+			return err, nil
+		}
+		sl = append(sl, &sink{ c.Name, level, c.Digest, n })
+	}
+	return nil, sl
+}
+
+// loadNotifiers reads the sinks from filename, a JSON list of NotifierConfig.
+func loadNotifiers(filename string) (error, []*sink) {
+	var cl []NotifierConfig
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err, nil
+	}
+	err = json.Unmarshal(data, &cl)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidNotifier, err.Error()), nil
+	}
+	return newSinks(cl)
+}
+
+/***********/
+/* Webhook */
+/***********/
+
+// Signed notifications carry the time they were sent, in seconds since the
+// epoch, and the HMAC-SHA256 of that time, a dot and the body, keyed with the
+// shared secret. Listeners should reject those sent too long ago, so that
+// they can't be replayed.
+const (
+	timestampHeader	= "X-SampDB-Timestamp"
+	signatureHeader	= "X-SampDB-Signature"
+)
+
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookNotifier posts notifications as JSON to a URL, in the payload of
+// its format. They are signed if there's a secret.
+type webhookNotifier struct {
+	url		string
+	format		string
+	secret		string
+	mentions	map[string]string
+}
+
+func (h *webhookNotifier) Notify(n Notification) (error, int) {
+	var payload interface{} = n
+	contentType := "application/json"
+	switch h.format {
+	case formatCloudEvents:
+		payload = newCloudEvent(n)
+		contentType = cloudEventsContentType
+	case formatSlack:
+		payload = slackPayload(n, h.mentions)
+	case formatMattermost:
+		payload = mattermostPayload(n, h.mentions)
+	case formatTeams:
+		payload = teamsPayload(n, h.mentions)
+	}
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return err, 0
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err, 0
+	}
+	req.Header.Set("Content-Type", contentType)
+	if h.secret != "" {
+		timestamp := fmt.Sprint(time.Now().Unix())
+		req.Header.Set(timestampHeader, timestamp)
+		req.Header.Set(signatureHeader, sign(h.secret, timestamp, jsonData))
+	}
+
+	client := &http.Client{ Timeout: notifyTimeout }
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Notification service: Error sending object (is the listener running?)\n")
+		return err, 0
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		fmt.Printf("Notification returned %d\n", resp.StatusCode)
+		return fmt.Errorf("listener returned %d", resp.StatusCode), resp.StatusCode
+	}
+	return nil, resp.StatusCode
+}
+
+/********/
+/* SMTP */
+/********/
+
+// smtpNotifier emails notifications.
+type smtpNotifier struct {
+	address		string
+	from		string
+	to		[]string
+	username	string
+	password	string
+}
+
+func (m *smtpNotifier) Notify(n Notification) (error, int) {
+	var auth smtp.Auth
+	if m.username != "" {
+		host, _, _ := net.SplitHostPort(m.address)
+		auth = smtp.PlainAuth("", m.username, m.password, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(m.to, ", "))
+	subject := n.Type
+	if n.Employee != "" && subject != "" {
+		subject += " of " + n.Employee
+	} else if n.Employee != "" {
+		subject = n.Employee
+	}
+	fmt.Fprintf(&msg, "Subject: SampDB %s: %s\r\n", n.Level, subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n", n.Message)
+
+	return smtp.SendMail(m.address, auth, m.from, m.to, msg.Bytes()), 0
+}
+
+/**********/
+/* Syslog */
+/**********/
+
+// syslogNotifier writes notifications to syslog, with the severity of their
+// level. The connection is opened on the first notification.
+type syslogNotifier struct {
+	network	string
+	address	string
+	tag	string
+	lock	sync.Mutex
+	writer	*syslog.Writer
+}
+
+func (s *syslogNotifier) Notify(n Notification) (error, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.writer == nil {
+		w, err := syslog.Dial(s.network, s.address, syslog.LOG_WARNING | syslog.LOG_DAEMON, s.tag)
+		if err != nil {
+			return err, 0
+		}
+		s.writer = w
+	}
+
+	switch levelRank(n.Level) {
+	case 0:
+		return s.writer.Info(n.Message), 0
+	case 1:
+		return s.writer.Warning(n.Message), 0
+	}
+	return s.writer.Err(n.Message), 0
+}
+
+/********/
+/* File */
+/********/
+
+// fileNotifier appends notifications to a file, as lines of JSON.
+type fileNotifier struct {
+	path	string
+	lock	sync.Mutex
+}
+
+func (f *fileNotifier) Notify(n Notification) (error, int) {
+	line, err := json.Marshal(n)
+	if err != nil {
+		return err, 0
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	file, err := os.OpenFile(f.path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0666)
+	if err != nil {
+		return err, 0
+	}
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		file.Close()
+		return err, 0
+	}
+	return file.Close(), 0
+}
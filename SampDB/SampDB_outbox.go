@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+var errNotFailed = errors.New("notification has not failed")
+
+// Statuses of outbox entries. Pending entries are retried until they are
+// delivered, or until outboxMaxAttempts is reached and they failed. Failed
+// entries can be resent by hand.
+const (
+	outboxPending	= "pending"
+	outboxDelivered	= "delivered"
+	outboxFailed	= "failed"
+)
+
+// OutboxEntry is a notification waiting for, or done with, delivery to one
+// of the notifiers.
+type OutboxEntry struct {
+	ID		int `json:"id"`
+	Notification	Notification `json:"notification"`
+	Sink		string `json:"sink,omitempty"`
+	Status		string `json:"status"`
+	Attempts	int `json:"attempts"`
+	NextAttempt	time.Time `json:"nextAttempt"`
+	LastError	string `json:"lastError,omitempty"`
+	ResponseCode	int `json:"responseCode,omitempty"`
+	Created		time.Time `json:"created"`
+}
+
+var listenerURL = "http://localhost:8080/api/notify"
+
+// Delivery is retried with exponential backoff, starting at outboxBackoff
+// and doubling up to outboxMaxBackoff between attempts.
+var outboxMaxAttempts = 8
+var outboxBackoff = time.Second
+var outboxMaxBackoff = 5 * time.Minute
+
+// outboxPoll is how long the worker sleeps when nothing is pending.
+const outboxPoll = time.Minute
+
+var outboxWake = make(chan struct{}, 1)
+
+// Closing outboxStop stops runOutbox, which closes outboxStopped once it's
+// done.
+var outboxStop = make(chan struct{})
+var outboxStopped = make(chan struct{})
+
+func backoff(attempts int) time.Duration {
+	d := outboxBackoff
+	for i := 1; i < attempts && d < outboxMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > outboxMaxBackoff {
+		d = outboxMaxBackoff
+	}
+	return d
+}
+
+// enqueueNotification stores n in the outbox, once for every notifier that
+// accepts its level, and wakes the worker up. The entries are added in a
+// single transaction, so that n is queued for all of those notifiers or for
+// none. It must be called with dataAccess held.
+func enqueueNotification(n Notification) error {
+	now := time.Now().UTC()
+	err := dataStore.WithTx(func(tx dataInterface) error {
+		for _, s := range(notifiers) {
+			if !s.accepts(n) {
+				continue
+			}
+			err, _ := tx.AddOutbox(OutboxEntry {
+				Notification:	n,
+				Sink:		s.name,
+				Status:		outboxPending,
+				NextAttempt:	now,
+				Created:	now,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	wakeOutbox()
+	return nil
+}
+
+func wakeOutbox() {
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// sendNotification delivers the notification of e to its notifier.
+func sendNotification(e OutboxEntry) (error, int) {
+	s := findNotifier(e.Sink)
+	if s == nil {
+		return fmt.Errorf("notifier '%s' is not configured", e.Sink), 0
+	}
+	return s.notifier.Notify(e.Notification)
+}
+
+// deliverDue attempts every pending entry due at now. It returns when the
+// next attempt is due, or the zero time if nothing is pending anymore.
+func deliverDue(now time.Time) time.Time {
+	return deliverPending(now, false)
+}
+
+// deliverPending attempts the pending entries due at now, or all of them.
+func deliverPending(now time.Time, all bool) time.Time {
+	dataAccess.Lock()
+	err, el := dataStore.ReadOutbox(outboxPending)
+	dataAccess.Unlock()
+	if err != nil && err != errNotFound {
+		return now.Add(outboxBackoff)
+	}
+
+	var next time.Time
+	for _, e := range(el) {
+		if !all && e.NextAttempt.After(now) {
+			if next.IsZero() || e.NextAttempt.Before(next) {
+				next = e.NextAttempt
+			}
+			continue
+		}
+
+		// The lock isn't held while waiting for the listener.
+		err, code := sendNotification(e)
+		e.Attempts++
+		e.ResponseCode = code
+		if err == nil {
+			e.Status = outboxDelivered
+			e.LastError = ""
+		} else if e.Attempts >= outboxMaxAttempts {
+			e.Status = outboxFailed
+			e.LastError = err.Error()
+			fmt.Fprintf(os.Stderr, "Notification %d given up after %d attempts: %s\n", e.ID, e.Attempts, err.Error())
+		} else {
+			e.LastError = err.Error()
+			e.NextAttempt = now.Add(backoff(e.Attempts))
+			if next.IsZero() || e.NextAttempt.Before(next) {
+				next = e.NextAttempt
+			}
+		}
+
+		dataAccess.Lock()
+		err = dataStore.UpdateOutbox(e)
+		dataAccess.Unlock()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error updating notification %d: %s\n", e.ID, err.Error())
+		}
+	}
+	return next
+}
+
+// runOutbox delivers the outbox in the background, until outboxStop is
+// closed.
+func runOutbox() {
+	defer close(outboxStopped)
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-outboxStop:
+			return
+		case <-outboxWake:
+		case <-timer.C:
+		}
+		next := deliverDue(time.Now().UTC())
+
+		wait := outboxPoll
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+// flushOutbox stops runOutbox, then attempts every pending entry once,
+// including those waiting for a retry. It gives up at deadline, and returns
+// whether it was done by then. Entries left pending are delivered on the next
+// start, with non-volatile storage.
+func flushOutbox(deadline time.Time) bool {
+	timeout := time.NewTimer(time.Until(deadline))
+	defer timeout.Stop()
+
+	close(outboxStop)
+	select {
+	case <-outboxStopped:
+	case <-timeout.C:
+		return false
+	}
+
+	done := make(chan struct{})
+	go func() {
+		deliverPending(time.Now().UTC(), true)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-timeout.C:
+		return false
+	}
+}
+
+/*******/
+/* API */
+/*******/
+
+// findOutbox returns the outbox entry with the given id. It must be called
+// with dataAccess held.
+func findOutbox(id int) (error, *OutboxEntry) {
+	err, el := dataStore.ReadOutbox("")
+	if err != nil {
+		return err, nil
+	}
+	for _, e := range(el) {
+		if e.ID == id {
+			return nil, &e
+		}
+	}
+	return errNotFound, nil
+}
+
+// getNotifications returns the notifications in the outbox, optionally those
+// with a status or about an employee only.
+func getNotifications(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && status != outboxPending && status != outboxDelivered && status != outboxFailed && status != outboxSuppressed {
+		http.Error(w, "'status' must be one of pending, delivered, failed or suppressed.", http.StatusBadRequest)
+		return
+	}
+	emp := r.URL.Query().Get("employee")
+
+	dataAccess.Lock()
+	err, el := dataStore.ReadOutbox(status)
+	dataAccess.Unlock()
+
+	if err != nil && err != errNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var found []OutboxEntry
+	for _, e := range(el) {
+		if emp == "" || e.Notification.Employee == emp {
+			found = append(found, e)
+		}
+	}
+	if len(found) == 0 {
+		http.Error(w, "No notifications found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(found)
+}
+
+func getNotification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid notification id", http.StatusBadRequest)
+		return
+	}
+
+	dataAccess.Lock()
+	err, e := findOutbox(id)
+	dataAccess.Unlock()
+
+	if err == errNotFound {
+		http.Error(w, "Notification not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(e)
+}
+
+// resendNotification puts a failed notification back in the outbox. It gets
+// a single attempt, since it already used up the others.
+func resendNotification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid notification id", http.StatusBadRequest)
+		return
+	}
+
+	dataAccess.Lock()
+	err, e := findOutbox(id)
+	if err == nil && e.Status != outboxFailed {
+		err = errNotFailed
+	}
+	if err == nil {
+		e.Status = outboxPending
+		e.NextAttempt = time.Now().UTC()
+		err = dataStore.UpdateOutbox(*e)
+	}
+	dataAccess.Unlock()
+
+	if err == errNotFound {
+		http.Error(w, "Notification not found", http.StatusNotFound)
+		return
+	} else if err == errNotFailed {
+		http.Error(w, "Only failed notifications can be resent", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	wakeOutbox()
+	json.NewEncoder(w).Encode(e)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+var errInvalidPolicy = errors.New("invalid policy")
+
+// PolicySet holds how many computers employees may have before SampDB warns
+// about over-assignment. A limit for the employee wins over one for their
+// department, which wins over the default.
+type PolicySet struct {
+	Default		int `json:"default"`
+	Departments	map[string]int `json:"departments,omitempty"`
+	Employees	map[string]int `json:"employees,omitempty"`
+}
+
+// EffectivePolicy is the limit that applies to one employee, and where it
+// comes from: "employee", "department" or "default".
+type EffectivePolicy struct {
+	Employee	string `json:"employee"`
+	Department	string `json:"department,omitempty"`
+	Limit		int `json:"limit"`
+	Source		string `json:"source"`
+}
+
+// defaultLimit is the historical rule: more than 2 computers is too many.
+const defaultLimit = 2
+
+var policies = PolicySet{ Default: defaultLimit }
+var policyAccess sync.RWMutex
+
+// policyFile is where policies are loaded from and saved to. Without one,
+// changes made through the API only last until SampDB stops.
+var policyFile = ""
+
+func (p PolicySet) validate() error {
+	if p.Default < 0 {
+		return fmt.Errorf("%w: default limit %d is negative", errInvalidPolicy, p.Default)
+	}
+	for d, l := range(p.Departments) {
+		if d == "" || l < 0 {
+			return fmt.Errorf("%w: department '%s' with limit %d", errInvalidPolicy, d, l)
+		}
+	}
+	for e, l := range(p.Employees) {
+		if e == "" || l < 0 {
+			return fmt.Errorf("%w: employee '%s' with limit %d", errInvalidPolicy, e, l)
+		}
+	}
+	return nil
+}
+
+// effective returns the policy for an employee of a department.
+func (p PolicySet) effective(emp, department string) EffectivePolicy {
+	if l, ok := p.Employees[emp]; ok {
+		return EffectivePolicy{ emp, department, l, "employee" }
+	}
+	if l, ok := p.Departments[department]; ok && department != "" {
+		return EffectivePolicy{ emp, department, l, "department" }
+	}
+	return EffectivePolicy{ emp, department, p.Default, "default" }
+}
+
+// loadPolicies reads the policies from filename, if it exists.
+func loadPolicies(filename string) error {
+	var p PolicySet
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidPolicy, err.Error())
+	}
+	err = p.validate()
+	if err != nil {
+		return err
+	}
+
+	policyAccess.Lock()
+	policies = p
+	policyAccess.Unlock()
+	return nil
+}
+
+// savePolicies writes p to policyFile, if there is one. It must be called
+// with policyAccess held.
+func savePolicies(p PolicySet) error {
+	if policyFile == "" {
+		return nil
+	}
+	return writeFileAtomic(policyFile, func(file *os.File) error {
+		enc := json.NewEncoder(file)
+		enc.SetIndent("", "  ")
+		return enc.Encode(p)
+	})
+}
+
+// policyFor looks up the department of an employee in store and returns the
+// policy that applies to them. It must be called with dataAccess held.
+func policyFor(store dataInterface, emp string) EffectivePolicy {
+	var department string
+	err, e := store.ReadEmployee(emp)
+	if err == nil {
+		department = e.Department
+	}
+
+	policyAccess.RLock()
+	defer policyAccess.RUnlock()
+	return policies.effective(emp, department)
+}
+
+func getPolicies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	policyAccess.RLock()
+	p := policies
+	policyAccess.RUnlock()
+
+	json.NewEncoder(w).Encode(p)
+}
+
+func updatePolicies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	var p PolicySet
+	err := json.NewDecoder(r.Body).Decode(&p)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	err = p.validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	policyAccess.Lock()
+	err = savePolicies(p)
+	if err == nil {
+		policies = p
+	}
+	policyAccess.Unlock()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving policies to %s: %s\n", policyFile, err.Error())
+		http.Error(w, "Error saving policies", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func getEffectivePolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	emp := r.URL.Query().Get("employee")
+	if emp == "" {
+		http.Error(w, "Missing mandatory parameter 'employee'.", http.StatusBadRequest)
+		return
+	}
+
+	dataAccess.Lock()
+	policy := policyFor(dataStore, emp)
+	dataAccess.Unlock()
+
+	json.NewEncoder(w).Encode(policy)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Quota modes. In warn mode, over-assignment policies only trigger
+// notifications. In enforce mode, changes that would exceed them are refused
+// unless forced.
+const (
+	quotaWarn	= "warn"
+	quotaEnforce	= "enforce"
+)
+
+var quotaMode = quotaWarn
+
+// QuotaError is returned for a change that would give an employee more
+// computers than their policy allows.
+type QuotaError struct {
+	EffectivePolicy
+	Assigned	int `json:"assigned"`
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("employee %s would have %d computers, over the limit of %d", e.Employee, e.Assigned, e.Limit)
+}
+
+// checkQuota checks whether emp can get one more computer in store. It
+// returns a *QuotaError if not, unless force is set, in which case it returns
+// the description of the override to record with the change.
+func checkQuota(store dataInterface, emp string, force bool) (string, error) {
+	if quotaMode != quotaEnforce {
+		return "", nil
+	}
+	err, cl := store.ReadAll(KeyAssignee, emp)
+	if err != nil && err != errNotFound {
+		return "", err
+	}
+	qe := &QuotaError{ policyFor(store, emp), len(cl) + 1 }
+	if qe.Assigned <= qe.Limit {
+		return "", nil
+	}
+	if !force {
+		return "", qe
+	}
+	return fmt.Sprintf("quota override: %d computers, %s limit %d", qe.Assigned, qe.Source, qe.Limit), nil
+}
+
+// force tells whether a request asks to override quotas, with force=true.
+func force(r *http.Request) bool {
+	f, err := strconv.ParseBool(r.URL.Query().Get("force"))
+	return err == nil && f
+}
+
+// quotaError writes the response for a change refused by checkQuota. It
+// returns false for any other error.
+func quotaError(w http.ResponseWriter, err error) bool {
+	var qe *QuotaError
+	if !errors.As(err, &qe) {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(struct {
+		Error	string `json:"error"`
+		*QuotaError
+		Hint	string `json:"hint"`
+	}{ "quota exceeded", qe, "repeat the request with force=true to override the quota" })
+	return true
+}
+
+// getQuotaOverrides returns the changes that were forced over a quota, for
+// one employee or for all of them.
+func getQuotaOverrides(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	keytype, key := KeyAll, ""
+	if emp := r.URL.Query().Get("employee"); emp != "" {
+		keytype, key = KeyAssignee, emp
+	}
+
+	dataAccess.Lock()
+	err, el := dataStore.ReadEvents(keytype, key)
+	dataAccess.Unlock()
+
+	if err != nil && err != errNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var overrides []AssignmentEvent
+	for _, e := range(el) {
+		if e.Override != "" && (key == "" || e.NewAssignee == key) {
+			overrides = append(overrides, e)
+		}
+	}
+	if len(overrides) == 0 {
+		http.Error(w, "No overrides found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(overrides)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// outboxSuppressed is the status of notifications that weren't sent, because
+// the same one was sent shortly before. They are kept for the record.
+const outboxSuppressed = "suppressed"
+
+// notifyWindow is how long a notification suppresses repeats of itself.
+// Zero disables suppression.
+var notifyWindow = time.Hour
+
+type notified struct {
+	count	int
+	at	time.Time
+}
+
+// lastNotified holds what was last notified per employee and rule, which is
+// the type of the notification. It is guarded by dataAccess.
+var lastNotified = make(map[string]notified)
+
+func notifiedKey(emp, rule string) string {
+	return rule + "/" + emp
+}
+
+// suppressed tells whether a notification that emp has count of what rule
+// is about repeats the last one. If not, it becomes the last one. It must be
+// called with dataAccess held.
+func suppressed(emp, rule string, count int, now time.Time) bool {
+	key := notifiedKey(emp, rule)
+	last, ok := lastNotified[key]
+	if ok && count <= last.count && now.Before(last.at.Add(notifyWindow)) {
+		return true
+	}
+	lastNotified[key] = notified{ count, now }
+	return false
+}
+
+// forgetNotified makes the next notification about emp and rule go out,
+// once emp is back within the rule. It must be called with dataAccess held.
+func forgetNotified(emp, rule string) {
+	delete(lastNotified, notifiedKey(emp, rule))
+}
+
+// recordSuppressed stores n in the outbox, where it's never delivered. It
+// must be called with dataAccess held.
+func recordSuppressed(n Notification, now time.Time) error {
+	err, _ := dataStore.AddOutbox(OutboxEntry {
+		Notification:	n,
+		Status:		outboxSuppressed,
+		NextAttempt:	now,
+		Created:	now,
+	})
+	return err
+}
+
+// getSuppressedNotifications returns the suppressed notifications, for one
+// employee or for all of them.
+func getSuppressedNotifications(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	emp := r.URL.Query().Get("employee")
+
+	dataAccess.Lock()
+	err, el := dataStore.ReadOutbox(outboxSuppressed)
+	dataAccess.Unlock()
+
+	if err != nil && err != errNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var found []OutboxEntry
+	for _, e := range(el) {
+		if emp == "" || e.Notification.Employee == emp {
+			found = append(found, e)
+		}
+	}
+	if len(found) == 0 {
+		http.Error(w, "No suppressed notifications found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(found)
+}
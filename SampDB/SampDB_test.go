@@ -4,12 +4,19 @@ import (
 	"testing"
 	"strings"
 	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"regexp"
+	"strconv"
+	"syscall"
 	"time"
 	"bufio"
 )
@@ -23,7 +30,10 @@ const (
 	errFailed          = -6
 )
 
-const baseURL = "http://localhost:55555"
+// Both servers listen on free ports, so that tests can run next to anything
+// else. setupTest sets where.
+var baseURL, listenerBaseURL string
+var sampDBPort, listenerPort int
 const testfile = "only-for-tests"
 
 func handleError(t *testing.T, err int, req string) {
@@ -58,10 +68,34 @@ func init () {
 
 	// Start both non-volatile storage files fresh
 	os.Remove(testfile + ".json")
+	os.Remove(testfile + ".json.history")
+	os.Remove(testfile + ".json.archive")
+	os.Remove(testfile + ".json.employees")
+	os.Remove(testfile + ".json.outbox")
+	os.Remove(testfile + ".json.journal")
 	os.Remove(testfile + ".sqlite")
 }
 
-func setupTest (t *testing.T, storagetype string) {
+// testEmployees are the employee codes the tests assign computers to. They
+// are registered whenever SampDB is started.
+var testEmployees = []string{ "mmu", "ima", "abc", "foo", "bar" }
+
+// testStoreSuffixes are the files that make up a store, next to the file
+// named after its storage type.
+var testStoreSuffixes = []string{ "", ".history", ".archive", ".employees", ".outbox", ".journal", ".tmp" }
+
+// setupTest starts both servers on a fresh store. Any args are passed on to
+// SampDB.
+func setupTest (t *testing.T, storagetype string, args ...string) {
+	for _, suffix := range(testStoreSuffixes) {
+		os.Remove(testfile + "." + storagetype + suffix)
+	}
+	restartTest(t, storagetype, args...)
+}
+
+// restartTest starts both servers on the store a previous setupTest left
+// behind.
+func restartTest (t *testing.T, storagetype string, args ...string) {
 
 	var err error
 
@@ -78,92 +112,137 @@ func setupTest (t *testing.T, storagetype string) {
 		SampDBBuilt = true
 	}
 
+	err = os.Chdir("../DummyListener")
+	if err != nil {
+		t.Fatalf("Error changing to DummyListener folder. Is this executed in the right folder?")
+	}
+
+	if !DummyListenerBuilt {
+		// Build DummyListener if it isn't already built
+		buildCmd := exec.Command("go", "build")
+		err = buildCmd.Run()
+		if err != nil {
+			t.Fatalf("Error building DummyListener: %s", err.Error())
+			return
+		}
+		DummyListenerBuilt = true
+	}
+
+	err = os.Chdir("../SampDB")
+	if err != nil {
+		t.Fatalf("Error changing to SampDB folder. Is this executed in the right folder?")
+	}
+
+	startDummyListener(t, 0)
+
 	// Run SampDB in the background
 	outSampDBBuf.Reset()
 	filename := testfile + "." + storagetype
-	SampDB = exec.Command("./SampDB", "--file", filename, "--storage-type", storagetype)
+	SampDB = exec.Command("./SampDB", append([]string{"--file", filename, "--storage-type", storagetype,
+		"--port", "0", "--listener-url", listenerBaseURL + "/api/notify"}, args...)...)
         SampDB.Stdout = &outSampDBBuf
 	SampDB.Stderr = os.Stderr
 	err = SampDB.Start()
 	if err != nil {
+		DummyListener.Process.Kill()
+		DummyListener.Wait()
 		t.Fatalf("Error starting program: %s", err.Error())
 		return
 	}
 
 	// Verify server is up and running
-	timeout := 10
-	startLine := "Starting server on port 55555...\n"
-	for timeout > 0 {
-		if outSampDBBuf.String() == startLine {
-			break
-		}
-		time.Sleep(time.Second)
-		timeout --
-		if timeout == 0 {
-			t.Fatalf("Error starting SampDB - timeout reached.")
+	sampDBPort = waitForStart(&outSampDBBuf)
+	if sampDBPort == 0 {
+		teardownTest(t)
+		t.Fatalf("Error starting SampDB - timeout reached.")
+	}
+	baseURL = fmt.Sprintf("http://localhost:%d", sampDBPort)
+	for i, arg := range(args) {
+		if arg == "--base-path" && i + 1 < len(args) {
+			baseURL += args[i + 1]
 		}
 	}
 	fmt.Printf(outSampDBBuf.String())
 
-	err = os.Chdir("../DummyListener")
-	if err != nil {
-		t.Fatalf("Error changing to DummyListener folder. Is this executed in the right folder?")
+	for _, code := range(testEmployees) {
+		resp := addEmployeeReq(t, Employee{ Code: code, FullName: "Test " + code, Active: true })
+		if resp != http.StatusCreated && resp != http.StatusConflict {
+			handleError(t, resp, "addEmployee")
+		}
 	}
 
-	if !DummyListenerBuilt {
-		// Build DummyListener if it isn't already built
-		buildCmd := exec.Command("go", "build")
-		err = buildCmd.Run()
-		if err != nil {
-			t.Fatalf("Error building DummyListener: %s", err.Error())
-			return
+	fmt.Printf("Setup complete.\n")
+}
+
+// startLine is what servers print once they listen on port.
+func startLine(port int) string {
+	return fmt.Sprintf("Starting server on port %d...\n", port)
+}
+
+// waitForStart waits for a server to print that it started, and returns its
+// port, or 0 if it didn't start within 10 seconds.
+func waitForStart(buf *bytes.Buffer) int {
+	for i := 0; i < 100; i++ {
+		var port int
+		_, err := fmt.Sscanf(buf.String(), "Starting server on port %d...\n", &port)
+		if err == nil {
+			return port
 		}
-		DummyListenerBuilt = true
+		time.Sleep(100 * time.Millisecond)
 	}
+	return 0
+}
 
-	// Run DummyListener in the background
+// startDummyListener runs DummyListener in the background on port, or on a
+// free port for 0.
+func startDummyListener(t *testing.T, port int) {
 	outDummyListenerBuf.Reset()
-	DummyListener = exec.Command("./DummyListener")
+	DummyListener = exec.Command("../DummyListener/DummyListener", "--port", strconv.Itoa(port))
         DummyListener.Stdout = &outDummyListenerBuf
-	err = DummyListener.Start()
+	err := DummyListener.Start()
 	if err != nil {
-		t.Fatalf("Error starting program: %s", err.Error())
-		return
+		t.Fatalf("Error starting DummyListener: %s", err.Error())
 	}
 
-	// Verify server is up and running
-	timeout = 10
-	startLine = "Starting server on port 8080...\n"
-	for timeout > 0 {
-		if outDummyListenerBuf.String() == startLine {
-			break
-		}
-		time.Sleep(time.Second)
-		timeout --
-		if timeout == 0 {
-			t.Fatalf("Error starting SampDB - timeout reached.")
-		}
+	// Verify server is up and running.
+	listenerPort = waitForStart(&outDummyListenerBuf)
+	if listenerPort == 0 {
+		t.Fatalf("Error starting DummyListener - timeout reached.")
 	}
+	listenerBaseURL = fmt.Sprintf("http://localhost:%d", listenerPort)
 	fmt.Printf(outDummyListenerBuf.String())
+}
 
-	err = os.Chdir("../SampDB")
+// stopSampDB asks SampDB to stop, like a service manager would, and waits for
+// it. It's killed if it doesn't stop in time.
+func stopSampDB() error {
+	err := SampDB.Process.Signal(syscall.SIGTERM)
 	if err != nil {
-		t.Fatalf("Error changing to SampDB folder. Is this executed in the right folder?")
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- SampDB.Wait()
+	}()
+	select {
+	case err = <-exited:
+		return err
+	case <-time.After(30 * time.Second):
+		SampDB.Process.Kill()
+		<-exited
+		return errors.New("timeout reached")
 	}
-
-	fmt.Printf("Setup complete.\n")
 }
 
 func teardownTest (t *testing.T) {
 
 	fmt.Printf("Tearing down test...\n")
-	// Kill SampDB
-	err := SampDB.Process.Kill()
+	// Stop SampDB
+	err := stopSampDB()
 	if err != nil {
-		t.Fatalf("Error killing SampDB: %s", err.Error())
+		t.Fatalf("Error stopping SampDB: %s", err.Error())
 		return
 	}
-	SampDB.Wait()
 	fmt.Printf("SampDB process terminated.\n")
 
 	// Kill DummyListener
@@ -194,6 +273,22 @@ func addComputerReq(t *testing.T, c Computer) int {
 	return resp.StatusCode
 }
 
+func addEmployeeReq(t *testing.T, e Employee) int {
+	fmt.Printf("Adding employee %v\n", e)
+	jsonData, err := json.Marshal(e)
+	if err != nil {
+		return errMarshalling
+	}
+
+	resp, err := http.Post(baseURL + "/addEmployee", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return errSending
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode
+}
+
 func getComputerByReq(t *testing.T, keyname, key string) (int, Computer) {
 	fmt.Printf("Getting computer with %s=%s\n", keyname, key)
 	var c Computer
@@ -742,6 +837,18 @@ func subTestAssignUnassign(t *testing.T) {
 		t.Errorf("Unexpected items returned by getComputersByAssignee.")
 	}
 
+	// Unassign the second computer by IP
+	resp = unassignComputerByReq(t, "IP", c2.IP)
+	if resp != http.StatusOK {
+		handleError(t, resp, "unassignComputerByIP")
+	}
+
+	// Verify no computers are returned by getComputerByAssignee
+	resp, cl = getComputersByAssigneeReq(t, "mmu")
+	if resp != http.StatusNotFound {
+		t.Errorf("Unexpected response %d for getComputersByAssignee (expected StatusNotFound).", resp)
+	}
+
 	// Delete the computers to return to baseline.
 	resp = delComputerByReq(t, "Name", c1.Name)
 	if resp != http.StatusOK {
@@ -751,6 +858,16 @@ func subTestAssignUnassign(t *testing.T) {
 	if resp != http.StatusOK {
 		handleError(t, resp, "deleteComputerByIP")
 	}
+
+	// Deleting them again is refused.
+	resp = delComputerByReq(t, "Name", c1.Name)
+	if resp != http.StatusNotFound {
+		t.Errorf("Unexpected response %d for deleteComputerByName (expected StatusNotFound).", resp)
+	}
+	resp = delComputerByReq(t, "IP", c2.IP)
+	if resp != http.StatusNotFound {
+		t.Errorf("Unexpected response %d for deleteComputerByIP (expected StatusNotFound).", resp)
+	}
 }
 
 func TestReassignVolatile (t *testing.T) {
@@ -872,290 +989,3026 @@ func subTestReassign(t *testing.T) {
 	}
 }
 
-func TestNotification(t *testing.T) {
-
-	fmt.Printf("Starting test 'Notification'\n")
-
-	setupTest(t, "volatile")
+func getETagReq(t *testing.T, keyname, key string) (int, string) {
+	fmt.Printf("Getting ETag of computer with %s=%s\n", keyname, key)
+	resp, err := http.Get(fmt.Sprintf("%s/getComputerBy%s?%s=%s", baseURL, keyname, strings.ToLower(keyname), key))
+	if err != nil {
+		return errSending, ""
+	}
+	defer resp.Body.Close()
 
-	// Add three computers, assigned to the same person
-	for i := 0; i < 3; i ++ {
-		resp := addComputerReq(t,  Computer{
-			        fmt.Sprintf("0%d:2%d:4%d:6%d:8%d:a%d",i,i,i,i,i,i),
-				fmt.Sprintf("TestComputer%d", i),
-				fmt.Sprintf("172.1.0.%d", i),
-				"mmu",
-				"",
-			})
+	return resp.StatusCode, resp.Header.Get("ETag")
+}
 
-	        if resp != http.StatusCreated {
-		        handleError(t, resp, "addComputer")
-		}
+func conditionalReq(t *testing.T, method, endpoint, etag string, body []byte) int {
+	fmt.Printf("Sending %s %s with If-Match: %s\n", method, endpoint, etag)
+	client := &http.Client{}
+	req, err := http.NewRequest(method, baseURL + endpoint, bytes.NewBuffer(body))
+	if err != nil {
+		return errSending
+	}
+	req.Header.Set("If-Match", etag)
+	resp, err := client.Do(req)
+	if err != nil {
+		return errSending
 	}
+	resp.Body.Close()
 
-	// Loooking for the warning from SampDB and the DummyListener
-	expectedSampDB := `Starting server on port 55555...
-Warning: Employee [mmu] has been assigned 3 computers!
-`
+	return resp.StatusCode
+}
 
-	expectedDummyListener := `Starting server on port 8080...
-DummyListener WARNING [mmu]: : Over-assignement warning: Employee mmu is now assigned 3 computers.
-`
+func TestConcurrencyVolatile (t *testing.T) {
+	fmt.Printf("Starting test TestConcurrencyVolatile.\n")
+	setupTest(t, "volatile")
+	subTestConcurrency(t)
+	teardownTest(t)
+	fmt.Printf("Test TestConcurrencyVolatile completed.\n");
+}
 
-	if outSampDBBuf.String() != expectedSampDB {
-		t.Errorf("Expected SampDB output:\n%q\nBut got: %s",
-				expectedSampDB, outSampDBBuf.String())
-	}
-	if string(outDummyListenerBuf.Bytes()) != expectedDummyListener {
-		t.Errorf("Expected dummyListener output:\n%q\nBut got: %s",
-			expectedDummyListener, outSampDBBuf.String())
-	}
+func TestConcurrencyJSON (t *testing.T) {
+	fmt.Printf("Starting test TestConcurrencyJSON.\n")
+	setupTest(t, "json")
+	subTestConcurrency(t)
+	teardownTest(t)
+	fmt.Printf("Test TestConcurrencyJSON completed.\n");
+}
 
-	// Reset output buffers
-	outSampDBBuf.Reset()
-	outDummyListenerBuf.Reset()
+func TestConcurrencySQL (t *testing.T) {
+	fmt.Printf("Starting test TestConcurrencySQL.\n")
+	setupTest(t, "sqlite")
+	subTestConcurrency(t)
+	teardownTest(t)
+	fmt.Printf("Test TestConcurrencySQL completed.\n");
+}
 
-	// Adding three non-assigned computers
-	for i := 3; i < 6; i ++ {
-		resp := addComputerReq(t,  Computer{
-			        fmt.Sprintf("0%d:2%d:4%d:6%d:8%d:a%d",i,i,i,i,i,i),
-				fmt.Sprintf("TestComputer%d", i),
-				fmt.Sprintf("172.1.0.%d", i),
-				"",
-				"",
-			})
+func subTestConcurrency(t *testing.T) {
 
-	        if resp != http.StatusCreated {
-		        handleError(t, resp, "addComputer")
-		}
+	var c = Computer {
+		MAC: "01:23:45:67:89:ab",
+		Name: "TestComputer",
+		IP: "172.1.0.1",
+	}
+	resp := addComputerReq(t, c)
+	if resp != http.StatusCreated {
+		handleError(t, resp, "addComputer")
 	}
 
-	// Assigning computers to the same user
-	resp := assignComputerByReq(t, "MAC", "03:23:43:63:83:a3", "ima")
+	resp, tag := getETagReq(t, "MAC", c.MAC)
 	if resp != http.StatusOK {
-		handleError(t, resp, "assignComputerByMAC")
+		handleError(t, resp, "getComputerByMAC")
 	}
-	resp = assignComputerByReq(t, "Name", "TestComputer4", "ima")
+	if tag != `"1"` {
+		t.Errorf("Unexpected ETag of a new computer: %s", tag)
+	}
+
+	// Two admins assign the computer based on the same read.
+	first, _ := json.Marshal(Assignment { c.Name, "mmu" })
+	second, _ := json.Marshal(Assignment { c.Name, "ima" })
+	resp = conditionalReq(t, http.MethodPut, "/assignComputerByName", tag, first)
 	if resp != http.StatusOK {
 		handleError(t, resp, "assignComputerByName")
 	}
-	resp = assignComputerByReq(t, "IP", "172.1.0.5", "ima")
-	if resp != http.StatusOK {
-		handleError(t, resp, "assignComputerByIP")
+	resp = conditionalReq(t, http.MethodPut, "/assignComputerByName", tag, second)
+	if resp != http.StatusPreconditionFailed {
+		t.Errorf("Stale assignment returned %d instead of %d", resp, http.StatusPreconditionFailed)
 	}
 
-	// Loooking for the warnings from SampDB and the DummyListener
-	expectedSampDB = `Starting server on port 55555...
-Warning: Employee [mmu] has been assigned 3 computers!
-Warning: Employee [ima] has been assigned 3 computers!
-`
-
-	expectedDummyListener = `Starting server on port 8080...
-DummyListener WARNING [mmu]: : Over-assignement warning: Employee mmu is now assigned 3 computers.
-DummyListener WARNING [ima]: : Over-assignement warning: Employee ima is now assigned 3 computers.
-`
-
+	resp, got := getComputerByReq(t, "IP", c.IP)
+	if resp != http.StatusOK {
+		handleError(t, resp, "getComputerByIP")
+	}
+	if got.Assignee != "mmu" {
+		t.Errorf("Stale assignment overwrote the previous one (assignee is %s)", got.Assignee)
+	}
 
-	if outSampDBBuf.String() != expectedSampDB {
-		t.Errorf("Expected SampDB output:\n%q\nBut got: %s",
-				expectedSampDB, outSampDBBuf.String())
+	resp, tag = getETagReq(t, "IP", c.IP)
+	if tag != `"2"` {
+		t.Errorf("Unexpected ETag after assignment: %s", tag)
+	}
+	resp = conditionalReq(t, http.MethodDelete, "/unassignComputerByIP?ip=" + c.IP, `"1"`, nil)
+	if resp != http.StatusPreconditionFailed {
+		t.Errorf("Stale unassignment returned %d instead of %d", resp, http.StatusPreconditionFailed)
+	}
+	resp = conditionalReq(t, http.MethodDelete, "/unassignComputerByIP?ip=" + c.IP, tag, nil)
+	if resp != http.StatusOK {
+		handleError(t, resp, "unassignComputerByIP")
+	}
+	resp = conditionalReq(t, http.MethodDelete, "/deleteComputerByMAC?mac=" + c.MAC, tag, nil)
+	if resp != http.StatusPreconditionFailed {
+		t.Errorf("Stale deletion returned %d instead of %d", resp, http.StatusPreconditionFailed)
 	}
-	if outDummyListenerBuf.String() != expectedDummyListener {
-		t.Errorf("Expected dummyListener output:\n%q\nBut got: %s",
-			expectedDummyListener, outDummyListenerBuf.String())
+	resp = conditionalReq(t, http.MethodDelete, "/deleteComputerByMAC?mac=" + c.MAC, "*", nil)
+	if resp != http.StatusOK {
+		handleError(t, resp, "deleteComputerByMAC")
 	}
+}
 
-	for i := 0; i < 6; i ++ {
-		resp = delComputerByReq(t, "Name", fmt.Sprintf("TestComputer%d", i))
-		if resp != http.StatusOK {
-			handleError(t, resp, "deleteComputerByMAC")
-		}
+func getHistoryReq(t *testing.T, keyname, key string) (int, []AssignmentEvent) {
+	fmt.Printf("Getting history with %s=%s\n", keyname, key)
+	var el []AssignmentEvent
+	resp, err := http.Get(fmt.Sprintf("%s/getHistoryBy%s?%s=%s", baseURL, keyname, strings.ToLower(keyname), key))
+	if err != nil {
+		return errSending, nil
 	}
+	defer resp.Body.Close()
 
-	teardownTest(t)
+	if resp.StatusCode == http.StatusOK {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return errReading, nil
+		}
 
-	fmt.Printf("Test 'Notification' complete.\n")
+		err = json.Unmarshal(body, &el)
+		if err != nil {
+			return errUnmarshalling, nil
+		}
+	}
+	return resp.StatusCode, el
 }
 
-func TestJSONStorage(t *testing.T) {
+func TestHistoryVolatile (t *testing.T) {
+	fmt.Printf("Starting test TestHistoryVolatile.\n")
+	setupTest(t, "volatile")
+	subTestHistory(t)
+	teardownTest(t)
+	fmt.Printf("Test TestHistoryVolatile completed.\n");
+}
 
-	fmt.Printf("Starting test TestJSONStorage.\n")
+func TestHistoryJSON (t *testing.T) {
+	fmt.Printf("Starting test TestHistoryJSON.\n")
+	os.Remove(testfile + ".json.history")
+	setupTest(t, "json")
+	subTestHistory(t)
+	teardownTest(t)
 
-	var got string
+	// The history must survive a restart.
+	restartTest(t, "json")
+	resp, el := getHistoryReq(t, "MAC", "01:23:45:67:89:ab")
+	if resp != http.StatusOK {
+		handleError(t, resp, "getHistoryByMAC")
+	}
+	if len(el) != 5 {
+		t.Errorf("Unexpected number of events after restart (expected 5, got %d).", len(el))
+	}
+	teardownTest(t)
+	os.Remove(testfile + ".json.history")
+	fmt.Printf("Test TestHistoryJSON completed.\n");
+}
 
-	var filename = testfile + ".json"
+func TestHistorySQL (t *testing.T) {
+	fmt.Printf("Starting test TestHistorySQL.\n")
+	setupTest(t, "sqlite")
+	subTestHistory(t)
+	teardownTest(t)
+	fmt.Printf("Test TestHistorySQL completed.\n");
+}
 
-	// Create a fresh JSON file
-	os.Remove(filename)
-	setupTest(t, "json")
+func subTestHistory(t *testing.T) {
 
-	// Write one computer to file.
-	resp := addComputerReq(t, Computer {
-		MAC: "ba:ad:ba:ad:ba:ad",
-		Name: "UniqueText",
-		IP: "8.8.8.8",
-		Assignee: "foo",
-		Description: "More unique text",
-	})
+	var c = Computer {
+		MAC: "01:23:45:67:89:ab",
+		Name: "TestComputer",
+		IP: "172.1.0.1",
+		Assignee: "mmu",
+	}
+	resp := addComputerReq(t, c)
 	if resp != http.StatusCreated {
-		handleError(t, resp, "addCompuer")
+		handleError(t, resp, "addComputer")
 	}
 
-	// Read file
-	file, err := os.Open(filename)
+	// Reassign with an explicit actor, then unassign twice and delete.
+	body, _ := json.Marshal(Assignment { c.Name, "ima" })
+	client := &http.Client{}
+	req, _ := http.NewRequest(http.MethodPut, baseURL + "/assignComputerByName", bytes.NewBuffer(body))
+	req.Header.Set("X-Actor", "admin")
+	r, err := client.Do(req)
 	if err != nil {
-		t.Errorf("Error opening file %s", testfile)
+		t.Fatalf("Error sending assignComputerByName: %s", err.Error())
 	}
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		got += scanner.Text()
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		handleError(t, r.StatusCode, "assignComputerByName")
 	}
-	file.Close()
-
-	expected := `[{"mac":"ba:ad:ba:ad:ba:ad","name":"UniqueText","ip":"8.8.8.8","assignee":"foo","description":"More unique text"}]`
-
-	if got != expected {
-		t.Errorf("Unexpected contents of JSON test file:\nExpected: <%s>\nGot: <%s>\n", expected, got)
+	resp = unassignComputerByReq(t, "IP", c.IP)
+	if resp != http.StatusOK {
+		handleError(t, resp, "unassignComputerByIP")
 	}
-
-	// Destroy volatile storage
-	teardownTest(t)
-
-	// Reopen test file
-	setupTest(t, "json")
-
-	// Write one more computer to file.
-	resp = addComputerReq(t, Computer {
-		MAC: "de:ad:de:ad:de:ad",
-		Name: "UniqueText2",
-		IP: "9.9.9.9",
-		Assignee: "bar",
-		Description: "Even more unique text",
-	})
-	if resp != http.StatusCreated {
-		handleError(t, resp, "addCompuer")
+	resp = unassignComputerByReq(t, "IP", c.IP)
+	if resp != http.StatusOK {
+		handleError(t, resp, "unassignComputerByIP")
+	}
+	resp = assignComputerByReq(t, "MAC", c.MAC, "mmu")
+	if resp != http.StatusOK {
+		handleError(t, resp, "assignComputerByMAC")
+	}
+	resp = delComputerByReq(t, "MAC", c.MAC)
+	if resp != http.StatusOK {
+		handleError(t, resp, "deleteComputerByMAC")
 	}
 
-	// Read file
-	got = ""
-	file, err = os.Open(filename)
+	// The second unassignment changed nothing and isn't recorded.
+	resp, el := getHistoryReq(t, "MAC", c.MAC)
+	if resp != http.StatusOK {
+		handleError(t, resp, "getHistoryByMAC")
+	}
+	expected := [][2]string{ {"", "mmu"}, {"mmu", "ima"}, {"ima", ""}, {"", "mmu"}, {"mmu", ""} }
+	if len(el) != len(expected) {
+		t.Fatalf("Unexpected number of events (expected %d, got %d): %v", len(expected), len(el), el)
+	}
+	for n, e := range(el) {
+		if e.OldAssignee != expected[n][0] || e.NewAssignee != expected[n][1] || e.Name != c.Name {
+			t.Errorf("Unexpected event %d: %v", n, e)
+		}
+	}
+	if el[1].Actor != "admin" {
+		t.Errorf("Unexpected actor %s", el[1].Actor)
+	}
+
+	resp, el = getHistoryReq(t, "Assignee", "ima")
+	if resp != http.StatusOK {
+		handleError(t, resp, "getHistoryByAssignee")
+	}
+	if len(el) != 2 {
+		t.Errorf("Unexpected number of events for ima (expected 2, got %d).", len(el))
+	}
+
+	resp, _ = getHistoryReq(t, "Assignee", "zzz")
+	if resp != http.StatusNotFound {
+		t.Errorf("History of unknown employee returned %d", resp)
+	}
+}
+
+// jsonReq sends body, if any, as JSON and returns the response code.
+func jsonReq(t *testing.T, method, endpoint string, body interface{}) int {
+	fmt.Printf("Sending %s %s\n", method, endpoint)
+	reader := &bytes.Buffer{}
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return errMarshalling
+		}
+		reader = bytes.NewBuffer(jsonData)
+	}
+	req, err := http.NewRequest(method, baseURL + endpoint, reader)
 	if err != nil {
-		t.Errorf("Error opening file %s", testfile)
+		return errSending
 	}
-	scanner = bufio.NewScanner(file)
-	for scanner.Scan() {
-		got += scanner.Text()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errSending
 	}
-	file.Close()
+	resp.Body.Close()
+	return resp.StatusCode
+}
 
-	expected = `[{"mac":"ba:ad:ba:ad:ba:ad","name":"UniqueText","ip":"8.8.8.8","assignee":"foo","description":"More unique text"},{"mac":"de:ad:de:ad:de:ad","name":"UniqueText2","ip":"9.9.9.9","assignee":"bar","description":"Even more unique text"}]`
+func getEmployeeReq(t *testing.T, code string) (int, Employee) {
+	fmt.Printf("Getting employee %s\n", code)
+	var e Employee
+	resp, err := http.Get(baseURL + "/getEmployee?code=" + code)
+	if err != nil {
+		return errSending, e
+	}
+	defer resp.Body.Close()
 
-	if got != expected {
-		t.Errorf("Unexpected contents of JSON test file:\nExpected: <%s>\nGot: <%s>\n", expected, got)
+	if resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(&e)
+		if err != nil {
+			return errUnmarshalling, e
+		}
 	}
+	return resp.StatusCode, e
+}
 
+func TestEmployeesVolatile (t *testing.T) {
+	fmt.Printf("Starting test TestEmployeesVolatile.\n")
+	setupTest(t, "volatile")
+	subTestEmployees(t)
 	teardownTest(t)
+	fmt.Printf("Test TestEmployeesVolatile completed.\n");
+}
 
-	fmt.Printf("Test TestJSONStorage complete.\n")
+func TestEmployeesJSON (t *testing.T) {
+	fmt.Printf("Starting test TestEmployeesJSON.\n")
+	setupTest(t, "json")
+	subTestEmployees(t)
+	teardownTest(t)
+
+	// Employees must survive a restart.
+	restartTest(t, "json")
+	resp, e := getEmployeeReq(t, "jdo")
+	if resp != http.StatusOK {
+		handleError(t, resp, "getEmployee")
+	}
+	if e.Active || e.Department != "Sales" {
+		t.Errorf("Unexpected employee after restart: %v", e)
+	}
+	resp = jsonReq(t, http.MethodDelete, "/deleteEmployee?code=jdo", nil)
+	if resp != http.StatusOK {
+		handleError(t, resp, "deleteEmployee")
+	}
+	teardownTest(t)
+	fmt.Printf("Test TestEmployeesJSON completed.\n");
 }
 
-func TestSQLStorage(t *testing.T) {
+func TestEmployeesSQL (t *testing.T) {
+	fmt.Printf("Starting test TestEmployeesSQL.\n")
+	setupTest(t, "sqlite")
+	subTestEmployees(t)
+	teardownTest(t)
+	fmt.Printf("Test TestEmployeesSQL completed.\n");
+}
 
-	fmt.Printf("Starting test TestSQLStorage.\n")
+func subTestEmployees(t *testing.T) {
 
-	var filename = testfile + ".sqlite"
+	var e = Employee {
+		Code: "jdo",
+		FullName: "John Doe",
+		Email: "john.doe@example.com",
+		Department: "Engineering",
+	}
 
-	// Create a fresh JSON file
-	os.Remove(filename)
-	setupTest(t, "sqlite")
+	// Employees are active unless told otherwise.
+	resp := jsonReq(t, http.MethodPost, "/addEmployee", map[string]string{ "code": e.Code, "fullName": e.FullName, "email": e.Email, "department": e.Department })
+	if resp != http.StatusCreated {
+		handleError(t, resp, "addEmployee")
+	}
+	e.Active = true
+	resp, got := getEmployeeReq(t, e.Code)
+	if resp != http.StatusOK {
+		handleError(t, resp, "getEmployee")
+	}
+	if got != e {
+		t.Errorf("Unexpected employee (expected %v, got %v)", e, got)
+	}
+	resp = addEmployeeReq(t, e)
+	if resp != http.StatusConflict {
+		t.Errorf("Adding an existing employee returned %d", resp)
+	}
+	for _, bad := range([]Employee{ { Code: "jdoe", FullName: "X" }, { Code: "jd0", FullName: "X" }, { Code: "xyz" }, { Code: "xyz", FullName: "X", Email: "nope" } }) {
+		resp = addEmployeeReq(t, bad)
+		if resp != http.StatusBadRequest {
+			t.Errorf("Adding malformed employee %v returned %d", bad, resp)
+		}
+	}
 
-	// Write one computer to file.
-	resp := addComputerReq(t, Computer {
-		MAC: "ca:fe:ca:fe:ca:fe",
-		Name: "UniqueText",
-		IP: "8.8.8.8",
-		Assignee: "foo",
-		Description: "More unique text",
-	})
+	// Only known, active employees can get computers.
+	var c = Computer { MAC: "01:23:45:67:89:ab", Name: "TestComputer", IP: "172.1.0.1", Assignee: "mmU" }
+	resp = addComputerReq(t, c)
+	if resp != http.StatusBadRequest {
+		t.Errorf("Adding a computer for an unknown employee returned %d", resp)
+	}
+	c.Assignee = e.Code
+	resp = addComputerReq(t, c)
 	if resp != http.StatusCreated {
-		handleError(t, resp, "addCompuer")
+		handleError(t, resp, "addComputer")
+	}
+	resp = assignComputerByReq(t, "MAC", c.MAC, "zzz")
+	if resp != http.StatusBadRequest {
+		t.Errorf("Assigning to an unknown employee returned %d", resp)
 	}
 
-	// Read file
-	got, err := ioutil.ReadFile(filename)
+	// Employees with computers can't be deleted, but they can be deactivated.
+	resp = jsonReq(t, http.MethodDelete, "/deleteEmployee?code=" + e.Code, nil)
+	if resp != http.StatusConflict {
+		t.Errorf("Deleting an employee with computers returned %d", resp)
+	}
+	e.Active = false
+	e.Department = "Sales"
+	resp = jsonReq(t, http.MethodPut, "/updateEmployee", e)
+	if resp != http.StatusOK {
+		handleError(t, resp, "updateEmployee")
+	}
+	resp = unassignComputerByReq(t, "MAC", c.MAC)
+	if resp != http.StatusOK {
+		handleError(t, resp, "unassignComputerByMAC")
+	}
+	resp = assignComputerByReq(t, "MAC", c.MAC, e.Code)
+	if resp != http.StatusBadRequest {
+		t.Errorf("Assigning to an inactive employee returned %d", resp)
+	}
+	resp = jsonReq(t, http.MethodPut, "/updateEmployee", Employee{ Code: "nob", FullName: "Nobody" })
+	if resp != http.StatusNotFound {
+		t.Errorf("Updating an unknown employee returned %d", resp)
+	}
+
+	resp = delComputerByReq(t, "MAC", c.MAC)
+	if resp != http.StatusOK {
+		handleError(t, resp, "deleteComputerByMAC")
+	}
+	resp = jsonReq(t, http.MethodDelete, "/deleteEmployee?code=nob", nil)
+	if resp != http.StatusNotFound {
+		t.Errorf("Deleting an unknown employee returned %d", resp)
+	}
+}
+
+func TestEmployeeCodeFormat(t *testing.T) {
+
+	fmt.Printf("Starting test TestEmployeeCodeFormat.\n")
+
+	employeeCodeFormat = regexp.MustCompile("^[A-Z]{2}[0-9]{4}$")
+	defer func() { employeeCodeFormat = regexp.MustCompile(defaultEmployeeCodeFormat) }()
+
+	store := newVolatileStore()
+	err := store.AddEmployee(Employee{ Code: "mmu", FullName: "Old Style" })
+	if err != errMalformed {
+		t.Errorf("Employee with an old style code was added (%v)", err)
+	}
+	err = store.AddEmployee(Employee{ Code: "MU0042", FullName: "New Style", Active: true })
 	if err != nil {
-		t.Errorf("Error reading output file %s: %s", filename, err.Error())
-		return
+		t.Fatalf("Error adding employee: %s", err.Error())
+	}
+	// The handlers check assignees, so computers stored before the format
+	// changed can still be unassigned.
+	err = store.Add(Computer{ MAC: "01:23:45:67:89:ab", Name: "OldComputer", IP: "172.1.0.1", Assignee: "mmu" })
+	if err != nil {
+		t.Errorf("Error adding computer: %s", err.Error())
 	}
+	err = store.Assign(KeyMAC, "01:23:45:67:89:ab", "")
+	if err != nil {
+		t.Errorf("Error unassigning computer with an old style assignee: %s", err.Error())
+	}
+	err = store.Add(Computer{ MAC: "cd:ef:ba:ad:ca:fe", Name: "TestComputer", IP: "172.1.0.2", Assignee: "MU0042" })
+	if err != nil {
+		t.Errorf("Error adding computer: %s", err.Error())
+	}
+	err = checkAssignee(store, "MU0042")
+	if err != nil {
+		t.Errorf("Active employee rejected: %s", err.Error())
+	}
+	err = checkAssignee(store, "MU0043")
+	if err != errUnknownEmployee {
+		t.Errorf("Unknown employee accepted (%v)", err)
+	}
+
+	fmt.Printf("Test TestEmployeeCodeFormat complete.\n")
+}
 
-	// Read expected data
-	expectedFile := "expected1.sqlite"
-	expected, err := ioutil.ReadFile(expectedFile)
+func getArchivedComputersReq(t *testing.T) (int, []ArchivedComputer) {
+	fmt.Printf("Getting archived computers\n")
+	var al []ArchivedComputer
+	resp, err := http.Get(baseURL + "/getArchivedComputers")
 	if err != nil {
-		t.Errorf("Error reading expected output file %s: %s", expectedFile, err.Error())
-		return
+		return errSending, nil
 	}
+	defer resp.Body.Close()
 
-	// Compare
-	if len(got) != len(expected) {
-		t.Errorf("Output SQL file is not as expected (different size)")
-		return
+	if resp.StatusCode == http.StatusOK {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return errReading, nil
+		}
+
+		err = json.Unmarshal(body, &al)
+		if err != nil {
+			return errUnmarshalling, nil
+		}
 	}
+	return resp.StatusCode, al
+}
 
-	for i, b := range got {
-		if b != expected[i] {
-			t.Errorf("Output SQL file is not as expected (different content)")
-			return
+func archiveReq(t *testing.T, method, endpoint string) int {
+	fmt.Printf("Sending %s %s\n", method, endpoint)
+	req, err := http.NewRequest(method, baseURL + endpoint, nil)
+	if err != nil {
+		return errSending
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errSending
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// findArchived returns the latest archived computer with the given MAC.
+// Archives of the JSON tests outlive a single test, so IDs can't be assumed.
+func findArchived(t *testing.T, mac string) ArchivedComputer {
+	resp, al := getArchivedComputersReq(t)
+	if resp != http.StatusOK {
+		handleError(t, resp, "getArchivedComputers")
+	}
+	for n := len(al) - 1; n >= 0; n-- {
+		if al[n].MAC == mac {
+			return al[n]
 		}
 	}
+	t.Fatalf("Computer %s not found in archive: %v", mac, al)
+	return ArchivedComputer{}
+}
 
-	// Destroy volatile storage
+func TestArchiveVolatile (t *testing.T) {
+	fmt.Printf("Starting test TestArchiveVolatile.\n")
+	setupTest(t, "volatile")
+	subTestArchive(t)
 	teardownTest(t)
+	fmt.Printf("Test TestArchiveVolatile completed.\n");
+}
 
-	// Reopen test file
+func TestArchiveJSON (t *testing.T) {
+	fmt.Printf("Starting test TestArchiveJSON.\n")
+	setupTest(t, "json")
+	subTestArchive(t)
+	var c = Computer { MAC: "01:23:45:67:89:ae", Name: "KeptComputer", IP: "172.1.0.4", Assignee: "mmu" }
+	resp := addComputerReq(t, c)
+	if resp != http.StatusCreated {
+		handleError(t, resp, "addComputer")
+	}
+	resp = archiveReq(t, http.MethodDelete, "/deleteComputerByIP?ip=" + c.IP + "&reason=stolen")
+	if resp != http.StatusOK {
+		handleError(t, resp, "deleteComputerByIP")
+	}
+	teardownTest(t)
+
+	// The archive must survive a restart.
+	restartTest(t, "json")
+	a := findArchived(t, c.MAC)
+	if a.Reason != "stolen" || a.Assignee != "mmu" {
+		t.Errorf("Unexpected archived computer after restart: %v", a)
+	}
+	resp = archiveReq(t, http.MethodDelete, fmt.Sprintf("/purgeComputer?id=%d", a.ID))
+	if resp != http.StatusOK {
+		handleError(t, resp, "purgeComputer")
+	}
+	teardownTest(t)
+	fmt.Printf("Test TestArchiveJSON completed.\n");
+}
+
+func TestArchiveSQL (t *testing.T) {
+	fmt.Printf("Starting test TestArchiveSQL.\n")
 	setupTest(t, "sqlite")
+	subTestArchive(t)
+	teardownTest(t)
+	fmt.Printf("Test TestArchiveSQL completed.\n");
+}
 
-	// Write one more computer to file.
-	resp  = addComputerReq(t, Computer {
-		MAC: "de:ad:de:ad:de:ad",
-		Name: "UniqueText2",
-		IP: "9.9.9.9",
-		Assignee: "bar",
-		Description: "Even more unique text",
-	})
+func TestArchivedKeysBlock (t *testing.T) {
+	fmt.Printf("Starting test TestArchivedKeysBlock.\n")
+	setupTest(t, "volatile", "--archived-keys-block")
+
+	var c = Computer { MAC: "01:23:45:67:89:ab", Name: "TestComputer", IP: "172.1.0.1" }
+	resp := addComputerReq(t, c)
 	if resp != http.StatusCreated {
-		handleError(t, resp, "addCompuer")
+		handleError(t, resp, "addComputer")
+	}
+	resp = delComputerByReq(t, "MAC", c.MAC)
+	if resp != http.StatusOK {
+		handleError(t, resp, "deleteComputerByMAC")
+	}
+	resp = addComputerReq(t, Computer { MAC: "01:23:45:67:89:ac", Name: c.Name, IP: "172.1.0.2" })
+	if resp != http.StatusConflict {
+		t.Errorf("Adding a computer named like an archived one returned %d", resp)
 	}
 
-	// Read file
-	got, err = ioutil.ReadFile(filename)
-	if err != nil {
-		t.Errorf("Error reading output file %s: %s", filename, err.Error())
-		return
+	a := findArchived(t, c.MAC)
+	resp = archiveReq(t, http.MethodDelete, fmt.Sprintf("/purgeComputer?id=%d", a.ID))
+	if resp != http.StatusOK {
+		handleError(t, resp, "purgeComputer")
+	}
+	resp = addComputerReq(t, Computer { MAC: "01:23:45:67:89:ac", Name: c.Name, IP: "172.1.0.2" })
+	if resp != http.StatusCreated {
+		handleError(t, resp, "addComputer")
 	}
 
-	// Read expected data
-	expectedFile = "expected2.sqlite"
-	expected, err = ioutil.ReadFile(expectedFile)
-	if err != nil {
-		t.Errorf("Error reading expected output file %s: %s", expectedFile, err.Error())
-		return
+	teardownTest(t)
+	fmt.Printf("Test TestArchivedKeysBlock completed.\n");
+}
+
+func subTestArchive(t *testing.T) {
+
+	var c = Computer {
+		MAC: "01:23:45:67:89:ab",
+		Name: "TestComputer",
+		IP: "172.1.0.1",
+		Assignee: "mmu",
+		Description: "Written off in 2026",
+	}
+	resp := addComputerReq(t, c)
+	if resp != http.StatusCreated {
+		handleError(t, resp, "addComputer")
+	}
+	resp = archiveReq(t, http.MethodDelete, "/deleteComputerByName?name=" + c.Name + "&reason=broken")
+	if resp != http.StatusOK {
+		handleError(t, resp, "deleteComputerByName")
 	}
 
-	// Compare
-	if len(got) != len(expected) {
-		t.Errorf("Output SQL file is not as expected (different size)")
-		return
+	resp, _ = getComputerByReq(t, "MAC", c.MAC)
+	if resp != http.StatusNotFound {
+		t.Errorf("Archived computer is still active (%d)", resp)
+	}
+	a := findArchived(t, c.MAC)
+	if a.Computer != c || a.Reason != "broken" || a.Revision != 1 || a.Archived.IsZero() {
+		t.Errorf("Unexpected archived computer: %v", a)
 	}
 
-	for i, b := range got {
-		if b != expected[i] {
-			fmt.Println("Output SQL file is not as expected (different content)")
-			return
-		}
+	// The archived computer keeps its employee from being deleted, and
+	// can't be restored to them while they are inactive.
+	resp = jsonReq(t, http.MethodDelete, "/deleteEmployee?code=mmu", nil)
+	if resp != http.StatusConflict {
+		t.Errorf("Deleting the employee of an archived computer returned %d", resp)
+	}
+	mmu := Employee{ Code: "mmu", FullName: "Test mmu" }
+	resp = jsonReq(t, http.MethodPut, "/updateEmployee", mmu)
+	if resp != http.StatusOK {
+		handleError(t, resp, "updateEmployee")
+	}
+	resp = archiveReq(t, http.MethodPut, fmt.Sprintf("/restoreComputer?id=%d", a.ID))
+	if resp != http.StatusBadRequest {
+		t.Errorf("Restoring a computer of an inactive employee returned %d", resp)
+	}
+	mmu.Active = true
+	resp = jsonReq(t, http.MethodPut, "/updateEmployee", mmu)
+	if resp != http.StatusOK {
+		handleError(t, resp, "updateEmployee")
 	}
 
-	teardownTest(t)
+	// Archived keys don't block new computers by default, but then the
+	// archived one can't be restored.
+	var d = Computer { MAC: "01:23:45:67:89:ac", Name: c.Name, IP: "172.1.0.2" }
+	resp = addComputerReq(t, d)
+	if resp != http.StatusCreated {
+		handleError(t, resp, "addComputer")
+	}
+	resp = archiveReq(t, http.MethodPut, fmt.Sprintf("/restoreComputer?id=%d", a.ID))
+	if resp != http.StatusConflict {
+		t.Errorf("Restoring a conflicting computer returned %d", resp)
+	}
+	resp = delComputerByReq(t, "MAC", d.MAC)
+	if resp != http.StatusOK {
+		handleError(t, resp, "deleteComputerByMAC")
+	}
 
-	fmt.Printf("Test TestSQLStorage complete.\n")
+	resp = archiveReq(t, http.MethodPut, fmt.Sprintf("/restoreComputer?id=%d", a.ID))
+	if resp != http.StatusOK {
+		handleError(t, resp, "restoreComputer")
+	}
+	resp, restored := getComputerByReq(t, "MAC", c.MAC)
+	if resp != http.StatusOK {
+		handleError(t, resp, "getComputerByMAC")
+	}
+	if restored != c {
+		t.Errorf("Restored computer differs (expected %v, got %v)", c, restored)
+	}
+	resp, tag := getETagReq(t, "MAC", c.MAC)
+	if resp != http.StatusOK || tag != "\"2\"" {
+		t.Errorf("Unexpected ETag of restored computer: %s", tag)
+	}
+	resp = archiveReq(t, http.MethodPut, fmt.Sprintf("/restoreComputer?id=%d", a.ID))
+	if resp != http.StatusNotFound {
+		t.Errorf("Restoring twice returned %d", resp)
+	}
+
+	// Purging is permanent.
+	resp = archiveReq(t, http.MethodDelete, fmt.Sprintf("/purgeComputer?id=%d", findArchived(t, d.MAC).ID))
+	if resp != http.StatusOK {
+		handleError(t, resp, "purgeComputer")
+	}
+	resp = archiveReq(t, http.MethodDelete, fmt.Sprintf("/purgeComputer?id=%d", a.ID))
+	if resp != http.StatusNotFound {
+		t.Errorf("Purging a restored computer returned %d", resp)
+	}
+	resp = archiveReq(t, http.MethodDelete, "/purgeComputer?id=x")
+	if resp != http.StatusBadRequest {
+		t.Errorf("Purging an invalid id returned %d", resp)
+	}
+
+	resp = delComputerByReq(t, "MAC", c.MAC)
+	if resp != http.StatusOK {
+		handleError(t, resp, "deleteComputerByMAC")
+	}
+	a = findArchived(t, c.MAC)
+	resp = archiveReq(t, http.MethodDelete, fmt.Sprintf("/purgeComputer?id=%d", a.ID))
+	if resp != http.StatusOK {
+		handleError(t, resp, "purgeComputer")
+	}
+}
+
+// waitForOutput waits for the output of a server to catch up, notifications
+// being delivered in the background. It returns the contents of buf once
+// they equal expected, or after a few seconds.
+func waitForOutput(buf *bytes.Buffer, expected string) string {
+	for i := 0; i < 50 && buf.String() != expected; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return buf.String()
+}
+
+// listenerNotifications waits until DummyListener has received count
+// notifications matching query, and returns those it has.
+func listenerNotifications(t *testing.T, query string, count int) []Notification {
+	var nl []Notification
+	var err error
+	for i := 0; i < 50; i++ {
+		var r *http.Response
+		r, err = http.Get(listenerBaseURL + "/api/notifications" + query)
+		if err == nil {
+			nl = nil
+			json.NewDecoder(r.Body).Decode(&nl)
+			r.Body.Close()
+			if len(nl) >= count {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Errorf("Error querying DummyListener: %s", err.Error())
+	}
+	return nl
+}
+
+// checkOverAssignment checks that n warns that emp has count computers,
+// over limit.
+func checkOverAssignment(t *testing.T, n Notification, emp string, count, limit int) {
+	expected := fmt.Sprintf("Over-assignment warning: Employee %s is now assigned %d computers (limit %d).", emp, count, limit)
+	if n.Level != "Warning" || n.Type != typeOverAssignment || n.Employee != emp || n.Count != count || n.Limit != limit ||
+		len(n.Computers) != count || n.Message != expected {
+		t.Errorf("Expected a warning that %s has %d computers over %d, got %v", emp, count, limit, n)
+	}
+}
+
+func TestNotification(t *testing.T) {
+
+	fmt.Printf("Starting test 'Notification'\n")
+
+	setupTest(t, "volatile")
+
+	// Add three computers, assigned to the same person
+	for i := 0; i < 3; i ++ {
+		resp := addComputerReq(t,  Computer{
+			        MAC: fmt.Sprintf("0%d:2%d:4%d:6%d:8%d:a%d",i,i,i,i,i,i),
+				Name: fmt.Sprintf("TestComputer%d", i),
+				IP: fmt.Sprintf("172.1.0.%d", i),
+				Assignee: "mmu",
+				Description: "",
+			})
+
+	        if resp != http.StatusCreated {
+		        handleError(t, resp, "addComputer")
+		}
+	}
+
+	// Loooking for the warning from SampDB and the DummyListener
+	expectedSampDB := startLine(sampDBPort) + `Warning: Employee [mmu] has been assigned 3 computers!
+`
+
+	if waitForOutput(&outSampDBBuf, expectedSampDB) != expectedSampDB {
+		t.Errorf("Expected SampDB output:\n%q\nBut got: %s",
+				expectedSampDB, outSampDBBuf.String())
+	}
+	if nl := listenerNotifications(t, "", 1); len(nl) != 1 {
+		t.Errorf("Expected 1 notification, got %v", nl)
+	} else {
+		checkOverAssignment(t, nl[0], "mmu", 3, 2)
+	}
+
+	// Reset output buffers
+	outSampDBBuf.Reset()
+
+	// Adding three non-assigned computers
+	for i := 3; i < 6; i ++ {
+		resp := addComputerReq(t,  Computer{
+			        MAC: fmt.Sprintf("0%d:2%d:4%d:6%d:8%d:a%d",i,i,i,i,i,i),
+				Name: fmt.Sprintf("TestComputer%d", i),
+				IP: fmt.Sprintf("172.1.0.%d", i),
+				Assignee: "",
+				Description: "",
+			})
+
+	        if resp != http.StatusCreated {
+		        handleError(t, resp, "addComputer")
+		}
+	}
+
+	// Assigning computers to the same user
+	resp := assignComputerByReq(t, "MAC", "03:23:43:63:83:a3", "ima")
+	if resp != http.StatusOK {
+		handleError(t, resp, "assignComputerByMAC")
+	}
+	resp = assignComputerByReq(t, "Name", "TestComputer4", "ima")
+	if resp != http.StatusOK {
+		handleError(t, resp, "assignComputerByName")
+	}
+	resp = assignComputerByReq(t, "IP", "172.1.0.5", "ima")
+	if resp != http.StatusOK {
+		handleError(t, resp, "assignComputerByIP")
+	}
+
+	// Loooking for the warnings from SampDB and the DummyListener
+	expectedSampDB = startLine(sampDBPort) + `Warning: Employee [mmu] has been assigned 3 computers!
+Warning: Employee [ima] has been assigned 3 computers!
+`
+
+	if waitForOutput(&outSampDBBuf, expectedSampDB) != expectedSampDB {
+		t.Errorf("Expected SampDB output:\n%q\nBut got: %s",
+				expectedSampDB, outSampDBBuf.String())
+	}
+	if nl := listenerNotifications(t, "?employee=ima", 1); len(nl) != 1 {
+		t.Errorf("Expected 1 notification for ima, got %v", nl)
+	} else {
+		checkOverAssignment(t, nl[0], "ima", 3, 2)
+	}
+	if nl := listenerNotifications(t, "", 2); len(nl) != 2 {
+		t.Errorf("Expected 2 notifications, got %v", nl)
+	}
+
+	// A repeat is suppressed, and doesn't print the warning again.
+	resp = assignComputerByReq(t, "IP", "172.1.0.5", "ima")
+	if resp != http.StatusOK {
+		handleError(t, resp, "assignComputerByIP")
+	}
+	var el []OutboxEntry
+	r, err := http.Get(baseURL + "/getSuppressedNotifications?employee=ima")
+	if err == nil {
+		json.NewDecoder(r.Body).Decode(&el)
+		r.Body.Close()
+	}
+	if len(el) != 1 {
+		t.Errorf("Expected 1 suppressed notification for ima, got %v (%v)", el, err)
+	}
+	if outSampDBBuf.String() != expectedSampDB {
+		t.Errorf("Expected SampDB output:\n%q\nBut got: %s",
+				expectedSampDB, outSampDBBuf.String())
+	}
+
+	for i := 0; i < 6; i ++ {
+		resp = delComputerByReq(t, "Name", fmt.Sprintf("TestComputer%d", i))
+		if resp != http.StatusOK {
+			handleError(t, resp, "deleteComputerByMAC")
+		}
+	}
+
+	teardownTest(t)
+
+	fmt.Printf("Test 'Notification' complete.\n")
+}
+
+func TestNotificationListenerDown(t *testing.T) {
+
+	fmt.Printf("Starting test TestNotificationListenerDown.\n")
+
+	setupTest(t, "volatile")
+
+	// Stop the listener. Adding computers must succeed nonetheless.
+	DummyListener.Process.Kill()
+	DummyListener.Wait()
+	for i := 0; i < 3; i ++ {
+		resp := addComputerReq(t, benchComputer(i, "mmu"))
+		if resp != http.StatusCreated {
+			handleError(t, resp, "addComputer")
+		}
+	}
+
+	// Once the listener is back, the warning is delivered by a retry.
+	startDummyListener(t, listenerPort)
+	if nl := listenerNotifications(t, "", 1); len(nl) != 1 {
+		t.Errorf("Expected 1 notification, got %v", nl)
+	} else {
+		checkOverAssignment(t, nl[0], "mmu", 3, 2)
+	}
+
+	teardownTest(t)
+	fmt.Printf("Test TestNotificationListenerDown complete.\n")
+}
+
+func TestDummyListener(t *testing.T) {
+
+	fmt.Printf("Starting test TestDummyListener.\n")
+
+	setupTest(t, "volatile")
+
+	for _, n := range([]string{
+		`{"level": "Info", "employeeAbbreviation": "mmu", "message": "first"}`,
+		`{"level": "warning", "employeeAbbreviation": "ima", "message": "second"}`,
+		`{"level": "Warning", "employeeAbbreviation": "mmu", "message": "third", "version": 2, "type": "over-assignment", "count": 3, "limit": 2}`,
+		`{"level": "Fatal", "employeeAbbreviation": "mmu", "message": "unknown level"}`,
+	}) {
+		r, err := http.Post(listenerBaseURL + "/api/notify", "application/json", strings.NewReader(n))
+		if err != nil {
+			t.Fatalf("Error sending notification: %s", err.Error())
+		}
+		r.Body.Close()
+	}
+
+	nl := listenerNotifications(t, "", 3)
+	if len(nl) != 3 || nl[0].Message != "first" || nl[2].Count != 3 || nl[2].Type != typeOverAssignment {
+		t.Errorf("Unexpected notifications: %v", nl)
+	}
+	if nl = listenerNotifications(t, "?level=WARNING", 2); len(nl) != 2 || nl[0].Message != "second" {
+		t.Errorf("Unexpected warnings: %v", nl)
+	}
+	if nl = listenerNotifications(t, "?level=warning&employee=mmu", 1); len(nl) != 1 || nl[0].Message != "third" {
+		t.Errorf("Unexpected warnings for mmu: %v", nl)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, listenerBaseURL + "/api/notifications", nil)
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error resetting DummyListener: %s", err.Error())
+	}
+	r.Body.Close()
+	if nl = listenerNotifications(t, "", 0); r.StatusCode != http.StatusOK || len(nl) != 0 {
+		t.Errorf("Notifications were not reset (%d): %v", r.StatusCode, nl)
+	}
+	r, err = http.Post(listenerBaseURL + "/api/notifications", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Error sending to DummyListener: %s", err.Error())
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST to the notifications returned %d", r.StatusCode)
+	}
+
+	// Failing to start shows in the exit status: 2 for invalid arguments,
+	// 1 for a port that is taken.
+	for _, c := range([]struct{ args []string; status int }{
+		{ []string{ "--failure-rate", "2" }, 2 },
+		{ []string{ "--port", strconv.Itoa(listenerPort) }, 1 },
+	}) {
+		out, err := exec.Command("../DummyListener/DummyListener", c.args...).CombinedOutput()
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != c.status {
+			t.Errorf("Expected DummyListener %v to exit with %d, got %v: %s", c.args, c.status, err, out)
+		}
+	}
+
+	teardownTest(t)
+	fmt.Printf("Test TestDummyListener complete.\n")
+}
+
+// setFaults scripts the answers of DummyListener.
+func setFaults(t *testing.T, faults string) int {
+	req, _ := http.NewRequest(http.MethodPut, listenerBaseURL + "/api/faults", strings.NewReader(faults))
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error setting DummyListener faults: %s", err.Error())
+	}
+	r.Body.Close()
+	return r.StatusCode
+}
+
+// waitForDelivery waits until the last notification in the outbox of SampDB
+// is no longer pending, or until its attempts reach attempts, and returns it.
+func waitForDelivery(t *testing.T, attempts int) OutboxEntry {
+	var last OutboxEntry
+	for i := 0; i < 100; i++ {
+		var el []OutboxEntry
+		r, err := http.Get(baseURL + "/getNotifications")
+		if err == nil {
+			json.NewDecoder(r.Body).Decode(&el)
+			r.Body.Close()
+		}
+		if len(el) > 0 {
+			last = el[len(el) - 1]
+			if last.Status != outboxPending || last.Attempts >= attempts {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return last
+}
+
+func TestListenerFaults(t *testing.T) {
+
+	fmt.Printf("Starting test TestListenerFaults.\n")
+
+	setupTest(t, "volatile", "--notify-timeout", "500ms")
+
+	if code := setFaults(t, `{"failureRate": 2}`); code != http.StatusBadRequest {
+		t.Errorf("Invalid failure rate was accepted (%d)", code)
+	}
+
+	for i, c := range([]struct{ faults string; attempts int; code int; lastError string }{
+		// Fail twice, then succeed.
+		{ `{"sequence": [{"status": 500}, {"status": 500}]}`, 3, http.StatusCreated, "" },
+		// 200 instead of 201 is fine.
+		{ `{"status": 200}`, 1, http.StatusOK, "" },
+		{ `{"sequence": [{"reset": true}]}`, 2, http.StatusCreated, "" },
+		// Slower than the timeout of SampDB.
+		{ `{"sequence": [{"delay": "2s"}]}`, 2, http.StatusCreated, "" },
+		{ `{"failureRate": 1}`, 1, http.StatusInternalServerError, "listener returned 500" },
+	}) {
+		if code := setFaults(t, c.faults); code != http.StatusOK {
+			t.Fatalf("Error setting faults %s (%d)", c.faults, code)
+		}
+		resp := addComputerReq(t, benchComputer(i + 2, "mmu"))
+		if resp != http.StatusCreated {
+			handleError(t, resp, "addComputer")
+		}
+		if i == 0 {
+			resp = addComputerReq(t, benchComputer(0, "mmu"))
+			if resp != http.StatusCreated {
+				handleError(t, resp, "addComputer")
+			}
+			resp = addComputerReq(t, benchComputer(1, "mmu"))
+			if resp != http.StatusCreated {
+				handleError(t, resp, "addComputer")
+			}
+		}
+		e := waitForDelivery(t, c.attempts)
+		if e.Notification.Count != i + 3 || e.Attempts != c.attempts || e.ResponseCode != c.code || e.LastError != c.lastError {
+			t.Errorf("Unexpected delivery with faults %s: %v", c.faults, e)
+		}
+	}
+
+	teardownTest(t)
+	fmt.Printf("Test TestListenerFaults complete.\n")
+}
+
+func TestSignedNotification(t *testing.T) {
+
+	fmt.Printf("Starting test TestSignedNotification.\n")
+
+	// Both SampDB and DummyListener get the secret from the environment.
+	const secret = "test-secret"
+	os.Setenv("SAMPDB_NOTIFY_SECRET", secret)
+	defer os.Unsetenv("SAMPDB_NOTIFY_SECRET")
+	setupTest(t, "volatile")
+
+	for i := 0; i < 3; i++ {
+		resp := addComputerReq(t, benchComputer(i, "mmu"))
+		if resp != http.StatusCreated {
+			handleError(t, resp, "addComputer")
+		}
+	}
+	if nl := listenerNotifications(t, "", 1); len(nl) != 1 {
+		t.Errorf("Expected 1 notification, got %v", nl)
+	} else {
+		checkOverAssignment(t, nl[0], "mmu", 3, 2)
+	}
+
+	body := []byte(`{"level": "Warning", "employeeAbbreviation": "mmu", "message": "forged"}`)
+	now := fmt.Sprint(time.Now().Unix())
+	stale := fmt.Sprint(time.Now().Add(-time.Hour).Unix())
+	for _, c := range([]struct{ timestamp, signature string }{
+		{ "", "" },
+		{ now, sign("wrong-secret", now, body) },
+		{ now, sign(secret, now, []byte(`{"level": "Warning"}`)) },
+		{ stale, sign(secret, stale, body) },
+	}) {
+		req, _ := http.NewRequest(http.MethodPost, listenerBaseURL + "/api/notify", bytes.NewBuffer(body))
+		req.Header.Set(timestampHeader, c.timestamp)
+		req.Header.Set(signatureHeader, c.signature)
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending notification: %s", err.Error())
+		}
+		r.Body.Close()
+		if r.StatusCode != http.StatusUnauthorized {
+			t.Errorf("DummyListener accepted %v with %d", c, r.StatusCode)
+		}
+	}
+	if nl := listenerNotifications(t, "", 0); len(nl) != 1 {
+		t.Errorf("DummyListener recorded a forged notification: %v", nl)
+	}
+
+	teardownTest(t)
+	fmt.Printf("Test TestSignedNotification complete.\n")
+}
+
+func TestOutbox(t *testing.T) {
+
+	fmt.Printf("Starting test TestOutbox.\n")
+
+	// The listener fails twice, then accepts everything.
+	var calls int
+	listener := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer listener.Close()
+
+	savedStore, savedNotifiers, savedAttempts := dataStore, notifiers, outboxMaxAttempts
+	defer func() { dataStore, notifiers, outboxMaxAttempts = savedStore, savedNotifiers, savedAttempts }()
+	dataStore = newVolatileStore()
+	notifiers = []*sink{ { defaultNotifierName, 0, false, &webhookNotifier{ url: listener.URL } } }
+	outboxMaxAttempts = 3
+
+	dataAccess.Lock()
+	err := enqueueNotification(Notification{ Level: "Warning", Employee: "mmu", Message: "first" })
+	dataAccess.Unlock()
+	if err != nil {
+		t.Fatalf("Error queuing notification: %s", err.Error())
+	}
+
+	now := time.Now().UTC()
+	next := deliverDue(now)
+	if !next.Equal(now.Add(outboxBackoff)) {
+		t.Errorf("Unexpected first retry at %v", next)
+	}
+	if deliverDue(now); calls != 1 {
+		t.Errorf("Notification was retried before its backoff (%d calls)", calls)
+	}
+	next = deliverDue(next)
+	if !next.Equal(now.Add(outboxBackoff).Add(2 * outboxBackoff)) {
+		t.Errorf("Backoff didn't double, next retry at %v", next)
+	}
+	if next = deliverDue(next); !next.IsZero() {
+		t.Errorf("Delivered notification is still pending")
+	}
+	_, el := dataStore.ReadOutbox("")
+	if len(el) != 1 || el[0].Status != outboxDelivered || el[0].Attempts != 3 {
+		t.Errorf("Unexpected outbox after delivery: %v", el)
+	}
+
+	// A notification that keeps failing ends up failed.
+	calls = -10
+	dataAccess.Lock()
+	enqueueNotification(Notification{ Level: "Warning", Employee: "mmu", Message: "second" })
+	dataAccess.Unlock()
+	for i := 0; i < outboxMaxAttempts; i++ {
+		now = now.Add(time.Hour)
+		deliverDue(now)
+	}
+	_, el = dataStore.ReadOutbox(outboxFailed)
+	if len(el) != 1 || el[0].Notification.Message != "second" || el[0].LastError != "listener returned 500" {
+		t.Errorf("Unexpected failed notifications: %v", el)
+	}
+	failed := el[0]
+	if failed.ResponseCode != http.StatusInternalServerError || failed.Attempts != outboxMaxAttempts {
+		t.Errorf("Unexpected failed notification: %v", failed)
+	}
+
+	// Failed notifications can be listed and resent, and get one more attempt.
+	request := func(handler http.HandlerFunc, method, target string) (int, []byte) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(method, target, nil))
+		return rec.Code, rec.Body.Bytes()
+	}
+	code, body := request(getNotifications, http.MethodGet, "/getNotifications?status=failed&employee=mmu")
+	json.Unmarshal(body, &el)
+	if code != http.StatusOK || len(el) != 1 || el[0].ID != failed.ID {
+		t.Errorf("Unexpected failed notifications: %d %s", code, body)
+	}
+	if code, _ = request(getNotifications, http.MethodGet, "/getNotifications?status=lost"); code != http.StatusBadRequest {
+		t.Errorf("Invalid status was accepted (%d)", code)
+	}
+	if code, _ = request(getNotifications, http.MethodGet, "/getNotifications?employee=ima"); code != http.StatusNotFound {
+		t.Errorf("Unexpected notifications for ima (%d)", code)
+	}
+	target := fmt.Sprintf("/resendNotification?id=%d", failed.ID)
+	for _, c := range([]struct{ target string; code int }{
+		{ target, http.StatusOK },
+		{ target, http.StatusConflict },
+		{ "/resendNotification?id=1", http.StatusConflict },
+		{ "/resendNotification?id=99", http.StatusNotFound },
+	}) {
+		if code, body = request(resendNotification, http.MethodPut, c.target); code != c.code {
+			t.Errorf("%s returned %d: %s", c.target, code, body)
+		}
+	}
+	deliverDue(now.Add(time.Minute))
+	var resent OutboxEntry
+	code, body = request(getNotification, http.MethodGet, fmt.Sprintf("/getNotification?id=%d", failed.ID))
+	json.Unmarshal(body, &resent)
+	if code != http.StatusOK || resent.Status != outboxFailed || resent.Attempts != outboxMaxAttempts + 1 {
+		t.Errorf("Unexpected notification after failed resend: %d %s", code, body)
+	}
+	calls = 10
+	request(resendNotification, http.MethodPut, target)
+	deliverDue(now.Add(time.Minute))
+	code, body = request(getNotification, http.MethodGet, fmt.Sprintf("/getNotification?id=%d", failed.ID))
+	resent = OutboxEntry{}
+	json.Unmarshal(body, &resent)
+	if resent.Status != outboxDelivered || resent.ResponseCode != http.StatusCreated || resent.LastError != "" {
+		t.Errorf("Unexpected notification after resend: %s", body)
+	}
+
+	// A notification that can't be queued for every notifier isn't queued
+	// for any.
+	dataStore = &failingOutbox{ newVolatileStore(), new(int) }
+	notifiers = []*sink{
+		{ "first", 0, false, &webhookNotifier{ url: listener.URL } },
+		{ "second", 0, false, &webhookNotifier{ url: listener.URL } },
+	}
+	dataAccess.Lock()
+	err = enqueueNotification(Notification{ Level: "Warning", Employee: "mmu", Message: "partial" })
+	dataAccess.Unlock()
+	if err != errWritingDB {
+		t.Errorf("Unexpected error queuing a notification: %v", err)
+	}
+	if err, el := dataStore.ReadOutbox(""); err != errNotFound {
+		t.Errorf("Notification was queued for some notifiers: %v", el)
+	}
+
+	fmt.Printf("Test TestOutbox complete.\n")
+}
+
+// failingOutbox fails to add the second outbox entry it's given.
+type failingOutbox struct {
+	dataInterface
+	added	*int
+}
+
+func (f *failingOutbox) AddOutbox (e OutboxEntry) (error, int) {
+	*f.added++
+	if *f.added == 2 {
+		return errWritingDB, 0
+	}
+	return f.dataInterface.AddOutbox(e)
+}
+
+func (f *failingOutbox) WithTx (fn func(dataInterface) error) error {
+	return f.dataInterface.WithTx(func(tx dataInterface) error {
+		return fn(&failingOutbox{ tx, f.added })
+	})
+}
+
+func TestSuppression(t *testing.T) {
+
+	fmt.Printf("Starting test TestSuppression.\n")
+
+	savedStore, savedNotifiers, savedLast := dataStore, notifiers, lastNotified
+	defer func() { dataStore, notifiers, lastNotified = savedStore, savedNotifiers, savedLast }()
+	dataStore = newVolatileStore()
+	notifiers = []*sink{ { defaultNotifierName, 0, false, &webhookNotifier{ url: "http://localhost:1/" } } }
+	lastNotified = make(map[string]notified)
+
+	assigned := func(count int) []Computer {
+		var cl []Computer
+		for i := 0; i < count; i++ {
+			cl = append(cl, benchComputer(i, ""))
+		}
+		return cl
+	}
+	for _, count := range([]int{ 3, 3, 4, 4, 3 }) {
+		notify("mmu", assigned(count), 2)
+	}
+	notify("ima", assigned(3), 2)
+	_, pending := dataStore.ReadOutbox(outboxPending)
+	_, el := dataStore.ReadOutbox(outboxSuppressed)
+	if len(pending) != 3 || len(el) != 3 || el[0].Notification.Employee != "mmu" ||
+		!strings.Contains(el[2].Notification.Message, "assigned 3 computers") {
+		t.Errorf("Unexpected notifications: %v sent, %v suppressed", pending, el)
+	}
+
+	// After the window, or back within the limit, repeats are sent again.
+	last := lastNotified[notifiedKey("mmu", typeOverAssignment)]
+	last.at = last.at.Add(-notifyWindow)
+	lastNotified[notifiedKey("mmu", typeOverAssignment)] = last
+	notify("mmu", assigned(4), 2)
+	forgetNotified("ima", typeOverAssignment)
+	notify("ima", assigned(3), 2)
+	if _, pending = dataStore.ReadOutbox(outboxPending); len(pending) != 5 {
+		t.Errorf("Repeats were suppressed: %v", pending)
+	}
+
+	rec := httptest.NewRecorder()
+	getSuppressedNotifications(rec, httptest.NewRequest(http.MethodGet, "/getSuppressedNotifications?employee=mmu", nil))
+	json.NewDecoder(rec.Body).Decode(&el)
+	if rec.Code != http.StatusOK || len(el) != 3 || el[0].Status != outboxSuppressed {
+		t.Errorf("Unexpected suppressed notifications for mmu: %d %v", rec.Code, el)
+	}
+	rec = httptest.NewRecorder()
+	getSuppressedNotifications(rec, httptest.NewRequest(http.MethodGet, "/getSuppressedNotifications?employee=ima", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Unexpected suppressed notifications for ima: %d", rec.Code)
+	}
+
+	fmt.Printf("Test TestSuppression complete.\n")
+}
+
+func TestDigest(t *testing.T) {
+
+	fmt.Printf("Starting test TestDigest.\n")
+
+	savedStore, savedNotifiers := dataStore, notifiers
+	defer func() { dataStore, notifiers = savedStore, savedNotifiers }()
+	dataStore = newVolatileStore()
+	notifiers = []*sink {
+		{ "now", 0, false, &webhookNotifier{ url: "http://localhost:1/" } },
+		{ "daily", 0, true, &webhookNotifier{ url: "http://localhost:1/" } },
+	}
+
+	now := time.Date(2024, 3, 10, 8, 0, 0, 0, time.UTC)
+	since := now.AddDate(0, 0, -1)
+	for i, assignee := range([]string{ "mmu", "mmu", "mmu", "ima", "", "", "", "" }) {
+		dataStore.Add(benchComputer(i, assignee))
+	}
+	// Computer 4 was returned long ago, computer 5 yesterday, computer 6
+	// was added long ago and never assigned, and computer 7 was just added.
+	for _, e := range([]struct{ i int; from, to string; at time.Time }{
+		{ 4, "ima", "", now.AddDate(0, -2, 0) },
+		{ 5, "abc", "", now.Add(-time.Hour) },
+		{ 3, "", "ima", now.AddDate(0, 0, -3) },
+		{ 6, "", "", now.AddDate(0, 0, -40) },
+		{ 7, "", "", now.Add(-time.Minute) },
+	}) {
+		event := newEvent(benchComputer(e.i, e.from), e.to, "admin")
+		event.Time = e.at
+		dataStore.AddEvent(event)
+	}
+
+	dataAccess.Lock()
+	err, msg, level := buildDigest(dataStore, since, now)
+	dataAccess.Unlock()
+	if err != nil {
+		t.Fatalf("Error building digest: %s", err.Error())
+	}
+	for _, expected := range([]string{
+		"Employees over their limit:\n  mmu: 3 computers (default limit 2)\n\n",
+		"Computers unassigned for more than 30 days:\n  TestComputer4 (00:00:04:00:00:00, 10.0.0.4): since 2024-01-10\n  TestComputer6 (00:00:06:00:00:00, 10.0.0.6): never assigned, added 2024-01-30\n\n",
+		"Changes since the previous digest:\n  " + now.Add(-time.Hour).Local().Format("2006-01-02 15:04") + " TestComputer5 (00:00:05:00:00:00): abc -> unassigned, by admin\n",
+		"  " + now.Add(-time.Minute).Local().Format("2006-01-02 15:04") + " TestComputer7 (00:00:07:00:00:00): added unassigned, by admin\n",
+	}) {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("Digest doesn't contain %q:\n%s", expected, msg)
+		}
+	}
+	if level != "Warning" || strings.Contains(msg, "TestComputer3") || strings.Contains(msg, "TestComputer7 (00:00:07:00:00:00, 10.0.0.7)") {
+		t.Errorf("Unexpected digest (%s):\n%s", level, msg)
+	}
+
+	// Only the notifier in digest mode gets the digest, and only it doesn't
+	// get single notifications.
+	dataAccess.Lock()
+	enqueueDigest(since, now)
+	enqueueNotification(Notification{ Level: "Warning", Employee: "mmu", Message: "single" })
+	dataAccess.Unlock()
+	_, el := dataStore.ReadOutbox(outboxPending)
+	if len(el) != 2 || el[0].Sink != "daily" || el[0].Notification.Message != msg || el[1].Sink != "now" {
+		t.Errorf("Unexpected outbox: %v", el)
+	}
+
+	digestAt = 8 * time.Hour
+	if next := nextDigest(now.Add(-time.Minute)); !next.Equal(now) {
+		t.Errorf("Unexpected next digest %v", next)
+	}
+	if next := nextDigest(now); !next.Equal(now.AddDate(0, 0, 1)) {
+		t.Errorf("Unexpected next digest %v", next)
+	}
+
+	fmt.Printf("Test TestDigest complete.\n")
+}
+
+func TestNotificationSchema(t *testing.T) {
+
+	fmt.Printf("Starting test TestNotificationSchema.\n")
+
+	savedTemplates := templates
+	defer func() { templates = savedTemplates }()
+
+	cl := []Computer{ benchComputer(0, "mmu"), benchComputer(1, "mmu"), benchComputer(2, "mmu") }
+	n := overAssignment("mmu", cl, 2)
+	if n.Version != notificationVersion || n.Type != typeOverAssignment || n.Count != 3 || n.Limit != 2 ||
+		len(n.Computers) != 3 || n.Computers[1] != (ComputerKeys{ cl[1].MAC, cl[1].Name, cl[1].IP }) ||
+		len(n.ID) != 32 || n.Time.IsZero() ||
+		n.Message != "Over-assignment warning: Employee mmu is now assigned 3 computers (limit 2)." {
+		t.Errorf("Unexpected notification: %v", n)
+	}
+
+	var filename = testfile + "-templates.json"
+	defer os.Remove(filename)
+	ioutil.WriteFile(filename, []byte(`{"over-assignment": "{{.Employee}} has {{.Count}}/{{.Limit}}: {{range .Computers}}{{.Name}} {{end}}"}`), 0666)
+	err := loadTemplates(filename)
+	if err != nil {
+		t.Fatalf("Error loading templates: %s", err.Error())
+	}
+	if n = overAssignment("mmu", cl[:2], 1); n.Message != "mmu has 2/1: TestComputer0 TestComputer1 " {
+		t.Errorf("Unexpected message: %q", n.Message)
+	}
+	for _, tl := range([]string{ `{"over-assignment": "{{.Employe}}"}`, `{"over-assignment": "{{"}`, `{"birthday": "Happy birthday"}` }) {
+		ioutil.WriteFile(filename, []byte(tl), 0666)
+		if err = loadTemplates(filename); !errors.Is(err, errInvalidTemplate) {
+			t.Errorf("Invalid templates %s were loaded (%v)", tl, err)
+		}
+	}
+
+	// A CloudEvents webhook gets the notification in an envelope.
+	var contentType string
+	var event map[string]interface{}
+	listener := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&event)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer listener.Close()
+	err, sl := newSinks([]NotifierConfig{ { Type: "webhook", URL: listener.URL, Format: "cloudevents" } })
+	if err != nil {
+		t.Fatalf("Error configuring webhook: %s", err.Error())
+	}
+	err, _ = sl[0].notifier.Notify(n)
+	if err != nil {
+		t.Fatalf("Error sending notification: %s", err.Error())
+	}
+	data, _ := event["data"].(map[string]interface{})
+	if contentType != cloudEventsContentType || event["specversion"] != "1.0" || event["id"] != n.ID ||
+		event["type"] != "sampdb.over-assignment.v2" || event["subject"] != "mmu" ||
+		data == nil || data["count"] != 2.0 || data["employeeAbbreviation"] != "mmu" {
+		t.Errorf("Unexpected event (%s): %v", contentType, event)
+	}
+	if err, _ = newSinks([]NotifierConfig{ { Type: "webhook", URL: listener.URL, Format: "xml" } }); !errors.Is(err, errInvalidNotifier) {
+		t.Errorf("Webhook with an unknown format was configured (%v)", err)
+	}
+
+	fmt.Printf("Test TestNotificationSchema complete.\n")
+}
+
+func TestChatAdapters(t *testing.T) {
+
+	fmt.Printf("Starting test TestChatAdapters.\n")
+
+	var received map[string]interface{}
+	listener := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = nil
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer listener.Close()
+
+	savedURL := publicURL
+	defer func() { publicURL = savedURL }()
+	publicURL = "https://sampdb.example.com/"
+
+	cl := []Computer{ benchComputer(0, "mmu"), benchComputer(1, "mmu"), benchComputer(2, "mmu") }
+	cl[1].Name = "<lab> & [spare]"
+	n := overAssignment("mmu", cl, 2)
+	link := "https://sampdb.example.com/getComputerByMAC?mac=00%3A00%3A00%3A00%3A00%3A00"
+
+	send := func(format string, mentions map[string]string) string {
+		err, sl := newSinks([]NotifierConfig{ { Type: "webhook", URL: listener.URL, Format: format, Mentions: mentions } })
+		if err != nil {
+			t.Fatalf("Error configuring %s webhook: %s", format, err.Error())
+		}
+		err, _ = sl[0].notifier.Notify(n)
+		if err != nil {
+			t.Fatalf("Error sending %s notification: %s", format, err.Error())
+		}
+		text, _ := received["text"].(string)
+		return text
+	}
+
+	text := send(formatSlack, map[string]string{ "mmu": "U024BE7LH" })
+	blocks, _ := received["blocks"].([]interface{})
+	for _, expected := range([]string{
+		"*:warning: SampDB Warning* · <@U024BE7LH>\nOver-assignment warning: Employee mmu",
+		"\n• <" + link + "|TestComputer0> (00:00:00:00:00:00, 10.0.0.0)",
+		"|&lt;lab&gt; &amp; [spare]>",
+	}) {
+		if !strings.Contains(text, expected) {
+			t.Errorf("Slack text doesn't contain %q: %q", expected, text)
+		}
+	}
+	if len(blocks) != 1 {
+		t.Errorf("Unexpected Slack blocks: %v", blocks)
+	}
+	if text = send(formatSlack, nil); !strings.Contains(text, "* · *mmu*\n") {
+		t.Errorf("Unexpected Slack text without mentions: %q", text)
+	}
+
+	text = send(formatMattermost, map[string]string{ "mmu": "mmueller" })
+	for _, expected := range([]string{
+		"**:warning: SampDB Warning** · @mmueller\nOver-assignment warning",
+		"\n• [TestComputer0](" + link + ") (00:00:00:00:00:00, 10.0.0.0)",
+		"[<lab> & \\[spare\\]](",
+	}) {
+		if !strings.Contains(text, expected) {
+			t.Errorf("Mattermost text doesn't contain %q: %q", expected, text)
+		}
+	}
+	if received["username"] != "SampDB" {
+		t.Errorf("Unexpected Mattermost payload: %v", received)
+	}
+
+	send(formatTeams, map[string]string{ "mmu": "mmu@example.com" })
+	var card struct {
+		Type		string `json:"type"`
+		Attachments	[]struct {
+			ContentType	string `json:"contentType"`
+			Content		struct {
+				Type	string `json:"type"`
+				Body	[]struct {
+					Text	string `json:"text"`
+					Color	string `json:"color"`
+				} `json:"body"`
+				MSTeams	struct {
+					Entities	[]struct {
+						Text		string `json:"text"`
+						Mentioned	struct {
+							ID	string `json:"id"`
+						} `json:"mentioned"`
+					} `json:"entities"`
+				} `json:"msteams"`
+			} `json:"content"`
+		} `json:"attachments"`
+	}
+	data, _ := json.Marshal(received)
+	json.Unmarshal(data, &card)
+	if card.Type != "message" || len(card.Attachments) != 1 || card.Attachments[0].ContentType != "application/vnd.microsoft.card.adaptive" ||
+		card.Attachments[0].Content.Type != "AdaptiveCard" || len(card.Attachments[0].Content.Body) != 1 {
+		t.Fatalf("Unexpected Teams payload: %s", data)
+	}
+	content := card.Attachments[0].Content
+	if !strings.HasPrefix(content.Body[0].Text, "**SampDB Warning** · <at>mmu</at>\n\nOver-assignment warning") ||
+		!strings.Contains(content.Body[0].Text, "\n\n• [TestComputer0](" + link + ")") || content.Body[0].Color != "warning" ||
+		len(content.MSTeams.Entities) != 1 || content.MSTeams.Entities[0].Text != "<at>mmu</at>" || content.MSTeams.Entities[0].Mentioned.ID != "mmu@example.com" {
+		t.Errorf("Unexpected Teams card: %s", data)
+	}
+
+	fmt.Printf("Test TestChatAdapters complete.\n")
+}
+
+// smtpStandIn accepts one connection on l, plays an SMTP server and sends
+// the message it got to mail.
+func smtpStandIn(l net.Listener, mail chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	in := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "220 localhost\r\n")
+	var data strings.Builder
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(strings.Fields(line + " x")[0]) {
+		case "DATA":
+			fmt.Fprintf(conn, "354 go ahead\r\n")
+			for {
+				line, err = in.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			mail <- data.String()
+			fmt.Fprintf(conn, "250 ok\r\n")
+		case "QUIT":
+			fmt.Fprintf(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprintf(conn, "250 ok\r\n")
+		}
+	}
+}
+
+func TestNotifiers(t *testing.T) {
+
+	fmt.Printf("Starting test TestNotifiers.\n")
+
+	var webhook []Notification
+	listener := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		json.NewDecoder(r.Body).Decode(&n)
+		webhook = append(webhook, n)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer listener.Close()
+
+	smtpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting SMTP stand-in: %s", err.Error())
+	}
+	defer smtpListener.Close()
+	mail := make(chan string, 1)
+	go smtpStandIn(smtpListener, mail)
+
+	syslogListener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting syslog stand-in: %s", err.Error())
+	}
+	defer syslogListener.Close()
+
+	var filename = testfile + "-notifications.jsonl"
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	config, _ := json.Marshal([]NotifierConfig {
+		{ Type: "webhook", URL: listener.URL },
+		{ Name: "oncall", Type: "smtp", Level: "Error", Address: smtpListener.Addr().String(), From: "sampdb@example.com", To: []string{ "oncall@example.com" } },
+		{ Type: "syslog", Level: "warning", Network: "udp", Address: syslogListener.LocalAddr().String(), Tag: "SampDB-test" },
+		{ Type: "file", Path: filename },
+	})
+	var configFile = testfile + "-notifiers.json"
+	defer os.Remove(configFile)
+	ioutil.WriteFile(configFile, config, 0666)
+
+	savedStore, savedNotifiers := dataStore, notifiers
+	defer func() { dataStore, notifiers = savedStore, savedNotifiers }()
+	dataStore = newVolatileStore()
+	err, notifiers = loadNotifiers(configFile)
+	if err != nil {
+		t.Fatalf("Error loading notifiers: %s", err.Error())
+	}
+
+	dataAccess.Lock()
+	enqueueNotification(Notification{ Level: "Info", Employee: "mmu", Message: "info" })
+	enqueueNotification(Notification{ Level: "Warning", Employee: "mmu", Message: "warning" })
+	enqueueNotification(Notification{ Level: "Error", Employee: "mmu", Message: "error", Type: typeOverAssignment })
+	dataAccess.Unlock()
+
+	_, el := dataStore.ReadOutbox(outboxPending)
+	if len(el) != 3 + 2 + 1 + 3 {
+		t.Errorf("Unexpected outbox: %v", el)
+	}
+	deliverDue(time.Now().UTC())
+	_, el = dataStore.ReadOutbox(outboxDelivered)
+	if len(el) != 9 {
+		t.Errorf("Undelivered notifications: %v", el)
+	}
+
+	if len(webhook) != 3 || webhook[2].Message != "error" {
+		t.Errorf("Unexpected webhook notifications: %v", webhook)
+	}
+	select {
+	case m := <-mail:
+		if !strings.Contains(m, "To: oncall@example.com") || !strings.Contains(m, "Subject: SampDB Error: over-assignment of mmu") || !strings.Contains(m, "\r\n\r\nerror\r\n") {
+			t.Errorf("Unexpected email: %q", m)
+		}
+	default:
+		t.Errorf("No email received")
+	}
+	buf := make([]byte, 1024)
+	var logged []string
+	syslogListener.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, _, err := syslogListener.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		logged = append(logged, string(buf[:n]))
+	}
+	// The priority of daemon warnings is 28, of daemon errors 27.
+	if len(logged) != 2 || !strings.HasPrefix(logged[0], "<28>") || !strings.HasSuffix(logged[0], "SampDB-test[" + fmt.Sprint(os.Getpid()) + "]: warning\n") || !strings.HasPrefix(logged[1], "<27>") {
+		t.Errorf("Unexpected syslog messages: %q", logged)
+	}
+	data, _ := ioutil.ReadFile(filename)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var n Notification
+	if len(lines) != 3 || json.Unmarshal([]byte(lines[0]), &n) != nil || n.Level != "Info" || n.Message != "info" {
+		t.Errorf("Unexpected file notifications: %q", lines)
+	}
+
+	for _, c := range([]string{
+		`[{"type": "pager"}]`,
+		`[{"type": "file"}]`,
+		`[{"type": "webhook", "url": "http://localhost", "level": "Fatal"}]`,
+		`[{"type": "file", "path": "a"}, {"type": "file", "path": "b"}]`,
+	}) {
+		ioutil.WriteFile(configFile, []byte(c), 0666)
+		if err, _ := loadNotifiers(configFile); !errors.Is(err, errInvalidNotifier) {
+			t.Errorf("Invalid notifiers %s were loaded (%v)", c, err)
+		}
+	}
+
+	fmt.Printf("Test TestNotifiers complete.\n")
+}
+
+func TestOutboxJSON(t *testing.T) {
+
+	fmt.Printf("Starting test TestOutboxJSON.\n")
+
+	var store dataInterface
+	var filename = testfile + "-outbox.json"
+	for _, suffix := range([]string{"", ".outbox", ".history"}) {
+		os.Remove(filename + suffix)
+		defer os.Remove(filename + suffix)
+	}
+
+	err := initJSON(&store, filename)
+	if err != nil {
+		t.Fatalf("Error initializing JSON storage: %s", err.Error())
+	}
+	now := time.Now().UTC()
+	for _, msg := range([]string{ "first", "second" }) {
+		err, _ = store.AddOutbox(OutboxEntry{ Notification: Notification{ Level: "Warning", Employee: "mmu", Message: msg }, Status: outboxPending, NextAttempt: now, Created: now })
+		if err != nil {
+			t.Fatalf("Error adding outbox entry: %s", err.Error())
+		}
+	}
+	_, el := store.ReadOutbox(outboxPending)
+	el[0].Status = outboxDelivered
+	el[0].Attempts = 1
+	// Delivery attempts only rewrite the outbox, not the computers.
+	os.Remove(filename)
+	err = store.UpdateOutbox(el[0])
+	if err != nil {
+		t.Fatalf("Error updating outbox entry: %s", err.Error())
+	}
+	if _, err := os.Stat(filename); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Updating the outbox rewrote %s (%v)", filename, err)
+	}
+	store.Close()
+	err = ioutil.WriteFile(filename, []byte("[]"), 0666)
+	if err != nil {
+		t.Fatalf("Error writing %s: %s", filename, err.Error())
+	}
+
+	err = initJSON(&store, filename)
+	if err != nil {
+		t.Fatalf("Error reopening JSON storage: %s", err.Error())
+	}
+	err, el = store.ReadOutbox(outboxPending)
+	if err != nil || len(el) != 1 || el[0].ID != 2 || el[0].Notification.Message != "second" {
+		t.Errorf("Unexpected pending entries after reopening: %v (%v)", el, err)
+	}
+	err, el = store.ReadOutbox("")
+	if err != nil || len(el) != 2 || el[0].Attempts != 1 {
+		t.Errorf("Unexpected entries after reopening: %v (%v)", el, err)
+	}
+	store.Close()
+
+	fmt.Printf("Test TestOutboxJSON complete.\n")
+}
+
+func TestConfig(t *testing.T) {
+
+	fmt.Printf("Starting test TestConfig.\n")
+
+	var filename = testfile + "-config.json"
+	defer os.Remove(filename)
+	err := ioutil.WriteFile(filename, []byte(`{"storage": {"type": "json", "journal": true}, "server": {"port": 1000, "basePath": "/sampdb/"},
+		"notifications": {"listenerURL": "http://listener/notify", "secret": "s3cret", "window": "10m",
+			"notifiers": [{"type": "webhook", "url": "http://hooks/", "password": "pa55"}]}}`), 0666)
+	if err != nil {
+		t.Fatalf("Error writing config: %s", err.Error())
+	}
+
+	// Defaults < file < environment < flags.
+	os.Setenv("SAMPDB_PORT", "2000")
+	defer os.Unsetenv("SAMPDB_PORT")
+	for _, c := range([]struct{ file string; flags []configFlag; port int }{
+		{ "", nil, 2000 },
+		{ filename, nil, 2000 },
+		{ filename, []configFlag{ { "port", "3000" } }, 3000 },
+	}) {
+		err, config := resolveConfig(c.file, c.flags)
+		if err != nil || config.Server.Port != c.port {
+			t.Errorf("Expected port %d from %v, got %d (%v)", c.port, c, config.Server.Port, err)
+		}
+	}
+	os.Unsetenv("SAMPDB_PORT")
+	err, config := resolveConfig(filename, nil)
+	if err != nil || config.Server.Port != 1000 || config.Server.BasePath != "/sampdb" ||
+		config.Server.Address != "" || config.Notifications.ListenerURL != "http://listener/notify" ||
+		!config.Storage.Journal || config.Notifications.Window != Duration(10 * time.Minute) ||
+		config.Notifications.Timeout != Duration(notifyTimeout) || config.Policies.QuotaMode != quotaWarn {
+		t.Errorf("Unexpected config from %s: %v (%v)", filename, config, err)
+	}
+	if err = config.validate(); err != nil {
+		t.Errorf("Unexpected problems with %s: %s", filename, err.Error())
+	}
+
+	// Notifiers can't be listed both in place and in a file.
+	err, config = resolveConfig(filename, []configFlag{ { "notifiers", "notifiers.json" } })
+	if err == nil {
+		err = config.validate()
+	}
+	if !errors.Is(err, errInvalidConfig) || !strings.Contains(err.Error(), "\n  notifications.notifiers: ") {
+		t.Errorf("Expected notifiers in both places to be refused, got %v", err)
+	}
+
+	if err, _ := resolveConfig("", []configFlag{ { "port", "http" } }); !errors.Is(err, errInvalidConfig) {
+		t.Errorf("Expected a port that isn't a number to be refused, got %v", err)
+	}
+	err, config = resolveConfig("", []configFlag{
+		{ "storage-type", "paper" },
+		{ "port", "65536" },
+		{ "base-path", "sampdb" },
+		{ "listener-url", "localhost:8080" },
+		{ "notify-timeout", "0s" },
+		{ "digest-at", "8am" },
+		{ "quota-mode", "strict" },
+	})
+	err = config.validate()
+	if !errors.Is(err, errInvalidConfig) {
+		t.Errorf("Expected invalid settings to be refused, got %v", err)
+	} else {
+		for _, key := range([]string{ "storage.type", "server.port", "server.basePath", "notifications.listenerURL",
+			"notifications.timeout", "notifications.digest.at", "policies.quotaMode" }) {
+			if !strings.Contains(err.Error(), "\n  " + key + ": ") {
+				t.Errorf("Expected a problem with %s, got %s", key, err.Error())
+			}
+		}
+	}
+
+	err = ioutil.WriteFile(filename, []byte(`{"server": {"prot": 1000}}`), 0666)
+	if err != nil {
+		t.Fatalf("Error writing config: %s", err.Error())
+	}
+	if err, _ := resolveConfig(filename, nil); !errors.Is(err, errInvalidConfig) {
+		t.Errorf("Expected unknown settings to be refused, got %v", err)
+	}
+
+	// The API is served under the base path only.
+	setupTest(t, "volatile", "--base-path", "/sampdb")
+	for url, expected := range(map[string]int{
+		baseURL + "/getEmployee?code=mmu": http.StatusOK,
+		fmt.Sprintf("http://localhost:%d/getEmployee?code=mmu", sampDBPort): http.StatusNotFound,
+	}) {
+		r, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("Error getting %s: %s", url, err.Error())
+		}
+		r.Body.Close()
+		if r.StatusCode != expected {
+			t.Errorf("Expected %d for %s, got %d", expected, url, r.StatusCode)
+		}
+	}
+	teardownTest(t)
+
+	// --print-config shows the merged settings, without their secrets.
+	err = ioutil.WriteFile(filename, []byte(`{"storage": {"type": "json"}, "server": {"port": 1000},
+		"notifications": {"secret": "s3cret", "notifiers": [{"type": "webhook", "url": "http://hooks/", "password": "pa55"}]}}`), 0666)
+	if err != nil {
+		t.Fatalf("Error writing config: %s", err.Error())
+	}
+	cmd := exec.Command("./SampDB", "--print-config", "--port", "3000")
+	cmd.Env = append(os.Environ(), "SAMPDB_CONFIG=" + filename, "SAMPDB_PORT=2000", "SAMPDB_QUOTA_MODE=enforce")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Error printing the config: %s", err.Error())
+	}
+	var printed Config
+	err = json.Unmarshal(out, &printed)
+	if err != nil || printed.Storage.Type != "json" || printed.Server.Port != 3000 || printed.Policies.QuotaMode != quotaEnforce ||
+		strings.Contains(string(out), "s3cret") || strings.Contains(string(out), "pa55") {
+		t.Errorf("Unexpected config printed: %s", out)
+	}
+
+	cmd = exec.Command("./SampDB", "--config", filename, "--print-config", "--quota-mode", "strict")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err == nil || !strings.Contains(stderr.String(), "policies.quotaMode: 'strict'") {
+		t.Errorf("Expected the invalid quota mode to be reported, got %v: %s", err, stderr.String())
+	}
+
+	fmt.Printf("Test TestConfig complete.\n")
+}
+
+func TestShutdown(t *testing.T) {
+
+	fmt.Printf("Starting test TestShutdown.\n")
+
+	filename := testfile + ".json"
+	defer os.Remove(filename + ".journal")
+	setupTest(t, "json", "--journal", "--shutdown-timeout", "5s")
+
+	// The port is taken, which SampDB reports.
+	out, err := exec.Command("./SampDB", "--storage-type", "volatile", "--port", strconv.Itoa(sampDBPort)).CombinedOutput()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 || !strings.Contains(string(out), "address already in use") {
+		t.Errorf("Expected SampDB to fail listening on a taken port, got %v: %s", err, out)
+	}
+
+	// A notification the listener missed is pending when SampDB is stopped.
+	DummyListener.Process.Kill()
+	DummyListener.Wait()
+	for i := 0; i < 3; i++ {
+		resp := addComputerReq(t, benchComputer(i, "mmu"))
+		if resp != http.StatusCreated {
+			handleError(t, resp, "addComputer")
+		}
+	}
+	if e := waitForDelivery(t, 1); e.Status != outboxPending || e.Attempts != 1 {
+		t.Errorf("Expected a pending notification, got %v", e)
+	}
+	startDummyListener(t, listenerPort)
+
+	// It's delivered on the way out, and the journal is folded into the
+	// JSON file.
+	err = stopSampDB()
+	if err != nil {
+		t.Errorf("SampDB didn't stop cleanly: %s", err.Error())
+	}
+	if !strings.Contains(outSampDBBuf.String(), "Received terminated, shutting down...\nSampDB stopped.\n") {
+		t.Errorf("Unexpected SampDB output: %s", outSampDBBuf.String())
+	}
+	if nl := listenerNotifications(t, "", 1); len(nl) != 1 {
+		t.Errorf("Expected 1 notification, got %v", nl)
+	} else {
+		checkOverAssignment(t, nl[0], "mmu", 3, 2)
+	}
+	if info, err := os.Stat(filename + ".journal"); err != nil || info.Size() != 0 {
+		t.Errorf("Expected an empty journal, got %v (%v)", info, err)
+	}
+	DummyListener.Process.Kill()
+	DummyListener.Wait()
+
+	restartTest(t, "json")
+	if e := waitForDelivery(t, 2); e.Status != outboxDelivered || e.Notification.Employee != "mmu" {
+		t.Errorf("Expected the notification to be delivered, got %v", e)
+	}
+	for i := 0; i < 3; i++ {
+		resp := delComputerByReq(t, "MAC", benchComputer(i, "mmu").MAC)
+		if resp != http.StatusOK {
+			handleError(t, resp, "deleteComputerByMAC")
+		}
+	}
+	teardownTest(t)
+
+	fmt.Printf("Test TestShutdown complete.\n")
+}
+
+func TestPolicies(t *testing.T) {
+
+	fmt.Printf("Starting test TestPolicies.\n")
+
+	var filename = testfile + "-policies.json"
+	defer os.Remove(filename)
+	err := ioutil.WriteFile(filename, []byte(`{"default": 2, "departments": {"Engineering": 4}, "employees": {"ima": 1}}`), 0666)
+	if err != nil {
+		t.Fatalf("Error writing policies: %s", err.Error())
+	}
+	setupTest(t, "volatile", "--policies", "../SampDB/" + filename)
+
+	resp := addEmployeeReq(t, Employee{ Code: "dev", FullName: "Developer", Department: "Engineering", Active: true })
+	if resp != http.StatusCreated {
+		handleError(t, resp, "addEmployee")
+	}
+	for code, expected := range(map[string]EffectivePolicy{
+		"ima": { "ima", "", 1, "employee" },
+		"dev": { "dev", "Engineering", 4, "department" },
+		"mmu": { "mmu", "", 2, "default" },
+	}) {
+		var got EffectivePolicy
+		r, err := http.Get(baseURL + "/getEffectivePolicy?employee=" + code)
+		if err != nil {
+			t.Fatalf("Error sending getEffectivePolicy: %s", err.Error())
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		r.Body.Close()
+		if got != expected {
+			t.Errorf("Unexpected policy for %s (expected %v, got %v)", code, expected, got)
+		}
+	}
+
+	// Four computers are fine for a developer, two are too many for ima.
+	for i := 0; i < 4; i++ {
+		resp = addComputerReq(t, benchComputer(i, "dev"))
+		if resp != http.StatusCreated {
+			handleError(t, resp, "addComputer")
+		}
+	}
+	for i := 4; i < 6; i++ {
+		resp = addComputerReq(t, benchComputer(i, "ima"))
+		if resp != http.StatusCreated {
+			handleError(t, resp, "addComputer")
+		}
+	}
+	if nl := listenerNotifications(t, "", 1); len(nl) != 1 {
+		t.Errorf("Expected 1 notification, got %v", nl)
+	} else {
+		checkOverAssignment(t, nl[0], "ima", 2, 1)
+	}
+
+	// Changes are checked, and saved to the policy file.
+	resp = jsonReq(t, http.MethodPut, "/updatePolicies", PolicySet{ Default: -1 })
+	if resp != http.StatusBadRequest {
+		t.Errorf("Negative default limit was accepted (%d)", resp)
+	}
+	updated := PolicySet{ Default: 3, Employees: map[string]int{ "dev": 5 } }
+	resp = jsonReq(t, http.MethodPut, "/updatePolicies", updated)
+	if resp != http.StatusOK {
+		handleError(t, resp, "updatePolicies")
+	}
+	var saved PolicySet
+	data, _ := ioutil.ReadFile(filename)
+	err = json.Unmarshal(data, &saved)
+	if err != nil || saved.Default != 3 || saved.Employees["dev"] != 5 || len(saved.Departments) != 0 {
+		t.Errorf("Unexpected policy file after update: %s (%v)", data, err)
+	}
+
+	teardownTest(t)
+	fmt.Printf("Test TestPolicies complete.\n")
+}
+
+func TestQuota(t *testing.T) {
+
+	fmt.Printf("Starting test TestQuota.\n")
+
+	setupTest(t, "volatile", "--quota-mode", "enforce")
+
+	for i := 0; i < 3; i++ {
+		resp := addComputerReq(t, benchComputer(i, ""))
+		if resp != http.StatusCreated {
+			handleError(t, resp, "addComputer")
+		}
+	}
+	resp := assignComputerByReq(t, "MAC", benchComputer(0, "").MAC, "mmu")
+	if resp != http.StatusOK {
+		handleError(t, resp, "assignComputerByMAC")
+	}
+	resp = addComputerReq(t, benchComputer(3, "mmu"))
+	if resp != http.StatusCreated {
+		handleError(t, resp, "addComputer")
+	}
+
+	// A third computer is refused, with an explanation.
+	body, _ := json.Marshal(benchComputer(4, "mmu"))
+	r, err := http.Post(baseURL + "/addComputer", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("Error sending addComputer: %s", err.Error())
+	}
+	var explanation map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&explanation)
+	r.Body.Close()
+	if r.StatusCode != http.StatusConflict || explanation["employee"] != "mmu" || explanation["limit"] != 2.0 || explanation["assigned"] != 3.0 || explanation["source"] != "default" {
+		t.Errorf("Unexpected response to over-quota addComputer: %d %v", r.StatusCode, explanation)
+	}
+	resp = assignComputerByReq(t, "Name", benchComputer(1, "").Name, "mmu")
+	if resp != http.StatusConflict {
+		t.Errorf("Over-quota assignComputerByName returned %d", resp)
+	}
+	resp, _ = getComputerByReq(t, "MAC", benchComputer(4, "").MAC)
+	if resp != http.StatusNotFound {
+		t.Errorf("Refused computer was added anyway")
+	}
+
+	// Reassigning a computer the employee already has is no increase.
+	resp = assignComputerByReq(t, "MAC", benchComputer(0, "").MAC, "mmu")
+	if resp != http.StatusOK {
+		handleError(t, resp, "assignComputerByMAC")
+	}
+
+	// Forcing works, and is recorded.
+	req, _ := http.NewRequest(http.MethodPut, baseURL + "/assignComputerByIP?force=true", bytes.NewBuffer([]byte(`{"key": "` + benchComputer(2, "").IP + `", "assignee": "mmu"}`)))
+	req.Header.Set("X-Actor", "admin")
+	r, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending assignComputerByIP: %s", err.Error())
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		handleError(t, r.StatusCode, "assignComputerByIP")
+	}
+	var overrides []AssignmentEvent
+	r, err = http.Get(baseURL + "/getQuotaOverrides?employee=mmu")
+	if err != nil {
+		t.Fatalf("Error sending getQuotaOverrides: %s", err.Error())
+	}
+	json.NewDecoder(r.Body).Decode(&overrides)
+	r.Body.Close()
+	if len(overrides) != 1 || overrides[0].Actor != "admin" || overrides[0].IP != benchComputer(2, "").IP ||
+		overrides[0].Override != "quota override: 3 computers, default limit 2" {
+		t.Errorf("Unexpected overrides: %v", overrides)
+	}
+	r, err = http.Get(baseURL + "/getQuotaOverrides?employee=ima")
+	if err != nil {
+		t.Fatalf("Error sending getQuotaOverrides: %s", err.Error())
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusNotFound {
+		t.Errorf("Overrides found for ima (%d)", r.StatusCode)
+	}
+
+	// Restoring an assigned computer is assigning it again.
+	resp = delComputerByReq(t, "MAC", benchComputer(3, "").MAC)
+	if resp != http.StatusOK {
+		handleError(t, resp, "deleteComputerByMAC")
+	}
+	a := findArchived(t, benchComputer(3, "").MAC)
+	resp = archiveReq(t, http.MethodPut, fmt.Sprintf("/restoreComputer?id=%d", a.ID))
+	if resp != http.StatusConflict {
+		t.Errorf("Over-quota restoreComputer returned %d", resp)
+	}
+	resp = archiveReq(t, http.MethodPut, fmt.Sprintf("/restoreComputer?id=%d&force=true", a.ID))
+	if resp != http.StatusOK {
+		handleError(t, resp, "restoreComputer")
+	}
+	overrides = nil
+	r, err = http.Get(baseURL + "/getQuotaOverrides?employee=mmu")
+	if err != nil {
+		t.Fatalf("Error sending getQuotaOverrides: %s", err.Error())
+	}
+	json.NewDecoder(r.Body).Decode(&overrides)
+	r.Body.Close()
+	if len(overrides) != 2 || overrides[1].MAC != a.MAC || overrides[1].Override != "quota override: 3 computers, default limit 2" {
+		t.Errorf("Unexpected overrides after restoring: %v", overrides)
+	}
+
+	teardownTest(t)
+	fmt.Printf("Test TestQuota complete.\n")
+}
+
+func TestJSONStorage(t *testing.T) {
+
+	fmt.Printf("Starting test TestJSONStorage.\n")
+
+	var got string
+
+	var filename = testfile + ".json"
+
+	// Create a fresh JSON file
+	os.Remove(filename)
+	setupTest(t, "json")
+
+	// Write one computer to file.
+	resp := addComputerReq(t, Computer {
+		MAC: "ba:ad:ba:ad:ba:ad",
+		Name: "UniqueText",
+		IP: "8.8.8.8",
+		Assignee: "foo",
+		Description: "More unique text",
+	})
+	if resp != http.StatusCreated {
+		handleError(t, resp, "addCompuer")
+	}
+
+	// Read file
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Errorf("Error opening file %s", testfile)
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		got += scanner.Text()
+	}
+	file.Close()
+
+	expected := `[{"mac":"ba:ad:ba:ad:ba:ad","name":"UniqueText","ip":"8.8.8.8","assignee":"foo","description":"More unique text","revision":1}]`
+
+	if got != expected {
+		t.Errorf("Unexpected contents of JSON test file:\nExpected: <%s>\nGot: <%s>\n", expected, got)
+	}
+
+	// Destroy volatile storage
+	teardownTest(t)
+
+	// Reopen test file
+	restartTest(t, "json")
+
+	// Write one more computer to file.
+	resp = addComputerReq(t, Computer {
+		MAC: "de:ad:de:ad:de:ad",
+		Name: "UniqueText2",
+		IP: "9.9.9.9",
+		Assignee: "bar",
+		Description: "Even more unique text",
+	})
+	if resp != http.StatusCreated {
+		handleError(t, resp, "addCompuer")
+	}
+
+	// Read file
+	got = ""
+	file, err = os.Open(filename)
+	if err != nil {
+		t.Errorf("Error opening file %s", testfile)
+	}
+	scanner = bufio.NewScanner(file)
+	for scanner.Scan() {
+		got += scanner.Text()
+	}
+	file.Close()
+
+	expected = `[{"mac":"ba:ad:ba:ad:ba:ad","name":"UniqueText","ip":"8.8.8.8","assignee":"foo","description":"More unique text","revision":1},{"mac":"de:ad:de:ad:de:ad","name":"UniqueText2","ip":"9.9.9.9","assignee":"bar","description":"Even more unique text","revision":1}]`
+
+	if got != expected {
+		t.Errorf("Unexpected contents of JSON test file:\nExpected: <%s>\nGot: <%s>\n", expected, got)
+	}
+
+	teardownTest(t)
+
+	fmt.Printf("Test TestJSONStorage complete.\n")
+}
+
+// readSQLFile returns the computers stored in an SQLite file along with its
+// schema version (0 for files that predate schema_version).
+// sqlTableDefinition returns the CREATE TABLE statement of table.
+func sqlTableDefinition(t *testing.T, filename, table string) string {
+	data, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatalf("Error opening SQL file %s: %s", filename, err.Error())
+	}
+	defer data.Close()
+
+	var def string
+	err = data.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&def)
+	if err != nil {
+		t.Fatalf("Error reading the definition of %s: %s", table, err.Error())
+	}
+	return def
+}
+
+func readSQLFile(t *testing.T, filename string) ([]Computer, int) {
+	data, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatalf("Error opening SQL file %s: %s", filename, err.Error())
+	}
+	defer data.Close()
+
+	rows, err := data.Query("SELECT MAC, Name, IP, Assignee, Description FROM computers ORDER BY MAC")
+	if err != nil {
+		t.Fatalf("Error reading SQL file %s: %s", filename, err.Error())
+	}
+	defer rows.Close()
+
+	var cl []Computer
+	for rows.Next() {
+		var c Computer
+		var assignee, description sql.NullString
+		err = rows.Scan(&c.MAC, &c.Name, &c.IP, &assignee, &description)
+		if err != nil {
+			t.Fatalf("Error reading SQL file %s: %s", filename, err.Error())
+		}
+		c.Assignee = assignee.String
+		c.Description = description.String
+		cl = append(cl, c)
+	}
+
+	version := 0
+	data.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+
+	return cl, version
+}
+
+func compareSQLFiles(t *testing.T, filename, expectedFile string) {
+	got, version := readSQLFile(t, filename)
+	expected, _ := readSQLFile(t, expectedFile)
+
+	if version != sqlMigrations[len(sqlMigrations)-1].version {
+		t.Errorf("Output SQL file has schema version %d", version)
+	}
+	if len(got) != len(expected) {
+		t.Errorf("Output SQL file is not as expected (%d computers instead of %d)", len(got), len(expected))
+		return
+	}
+	for i := range(got) {
+		if got[i] != expected[i] {
+			t.Errorf("Output SQL file is not as expected (%v != %v)", got[i], expected[i])
+		}
+	}
+}
+
+func TestSQLStorage(t *testing.T) {
+
+	fmt.Printf("Starting test TestSQLStorage.\n")
+
+	var filename = testfile + ".sqlite"
+
+	// Create a fresh SQL file
+	os.Remove(filename)
+	setupTest(t, "sqlite")
+
+	// Write one computer to file.
+	resp := addComputerReq(t, Computer {
+		MAC: "ca:fe:ca:fe:ca:fe",
+		Name: "UniqueText",
+		IP: "8.8.8.8",
+		Assignee: "foo",
+		Description: "More unique text",
+	})
+	if resp != http.StatusCreated {
+		handleError(t, resp, "addCompuer")
+	}
+
+	compareSQLFiles(t, filename, "expected1.sqlite")
+
+	// Destroy volatile storage
+	teardownTest(t)
+
+	// Reopen test file
+	restartTest(t, "sqlite")
+
+	// Write one more computer to file.
+	resp  = addComputerReq(t, Computer {
+		MAC: "de:ad:de:ad:de:ad",
+		Name: "UniqueText2",
+		IP: "9.9.9.9",
+		Assignee: "bar",
+		Description: "Even more unique text",
+	})
+	if resp != http.StatusCreated {
+		handleError(t, resp, "addCompuer")
+	}
+
+	compareSQLFiles(t, filename, "expected2.sqlite")
+
+	teardownTest(t)
+
+	fmt.Printf("Test TestSQLStorage complete.\n")
+}
+
+func TestSQLMigration(t *testing.T) {
+
+	fmt.Printf("Starting test TestSQLMigration.\n")
+
+	// expected1.sqlite predates schema_version, so work on a copy of it.
+	var filename = testfile + "-migration.sqlite"
+	old, err := ioutil.ReadFile("expected1.sqlite")
+	if err != nil {
+		t.Fatalf("Error reading expected1.sqlite: %s", err.Error())
+	}
+	err = ioutil.WriteFile(filename, old, 0666)
+	if err != nil {
+		t.Fatalf("Error copying expected1.sqlite: %s", err.Error())
+	}
+	defer os.Remove(filename)
+
+	if _, version := readSQLFile(t, filename); version != 0 {
+		t.Fatalf("Unexpected schema version %d before migration", version)
+	}
+
+	var store dataInterface
+	err = initSQL(&store, filename)
+	if err != nil {
+		t.Fatalf("Error opening old SQL file: %s", err.Error())
+	}
+
+	// Same IP, different MAC and Name - allowed by the old composite key.
+	err = store.Add(Computer {
+		MAC: "de:ad:de:ad:de:ad",
+		Name: "OtherName",
+		IP: "8.8.8.8",
+	})
+	if err == nil {
+		t.Errorf("Duplicate IP was accepted after migration")
+	}
+
+	store.Close()
+
+	// Reopening must not apply anything twice.
+	err = initSQL(&store, filename)
+	if err != nil {
+		t.Fatalf("Error reopening migrated SQL file: %s", err.Error())
+	}
+	store.Close()
+
+	cl, version := readSQLFile(t, filename)
+	if version != sqlMigrations[len(sqlMigrations)-1].version {
+		t.Errorf("Unexpected schema version %d after migration", version)
+	}
+	if len(cl) != 1 || cl[0].Name != "UniqueText" || cl[0].Assignee != "foo" {
+		t.Errorf("Unexpected contents after migration: %v", cl)
+	}
+	// SQLite would store IPv6 addresses in VARCHAR(15) as well, so check
+	// the definition instead.
+	if def := sqlTableDefinition(t, filename, "computers"); !strings.Contains(def, "IP VARCHAR(45) NOT NULL UNIQUE") {
+		t.Errorf("IP wasn't widened by the migration: %s", def)
+	}
+	for _, table := range([]string{ "computers", "assignment_events", "archived_computers" }) {
+		if def := sqlTableDefinition(t, filename, table); !strings.Contains(def, "Assignee VARCHAR(16)") {
+			t.Errorf("Assignee of %s wasn't widened by the migration: %s", table, def)
+		}
+	}
+
+	fmt.Printf("Test TestSQLMigration complete.\n")
+}
+
+func TestVolatileIndexes(t *testing.T) {
+
+	fmt.Printf("Starting test TestVolatileIndexes.\n")
+
+	vs := newVolatileStore()
+	for i := 0; i < 6; i++ {
+		assignee := ""
+		if i % 2 == 0 {
+			assignee = "mmu"
+		}
+		err := vs.Add(benchComputer(i, assignee))
+		if err != nil {
+			t.Fatalf("Error adding computer %d: %s", i, err.Error())
+		}
+	}
+
+	// Delete from the middle so that the last record gets moved.
+	err := vs.Delete(KeyName, "TestComputer2")
+	if err != nil {
+		t.Fatalf("Error deleting computer: %s", err.Error())
+	}
+	err = vs.Assign(KeyIP, benchComputer(5, "").IP, "ima")
+	if err != nil {
+		t.Fatalf("Error assigning computer: %s", err.Error())
+	}
+
+	err, c := vs.Read(KeyMAC, benchComputer(5, "").MAC)
+	if err != nil || c.Name != "TestComputer5" || c.Assignee != "ima" {
+		t.Errorf("Unexpected computer read after delete and assign: %v (%v)", c, err)
+	}
+	err, _ = vs.Read(KeyIP, benchComputer(2, "").IP)
+	if err != errNotFound {
+		t.Errorf("Deleted computer is still indexed by IP.")
+	}
+
+	err, cl := vs.ReadAll(KeyAssignee, "mmu")
+	if err != nil || len(cl) != 2 || cl[0].Name != "TestComputer0" || cl[1].Name != "TestComputer4" {
+		t.Errorf("Unexpected computers assigned to mmu: %v (%v)", cl, err)
+	}
+	err, cl = vs.ReadAll(KeyNotAssigned, "")
+	if err != nil || len(cl) != 2 {
+		t.Errorf("Unexpected unassigned computers: %v (%v)", cl, err)
+	}
+
+	err = vs.Add(benchComputer(4, ""))
+	if err != errAlreadyExists {
+		t.Errorf("Expected duplicate to be refused, got %v", err)
+	}
+
+	fmt.Printf("Test TestVolatileIndexes complete.\n")
+}
+
+func TestJSONJournal(t *testing.T) {
+
+	fmt.Printf("Starting test TestJSONJournal.\n")
+
+	var store dataInterface
+	var filename = testfile + "-journal.json"
+	os.Remove(filename)
+	os.Remove(filename + ".journal")
+	defer os.Remove(filename)
+	defer os.Remove(filename + ".journal")
+
+	jsonJournal = true
+	defer func() { jsonJournal = false }()
+
+	err := initJSON(&store, filename)
+	if err != nil {
+		t.Fatalf("Error initializing JSON storage: %s", err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		err = store.Add(benchComputer(i, ""))
+		if err != nil {
+			t.Fatalf("Error adding computer %d: %s", i, err.Error())
+		}
+	}
+	err = store.Assign(KeyName, "TestComputer1", "mmu")
+	if err != nil {
+		t.Fatalf("Error assigning computer: %s", err.Error())
+	}
+	err = store.Delete(KeyName, "TestComputer0")
+	if err != nil {
+		t.Fatalf("Error deleting computer: %s", err.Error())
+	}
+
+	// The snapshot must be untouched, the changes only live in the journal.
+	got, err := ioutil.ReadFile(filename)
+	if err != nil || string(got) != "[]" {
+		t.Errorf("Unexpected snapshot contents <%s> (%v)", got, err)
+	}
+
+	// Simulate a crash in the middle of appending a record.
+	journal, err := os.OpenFile(filename + ".journal", os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatalf("Error opening journal: %s", err.Error())
+	}
+	journal.WriteString(`{"op":"add","computer":{"mac":`)
+	journal.Close()
+
+	// Reopen without closing, as if the process had died.
+	jsonJournal = false
+	err = initJSON(&store, filename)
+	if err != nil {
+		t.Fatalf("Error reopening JSON storage: %s", err.Error())
+	}
+
+	err, cl := store.ReadAll(KeyAll, "")
+	if err != nil || len(cl) != 2 {
+		t.Fatalf("Unexpected computers after replay: %v (%v)", cl, err)
+	}
+	err, c := store.Read(KeyName, "TestComputer1")
+	if err != nil || c.Assignee != "mmu" {
+		t.Errorf("Assignment was not replayed: %v (%v)", c, err)
+	}
+
+	// Without journaling, the journal is folded into the snapshot.
+	if _, err := os.Stat(filename + ".journal"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Journal was not removed after folding it into the snapshot.")
+	}
+	if _, err := os.Stat(filename + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Temporary snapshot file was left behind.")
+	}
+
+	fmt.Printf("Test TestJSONJournal complete.\n")
+}
+
+func TestJSONArchiveJournal(t *testing.T) {
+
+	fmt.Printf("Starting test TestJSONArchiveJournal.\n")
+
+	var store dataInterface
+	var filename = testfile + "-archive.json"
+	for _, suffix := range([]string{"", ".journal", ".archive", ".history"}) {
+		os.Remove(filename + suffix)
+		defer os.Remove(filename + suffix)
+	}
+
+	jsonJournal = true
+	defer func() { jsonJournal = false }()
+
+	err := initJSON(&store, filename)
+	if err != nil {
+		t.Fatalf("Error initializing JSON storage: %s", err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		err = store.Add(benchComputer(i, "mmu"))
+		if err != nil {
+			t.Fatalf("Error adding computer %d: %s", i, err.Error())
+		}
+		err = store.Archive(KeyMAC, benchComputer(i, "").MAC, "broken")
+		if err != nil {
+			t.Fatalf("Error archiving computer %d: %s", i, err.Error())
+		}
+	}
+	err, _ = store.Restore(1)
+	if err != nil {
+		t.Fatalf("Error restoring computer: %s", err.Error())
+	}
+	err = store.Purge(2)
+	if err != nil {
+		t.Fatalf("Error purging computer: %s", err.Error())
+	}
+
+	// Reopen without closing, and replay the journal on top of nothing.
+	err = initJSON(&store, filename)
+	if err != nil {
+		t.Fatalf("Error reopening JSON storage: %s", err.Error())
+	}
+	err, al := store.ReadArchived()
+	if err != nil || len(al) != 1 || al[0].ID != 3 || al[0].Reason != "broken" || al[0].Assignee != "mmu" {
+		t.Errorf("Unexpected archive after replay: %v (%v)", al, err)
+	}
+	err, c := store.Read(KeyName, "TestComputer0")
+	if err != nil || c.Revision != 2 {
+		t.Errorf("Restore was not replayed: %v (%v)", c, err)
+	}
+
+	// Compacting writes the archive next to the snapshot.
+	store.Close()
+	jsonJournal = false
+	err = initJSON(&store, filename)
+	if err != nil {
+		t.Fatalf("Error reopening JSON storage: %s", err.Error())
+	}
+	err, al = store.ReadArchived()
+	if err != nil || len(al) != 1 || al[0].ID != 3 {
+		t.Errorf("Unexpected archive after compaction: %v (%v)", al, err)
+	}
+
+	fmt.Printf("Test TestJSONArchiveJournal complete.\n")
+}
+
+func TestJSONTxPersistence(t *testing.T) {
+
+	fmt.Printf("Starting test TestJSONTxPersistence.\n")
+
+	var store dataInterface
+	var filename = testfile + "-tx.json"
+	defer func() { jsonJournal = false }()
+	assign := func(tx dataInterface) error {
+		err, c := tx.Read(KeyMAC, benchComputer(0, "").MAC)
+		if err != nil {
+			return err
+		}
+		err = tx.Assign(KeyMAC, c.MAC, "mmu")
+		if err != nil {
+			return err
+		}
+		return tx.AddEvent(newEvent(*c, "mmu", "admin"))
+	}
+
+	// A transaction that can't be written leaves nothing behind, in memory
+	// or on disk.
+	for _, journal := range([]bool{ false, true }) {
+		for _, suffix := range([]string{"", ".journal", ".history"}) {
+			os.Remove(filename + suffix)
+			defer os.Remove(filename + suffix)
+		}
+		jsonJournal = journal
+		err := initJSON(&store, filename)
+		if err != nil {
+			t.Fatalf("Error initializing JSON storage: %s", err.Error())
+		}
+		err = store.Add(benchComputer(0, ""))
+		if err != nil {
+			t.Fatalf("Error adding computer: %s", err.Error())
+		}
+		j := store.(*jsonStore)
+		if journal {
+			j.journal.Close()
+		} else {
+			j.filename = filename + ".missing/" + filename
+		}
+		err = store.WithTx(assign)
+		if err == nil {
+			t.Errorf("Transaction that couldn't be written succeeded (journal %v)", journal)
+		}
+		check := func(when string) {
+			err, c := store.Read(KeyMAC, benchComputer(0, "").MAC)
+			if err != nil || c.Assignee != "" {
+				t.Errorf("Failed assignment is left %s (journal %v): %v (%v)", when, journal, c, err)
+			}
+			err, el := store.ReadEvents(KeyAll, "")
+			if err != errNotFound {
+				t.Errorf("Failed event is left %s (journal %v): %v (%v)", when, journal, el, err)
+			}
+		}
+		check("in memory")
+		err = initJSON(&store, filename)
+		if err != nil {
+			t.Fatalf("Error reopening JSON storage: %s", err.Error())
+		}
+		check("on disk")
+		store.Close()
+	}
+
+	// With a journal, events are only moved to the history on compaction,
+	// and a crash in between doesn't duplicate them.
+	err := initJSON(&store, filename)
+	if err != nil {
+		t.Fatalf("Error reopening JSON storage: %s", err.Error())
+	}
+	err = store.WithTx(assign)
+	if err != nil {
+		t.Fatalf("Error assigning computer: %s", err.Error())
+	}
+	err = store.(*jsonStore).flushEvents()
+	if err != nil {
+		t.Fatalf("Error flushing events: %s", err.Error())
+	}
+	err = initJSON(&store, filename)
+	if err != nil {
+		t.Fatalf("Error reopening JSON storage: %s", err.Error())
+	}
+	err, el := store.ReadEvents(KeyAll, "")
+	if err != nil || len(el) != 1 || el[0].NewAssignee != "mmu" {
+		t.Errorf("Unexpected events after replay: %v (%v)", el, err)
+	}
+	err, c := store.Read(KeyMAC, benchComputer(0, "").MAC)
+	if err != nil || c.Assignee != "mmu" {
+		t.Errorf("Assignment was not replayed: %v (%v)", c, err)
+	}
+	store.Close()
+
+	fmt.Printf("Test TestJSONTxPersistence complete.\n")
+}
+
+func subTestTransactions(t *testing.T, store dataInterface) {
+
+	for i := 0; i < 3; i++ {
+		err := store.Add(benchComputer(i, "mmu"))
+		if err != nil {
+			t.Fatalf("Error adding computer %d: %s", i, err.Error())
+		}
+	}
+	err, before := store.ReadAll(KeyAll, "")
+	if err != nil {
+		t.Fatalf("Error reading computers: %s", err.Error())
+	}
+
+	// Move a computer, delete another and add a third, then fail.
+	errAbort := errors.New("abort")
+	err = store.WithTx(func(tx dataInterface) error {
+		if err := tx.Unassign(KeyName, "TestComputer0"); err != nil {
+			return err
+		}
+		if err := tx.Assign(KeyName, "TestComputer0", "ima"); err != nil {
+			return err
+		}
+		if err := tx.Delete(KeyName, "TestComputer1"); err != nil {
+			return err
+		}
+		if err := tx.Add(benchComputer(3, "")); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("Unexpected transaction result %v", err)
+	}
+
+	err, after := store.ReadAll(KeyAll, "")
+	if err != nil || len(after) != len(before) {
+		t.Fatalf("Unexpected computers after rollback: %v (%v)", after, err)
+	}
+	for i := range(before) {
+		if before[i] != after[i] {
+			t.Errorf("Computer not restored by rollback: %v != %v", after[i], before[i])
+		}
+	}
+	err, _ = store.ReadAll(KeyAssignee, "ima")
+	if err != errNotFound {
+		t.Errorf("Assignment survived rollback")
+	}
+
+	// The same transaction without the failure must stick.
+	err = store.WithTx(func(tx dataInterface) error {
+		if err := tx.Assign(KeyName, "TestComputer0", "ima"); err != nil {
+			return err
+		}
+		return tx.Delete(KeyName, "TestComputer1")
+	})
+	if err != nil {
+		t.Fatalf("Error committing transaction: %s", err.Error())
+	}
+	err, c := store.Read(KeyName, "TestComputer0")
+	if err != nil || c.Assignee != "ima" {
+		t.Errorf("Committed assignment is missing: %v (%v)", c, err)
+	}
+	err, _ = store.Read(KeyName, "TestComputer1")
+	if err != errNotFound {
+		t.Errorf("Committed deletion is missing")
+	}
+}
+
+func TestTransactionsVolatile(t *testing.T) {
+	fmt.Printf("Starting test TestTransactionsVolatile.\n")
+	subTestTransactions(t, newVolatileStore())
+	fmt.Printf("Test TestTransactionsVolatile complete.\n")
+}
+
+func TestTransactionsJSON(t *testing.T) {
+
+	fmt.Printf("Starting test TestTransactionsJSON.\n")
+
+	var store dataInterface
+	var filename = testfile + "-tx.json"
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	err := initJSON(&store, filename)
+	if err != nil {
+		t.Fatalf("Error initializing JSON storage: %s", err.Error())
+	}
+	subTestTransactions(t, store)
+
+	// Only the committed transaction may have reached the file.
+	err = initJSON(&store, filename)
+	if err != nil {
+		t.Fatalf("Error reopening JSON storage: %s", err.Error())
+	}
+	err, cl := store.ReadAll(KeyAll, "")
+	if err != nil || len(cl) != 2 {
+		t.Errorf("Unexpected computers in JSON file: %v (%v)", cl, err)
+	}
+
+	fmt.Printf("Test TestTransactionsJSON complete.\n")
+}
+
+func TestTransactionsSQL(t *testing.T) {
+
+	fmt.Printf("Starting test TestTransactionsSQL.\n")
+
+	var store dataInterface
+	var filename = testfile + "-tx.sqlite"
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	err := initSQL(&store, filename)
+	if err != nil {
+		t.Fatalf("Error initializing SQL storage: %s", err.Error())
+	}
+	subTestTransactions(t, store)
+	store.Close()
+
+	fmt.Printf("Test TestTransactionsSQL complete.\n")
+}
+
+func TestConvert(t *testing.T) {
+
+	fmt.Printf("Starting test TestConvert.\n")
+
+	var src, dst dataInterface
+	var from = testfile + "-from.json"
+	var to = testfile + "-to.json"
+	for _, suffix := range(testStoreSuffixes) {
+		os.Remove(from + suffix)
+		os.Remove(to + suffix)
+		defer os.Remove(from + suffix)
+		defer os.Remove(to + suffix)
+	}
+
+	// The source is left with a journal, as if its server had crashed.
+	jsonJournal = true
+	defer func() { jsonJournal = false }()
+	err := initJSON(&src, from)
+	if err != nil {
+		t.Fatalf("Error initializing source: %s", err.Error())
+	}
+	err = src.AddEmployee(Employee{ Code: "mmu", FullName: "Test mmu", Active: true })
+	if err != nil {
+		t.Fatalf("Error adding employee: %s", err.Error())
+	}
+	for i := 0; i < 5; i++ {
+		src.Add(benchComputer(i, "mmu"))
+	}
+	c := benchComputer(0, "mmu")
+	src.AddEvent(AssignmentEvent{ MAC: c.MAC, Name: c.Name, IP: c.IP, NewAssignee: "mmu", Time: time.Now().UTC(), Actor: "test" })
+	src.Archive(KeyName, benchComputer(4, "").Name, "retired")
+	src.AddOutbox(OutboxEntry{ Notification: Notification{ Employee: "mmu" }, Status: outboxPending, Created: time.Now().UTC() })
+	fromFiles := make(map[string][]byte)
+	for _, suffix := range(testStoreSuffixes) {
+		data, err := os.ReadFile(from + suffix)
+		if err == nil {
+			fromFiles[suffix] = data
+		}
+	}
+	if len(fromFiles[".journal"]) == 0 {
+		t.Fatalf("Source has no journal")
+	}
+
+	// The destination already holds a computer with the IP of the second one.
+	err = initJSON(&dst, to)
+	if err != nil {
+		t.Fatalf("Error initializing destination: %s", err.Error())
+	}
+	taken := benchComputer(9, "")
+	taken.IP = benchComputer(1, "").IP
+	dst.Add(taken)
+	dst.Close()
+
+	if status := runConvert([]string{"--from", "json:" + from, "--to", "volatile:x"}); status != 2 {
+		t.Errorf("Converting to volatile storage returned %d", status)
+	}
+	if status := runConvert([]string{"--from", "json:" + from, "--to", "json:" + to}); status != 1 {
+		t.Errorf("Conversion with a rejected record returned %d", status)
+	}
+
+	err = initJSON(&dst, to)
+	if err != nil {
+		t.Fatalf("Error reopening destination: %s", err.Error())
+	}
+	err, cl := dst.ReadAll(KeyAll, "")
+	if err != nil || len(cl) != 4 {
+		t.Fatalf("Unexpected computers after conversion: %v (%v)", cl, err)
+	}
+	err, _ = dst.Read(KeyName, "TestComputer1")
+	if err != errNotFound {
+		t.Errorf("Duplicate computer was converted")
+	}
+	err, _ = dst.ReadEmployee("mmu")
+	if err != nil {
+		t.Errorf("Employee was not converted")
+	}
+	err, events := dst.ReadEvents(KeyAll, "")
+	if err != nil || len(events) != 1 || events[0].Actor != "test" {
+		t.Errorf("Unexpected history after conversion: %v (%v)", events, err)
+	}
+	err, al := dst.ReadArchived()
+	if err != nil || len(al) != 1 || al[0].Name != benchComputer(4, "").Name || al[0].Reason != "retired" {
+		t.Errorf("Unexpected archive after conversion: %v (%v)", al, err)
+	}
+	err, ol := dst.ReadOutbox("")
+	if err != nil || len(ol) != 1 || ol[0].Notification.Employee != "mmu" {
+		t.Errorf("Unexpected outbox after conversion: %v (%v)", ol, err)
+	}
+	dst.Close()
+
+	// The conversion must leave its source as it was.
+	for _, suffix := range(testStoreSuffixes) {
+		data, err := os.ReadFile(from + suffix)
+		if err != nil && fromFiles[suffix] != nil {
+			t.Errorf("Conversion removed %s", from + suffix)
+		} else if err == nil && string(data) != string(fromFiles[suffix]) {
+			t.Errorf("Conversion modified %s", from + suffix)
+		}
+	}
+
+	fmt.Printf("Test TestConvert complete.\n")
+}
+
+/**************/
+/* Benchmarks */
+/**************/
+
+// sliceStore is the linear-scan volatile store SampDB used before the indexed
+// one. It is only kept around as a baseline for the benchmarks below.
+type sliceStore struct {
+	data []Computer
+}
+
+func (s *sliceStore) Read (keytype, key string) (error, *Computer) {
+	for _, c := range(s.data) {
+		if (keytype == KeyMAC && c.MAC == key) ||
+		   (keytype == KeyName && c.Name == key) ||
+		   (keytype == KeyIP && c.IP == key) {
+			return nil, &c
+		}
+	}
+	return errNotFound, nil
+}
+
+func (s *sliceStore) ReadAll (keytype, key string) (error, []Computer) {
+	var cl []Computer
+	for _, c := range(s.data) {
+		if c.Assignee == key {
+			cl = append(cl, c)
+		}
+	}
+	return nil, cl
+}
+
+func (s *sliceStore) Add (c Computer) error {
+	for _, nvc := range(s.data) {
+		if c.MAC == nvc.MAC || c.Name == nvc.Name || c.IP == nvc.IP {
+			return errAlreadyExists
+		}
+	}
+	s.data = append(s.data, c)
+	return nil
+}
+
+func (s *sliceStore) Assign (keytype, key, assignee string) error {
+	for n := range(s.data) {
+		if (keytype == KeyMAC && s.data[n].MAC == key) ||
+		   (keytype == KeyName && s.data[n].Name == key) ||
+		   (keytype == KeyIP && s.data[n].IP == key) {
+			s.data[n].Assignee = assignee
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+const benchSize = 20000
+
+func benchComputer(i int, assignee string) Computer {
+	return Computer {
+		MAC: fmt.Sprintf("%02x:%02x:%02x:00:00:00", i >> 16 & 0xff, i >> 8 & 0xff, i & 0xff),
+		Name: fmt.Sprintf("TestComputer%d", i),
+		IP: fmt.Sprintf("10.%d.%d.%d", i >> 16 & 0xff, i >> 8 & 0xff, i & 0xff),
+		Assignee: assignee,
+	}
+}
+
+func benchAssignee(i int) string {
+	return fmt.Sprintf("e%02d", i % 100)
+}
+
+func fillVolatile() *volatileStore {
+	vs := newVolatileStore()
+	for i := 0; i < benchSize; i++ {
+		vs.Add(benchComputer(i, benchAssignee(i)))
+	}
+	return vs
+}
+
+func fillSlice() *sliceStore {
+	ss := &sliceStore{}
+	for i := 0; i < benchSize; i++ {
+		ss.data = append(ss.data, benchComputer(i, benchAssignee(i)))
+	}
+	return ss
+}
+
+func BenchmarkReadByNameIndexed(b *testing.B) {
+	vs := fillVolatile()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vs.Read(KeyName, fmt.Sprintf("TestComputer%d", i % benchSize))
+	}
+}
+
+func BenchmarkReadByNameSlice(b *testing.B) {
+	ss := fillSlice()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ss.Read(KeyName, fmt.Sprintf("TestComputer%d", i % benchSize))
+	}
+}
+
+func BenchmarkReadAllByAssigneeIndexed(b *testing.B) {
+	vs := fillVolatile()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vs.ReadAll(KeyAssignee, benchAssignee(i))
+	}
+}
+
+func BenchmarkReadAllByAssigneeSlice(b *testing.B) {
+	ss := fillSlice()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ss.ReadAll(KeyAssignee, benchAssignee(i))
+	}
+}
+
+func BenchmarkAssignByIPIndexed(b *testing.B) {
+	vs := fillVolatile()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vs.Assign(KeyIP, benchComputer(i % benchSize, "").IP, benchAssignee(i + 1))
+	}
+}
+
+func BenchmarkAssignByIPSlice(b *testing.B) {
+	ss := fillSlice()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ss.Assign(KeyIP, benchComputer(i % benchSize, "").IP, benchAssignee(i + 1))
+	}
+}
+
+func BenchmarkAddIndexed(b *testing.B) {
+	vs := fillVolatile()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vs.Add(benchComputer(benchSize + i, ""))
+	}
+}
+
+func BenchmarkAddSlice(b *testing.B) {
+	ss := fillSlice()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ss.Add(benchComputer(benchSize + i, ""))
+	}
 }